@@ -0,0 +1,105 @@
+package main
+
+import (
+	"better-media/pkg/models"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	maxBatchSize = 1000
+	// Items are checked against S3 and enqueued concurrently, bounded so a large batch does
+	// not open a thousand connections at once
+	batchWorkers = 16
+)
+
+type BatchJobResult struct {
+	Index   int    `json:"index"`
+	VideoID string `json:"video_id,omitempty"`
+	Status  int    `json:"status"`
+	JobID   string `json:"job_id,omitempty"`
+	TaskID  string `json:"task_id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (api *API) handleTranscodingJobsMethod(c *gin.Context) {
+	switch c.Param("method") {
+	case ":batch":
+		api.handleCreateTranscodingJobBatch(c)
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown method"})
+	}
+}
+
+// handleCreateTranscodingJobBatch queues many jobs in one request. Every item is validated
+// and queued on its own and gets its own result; one bad item never fails the batch.
+// Items without a priority go to the bulk queue, as batches are typically backfills.
+func (api *API) handleCreateTranscodingJobBatch(c *gin.Context) {
+	var items []models.VideoEncodingPayload
+	if err := c.ShouldBindJSON(&items); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: expected an array of jobs"})
+		return
+	}
+	if len(items) == 0 || len(items) > maxBatchSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A batch must contain between 1 and %d jobs", maxBatchSize)})
+		return
+	}
+
+	tenant := tenantID(c)
+	results := make([]BatchJobResult, len(items))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchWorkers)
+
+	for i, item := range items {
+		results[i] = BatchJobResult{Index: i, VideoID: item.VideoID}
+
+		// ShouldBindJSON only validates the slice itself, not its elements
+		if err := binding.Validator.ValidateStruct(&item); err != nil {
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = "Invalid job: " + err.Error()
+			continue
+		}
+		if item.Priority == "" {
+			item.Priority = models.QueueBulk
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, item models.VideoEncodingPayload) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			status, body := api.enqueueEncodingJob(c.Request.Context(), tenant, item)
+			results[i].Status = status
+			if v, ok := body["job_id"].(string); ok {
+				results[i].JobID = v
+			}
+			if v, ok := body["task_id"].(string); ok {
+				results[i].TaskID = v
+			}
+			if v, ok := body["error"].(string); ok {
+				results[i].Error = v
+			}
+		}(i, item)
+	}
+
+	wg.Wait()
+
+	queued := 0
+	for _, result := range results {
+		if result.Status == http.StatusOK {
+			queued++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"queued":  queued,
+		"failed":  len(results) - queued,
+		"results": results,
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Clients may send an Idempotency-Key header on job creation. The first request with a key
+// is processed and its response stored; repeating the request with the same key and body
+// replays that response instead of queueing another job.
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	idempotencyTTL    = 24 * time.Hour
+)
+
+type idempotentResponse struct {
+	RequestHash string `json:"request_hash"`
+	Status      int    `json:"status"`
+	Body        gin.H  `json:"body,omitempty"`
+}
+
+func idempotencyRedisKey(tenant, key string) string {
+	return "better-media:idempotency:" + tenant + ":" + key
+}
+
+func hashRequest(v any) string {
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// beginIdempotent claims an idempotency key for this request. It returns false after having
+// written the response itself: a replay of the stored response, or an error when the key
+// is in use by a request that is still running or had a different body.
+func (api *API) beginIdempotent(c *gin.Context, key string, request any) bool {
+	redisKey := idempotencyRedisKey(tenantID(c), key)
+	requestHash := hashRequest(request)
+
+	placeholder, _ := json.Marshal(idempotentResponse{RequestHash: requestHash})
+	claimed, err := api.Redis.SetNX(c.Request.Context(), redisKey, placeholder, idempotencyTTL).Result()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key"})
+		return false
+	}
+	if claimed {
+		return true
+	}
+
+	raw, err := api.Redis.Get(c.Request.Context(), redisKey).Bytes()
+	if err == redis.Nil {
+		// Expired between SETNX and GET, let the client try again
+		c.JSON(http.StatusConflict, gin.H{"error": "Request with this Idempotency-Key is in progress"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key"})
+		return false
+	}
+
+	var stored idempotentResponse
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key"})
+		return false
+	}
+
+	switch {
+	case stored.RequestHash != requestHash:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used with a different request"})
+	case stored.Status == 0:
+		c.JSON(http.StatusConflict, gin.H{"error": "Request with this Idempotency-Key is in progress"})
+	default:
+		c.Header("Idempotent-Replayed", "true")
+		c.JSON(stored.Status, stored.Body)
+	}
+	return false
+}
+
+// finishIdempotent stores the response for replays and writes it. Server errors release the
+// key instead, so the client can retry with it.
+func (api *API) finishIdempotent(c *gin.Context, key string, request any, status int, body gin.H) {
+	redisKey := idempotencyRedisKey(tenantID(c), key)
+
+	if status >= http.StatusInternalServerError {
+		api.Redis.Del(c.Request.Context(), redisKey)
+	} else {
+		data, _ := json.Marshal(idempotentResponse{RequestHash: hashRequest(request), Status: status, Body: body})
+		api.Redis.Set(c.Request.Context(), redisKey, data, idempotencyTTL)
+	}
+
+	c.JSON(status, body)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"better-media/internal/jobs"
+	"better-media/pkg/models"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hibiken/asynq"
+)
+
+// TaskStatus is the view of an asynq task returned by the job API
+type TaskStatus struct {
+	ID            string          `json:"id"`
+	Queue         string          `json:"queue"`
+	Type          string          `json:"type"`
+	State         string          `json:"state"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	LastError     string          `json:"last_error,omitempty"`
+	Retried       int             `json:"retried"`
+	MaxRetry      int             `json:"max_retry"`
+	LastFailedAt  *time.Time      `json:"last_failed_at,omitempty"`
+	NextProcessAt *time.Time      `json:"next_process_at,omitempty"`
+	CompletedAt   *time.Time      `json:"completed_at,omitempty"`
+
+	// Result is what the task produced, see models.EncodingResult
+	Result json.RawMessage `json:"result,omitempty"`
+
+	// Job is the state of the job graph the task belongs to, if any
+	Job *jobs.Job `json:"job,omitempty"`
+}
+
+// taskPayload holds the fields shared by the payloads of all job tasks
+type taskPayload struct {
+	JobID    string `json:"job_id"`
+	TenantID string `json:"tenant_id"`
+}
+
+var taskStates = []string{"pending", "active", "scheduled", "retry", "archived", "completed"}
+
+func newTaskStatus(info *asynq.TaskInfo) TaskStatus {
+	status := TaskStatus{
+		ID:            info.ID,
+		Queue:         info.Queue,
+		Type:          info.Type,
+		State:         info.State.String(),
+		LastError:     info.LastErr,
+		Retried:       info.Retried,
+		MaxRetry:      info.MaxRetry,
+		LastFailedAt:  optionalTime(info.LastFailedAt),
+		NextProcessAt: optionalTime(info.NextProcessAt),
+		CompletedAt:   optionalTime(info.CompletedAt),
+	}
+	if json.Valid(info.Payload) {
+		status.Payload = info.Payload
+	}
+	if len(info.Result) > 0 && json.Valid(info.Result) {
+		status.Result = info.Result
+	}
+	return status
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func parseTaskPayload(info *asynq.TaskInfo) taskPayload {
+	var payload taskPayload
+	json.Unmarshal(info.Payload, &payload)
+	return payload
+}
+
+// ownsTask reports whether a task belongs to the tenant. Tasks without a tenant, such as
+// maintenance tasks, belong to no tenant.
+func ownsTask(info *asynq.TaskInfo, tenant string) bool {
+	owner := parseTaskPayload(info).TenantID
+	return owner != "" && owner == tenant
+}
+
+func listTasks(inspector *asynq.Inspector, queue, state string, opts ...asynq.ListOption) ([]*asynq.TaskInfo, error) {
+	switch state {
+	case "pending":
+		return inspector.ListPendingTasks(queue, opts...)
+	case "active":
+		return inspector.ListActiveTasks(queue, opts...)
+	case "scheduled":
+		return inspector.ListScheduledTasks(queue, opts...)
+	case "retry":
+		return inspector.ListRetryTasks(queue, opts...)
+	case "archived":
+		return inspector.ListArchivedTasks(queue, opts...)
+	case "completed":
+		return inspector.ListCompletedTasks(queue, opts...)
+	}
+	return nil, errors.New("unknown state " + state)
+}
+
+// findTask looks a task up in the given queue, or in every queue when queue is empty
+func (api *API) findTask(taskID, queue string) (*asynq.TaskInfo, error) {
+	queues := []string{queue}
+	if queue == "" {
+		var err error
+		if queues, err = api.Inspector.Queues(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, q := range queues {
+		info, err := api.Inspector.GetTaskInfo(q, taskID)
+		if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+			continue
+		}
+		return info, err
+	}
+	return nil, asynq.ErrTaskNotFound
+}
+
+// handleListJobs lists the tasks of the tenant, optionally filtered by queue and state.
+// page and page_size apply to each queue and state before the tenant filter, so a page
+// may hold fewer tasks than page_size.
+func (api *API) handleListJobs(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "page must be a positive number"})
+		return
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if err != nil || pageSize <= 0 || pageSize > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "page_size must be between 1 and 500"})
+		return
+	}
+
+	states := taskStates
+	if state := c.Query("state"); state != "" {
+		if !slices.Contains(taskStates, state) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown state: " + state, "states": taskStates})
+			return
+		}
+		states = []string{state}
+	}
+
+	queues := []string{c.Query("queue")}
+	if queues[0] == "" {
+		if queues, err = api.Inspector.Queues(); err != nil {
+			log.Printf("Error listing queues: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list jobs"})
+			return
+		}
+	}
+
+	tenant := tenantID(c)
+	tasks := []TaskStatus{}
+	for _, queue := range queues {
+		for _, state := range states {
+			infos, err := listTasks(api.Inspector, queue, state, asynq.Page(page), asynq.PageSize(pageSize))
+			if errors.Is(err, asynq.ErrQueueNotFound) {
+				continue
+			}
+			if err != nil {
+				log.Printf("Error listing %s tasks of queue %s: %v", state, queue, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list jobs"})
+				return
+			}
+			for _, info := range infos {
+				if ownsTask(info, tenant) {
+					tasks = append(tasks, newTaskStatus(info))
+				}
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"jobs": tasks, "page": page, "page_size": pageSize})
+}
+
+func (api *API) handleGetJob(c *gin.Context) {
+	info, err := api.findTask(c.Param("taskId"), c.Query("queue"))
+	if errors.Is(err, asynq.ErrTaskNotFound) || (err == nil && !ownsTask(info, tenantID(c))) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting task %s: %v", c.Param("taskId"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get job"})
+		return
+	}
+
+	status := newTaskStatus(info)
+	if jobID := parseTaskPayload(info).JobID; jobID != "" {
+		job, err := api.Jobs.Get(c.Request.Context(), jobID)
+		if err != nil && !errors.Is(err, jobs.ErrJobNotFound) {
+			log.Printf("Error getting job %s: %v", jobID, err)
+		}
+		status.Job = job
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// handleRetryJob runs an archived task again. A job is retried from its first task, which
+// resets the failed job graph; its fan-out tasks cannot be retried on their own because
+// their siblings were abandoned when the job failed.
+func (api *API) handleRetryJob(c *gin.Context) {
+	info, err := api.findTask(c.Param("taskId"), c.Query("queue"))
+	if errors.Is(err, asynq.ErrTaskNotFound) || (err == nil && !ownsTask(info, tenantID(c))) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting task %s: %v", c.Param("taskId"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry job"})
+		return
+	}
+
+	if info.State != asynq.TaskStateArchived {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only archived jobs can be retried", "state": info.State.String()})
+		return
+	}
+
+	switch info.Type {
+	case models.TaskEncodeRendition, models.TaskFinalizeVideo, models.TaskEncodeChunk, models.TaskStitchVideo:
+		c.JSON(http.StatusConflict, gin.H{"error": "This task is part of a failed job, submit the job again to retry it"})
+		return
+	case models.TaskProbeVideo, models.TaskSplitVideo:
+		if jobID := parseTaskPayload(info).JobID; jobID != "" {
+			if err := api.Jobs.Reset(c.Request.Context(), jobID); err != nil {
+				log.Printf("Error resetting job %s: %v", jobID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry job"})
+				return
+			}
+			// The last task of the job has a fixed ID, which an archived copy from the
+			// failed run would still hold
+			for _, id := range []string{models.FinalizeTaskID(jobID), models.StitchTaskID(jobID)} {
+				if err := api.Inspector.DeleteTask(info.Queue, id); err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+					log.Printf("Error deleting task %s of job %s: %v", id, jobID, err)
+				}
+			}
+		}
+	}
+
+	if err := api.Inspector.RunTask(info.Queue, info.ID); err != nil {
+		log.Printf("Error running task %s: %v", info.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry job"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Job has been queued again", "task_id": info.ID})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"better-media/internal/keys"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleGetKey serves a key of an encrypted rendition to a player. The playlists the proxy
+// serves point their EXT-X-KEY tags here with the viewer's token, which is checked like
+// for any other playback request.
+func (api *API) handleGetKey(c *gin.Context) {
+	videoId := c.Param("videoId")
+	keyId := c.Param("keyId")
+
+	if api.Keys == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Segment encryption is not configured"})
+		return
+	}
+	if _, ok := api.authorizePlayback(c, videoId); !ok || !api.enforcePlaybackPolicy(c, videoId) {
+		return
+	}
+
+	found, err := api.Keys.Keys(c.Request.Context(), videoId, []string{keyId})
+	if errors.Is(err, keys.ErrKeyNotFound) || errors.Is(err, keys.ErrInvalidID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading key %s of %s: %v", keyId, videoId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read key"})
+		return
+	}
+
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(http.StatusOK, "application/octet-stream", found[0].Value)
+}
+
+// maxLicenseKeys bounds the key IDs a single license request may ask for
+const maxLicenseKeys = 64
+
+// ClearKeyLicenseRequest is the license request of the W3C ClearKey key system, as a
+// browser's EME implementation sends it. Key IDs are base64url without padding.
+type ClearKeyLicenseRequest struct {
+	KIDs []string `json:"kids" binding:"required,min=1"`
+	Type string   `json:"type"`
+}
+
+// ClearKeyLicense is a JSON Web Key set of the requested keys
+type ClearKeyLicense struct {
+	Keys []ClearKeyJWK `json:"keys"`
+	Type string        `json:"type"`
+}
+
+type ClearKeyJWK struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Key     string `json:"k"`
+}
+
+// handleClearKeyLicense is a ClearKey license server for the keys of a video, checked
+// against the playback token like the key endpoint. Only temporary sessions are granted.
+func (api *API) handleClearKeyLicense(c *gin.Context) {
+	videoId := c.Param("videoId")
+
+	if api.Keys == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Segment encryption is not configured"})
+		return
+	}
+	if _, ok := api.authorizePlayback(c, videoId); !ok || !api.enforcePlaybackPolicy(c, videoId) {
+		return
+	}
+
+	var req ClearKeyLicenseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid license request"})
+		return
+	}
+	if req.Type != "" && req.Type != "temporary" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only temporary sessions are supported"})
+		return
+	}
+	if len(req.KIDs) > maxLicenseKeys {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many key IDs"})
+		return
+	}
+
+	keyIDs := make([]string, 0, len(req.KIDs))
+	for _, kid := range req.KIDs {
+		id, err := base64.RawURLEncoding.DecodeString(kid)
+		if err != nil || len(id) != 16 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key ID " + kid})
+			return
+		}
+		keyIDs = append(keyIDs, hex.EncodeToString(id))
+	}
+
+	found, err := api.Keys.Keys(c.Request.Context(), videoId, keyIDs)
+	if errors.Is(err, keys.ErrKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading keys of %s: %v", videoId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read keys"})
+		return
+	}
+
+	license := ClearKeyLicense{Keys: make([]ClearKeyJWK, 0, len(found)), Type: "temporary"}
+	for i, key := range found {
+		license.Keys = append(license.Keys, ClearKeyJWK{
+			KeyType: "oct",
+			KeyID:   req.KIDs[i],
+			Key:     base64.RawURLEncoding.EncodeToString(key.Value),
+		})
+	}
+
+	c.Header("Cache-Control", "private, no-store")
+	c.JSON(http.StatusOK, license)
+}
@@ -1,12 +1,24 @@
 package main
 
 import (
+	"better-media/internal/catalog"
+	"better-media/internal/config"
+	"better-media/internal/jobs"
+	"better-media/internal/keys"
+	"better-media/internal/playback"
+	"better-media/internal/policy"
+	"better-media/internal/sharing"
 	"better-media/internal/storage"
+	"better-media/internal/webhooks"
+	"better-media/pkg/m3u8"
 	"better-media/pkg/models"
-	"bufio"
-	"fmt"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -19,25 +31,37 @@ import (
 	"github.com/joho/godotenv"
 
 	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
 )
 
 type PresignedRequest struct {
 	FileName string `json:"file_name" binding:"required"`
 }
 
-const redisAddr = "127.0.0.1:6379"
-
 func main() {
 	godotenv.Load()
 	router := gin.Default()
-	config := cors.DefaultConfig()
-	config.AllowOrigins = []string{"http://localhost:3000"}
-	config.AllowMethods = []string{"GET", "POST", "PUT", "OPTIONS"}
-	router.Use(cors.New(config))
+	// X-Forwarded-For is only believed from the proxies in front of the API, anyone else
+	// could name any address in it. Without TRUSTED_PROXIES the client is the peer itself.
+	if err := router.SetTrustedProxies(config.List("TRUSTED_PROXIES", nil)); err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowOrigins = []string{"http://localhost:3000"}
+	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	corsConfig.AddAllowHeaders("X-Tenant-ID", idempotencyHeader)
+	router.Use(cors.New(corsConfig))
 
+	redisAddr := config.String("REDIS_ADDR", "127.0.0.1:6379")
 	asynqClient := asynq.NewClient(asynq.RedisClientOpt{Addr: redisAddr})
 	defer asynqClient.Close()
 
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: redisAddr})
+	defer inspector.Close()
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+	defer rdb.Close()
+
 	s3Client, err := storage.NewS3Client(
 		os.Getenv("S3_BUCKET_NAME"),
 		os.Getenv("S3_ENDPOINT"),
@@ -47,9 +71,53 @@ func main() {
 		log.Fatalf("failed to create s3 client: %v", err)
 	}
 
+	publicBaseURL := strings.TrimSuffix(config.String("PUBLIC_BASE_URL", "http://localhost:8080"), "/")
+	cdn, err := newCDN()
+	if err != nil {
+		log.Fatalf("failed to configure CDN: %v", err)
+	}
+
 	api := &API{
-		S3Client:    s3Client,
-		AsynqClient: asynqClient,
+		S3Client:     s3Client,
+		AsynqClient:  asynqClient,
+		Inspector:    inspector,
+		Redis:        rdb,
+		Jobs:         jobs.NewGraph(rdb),
+		Catalog:      catalog.New(rdb),
+		Webhooks:     webhooks.NewPublisher(rdb, asynqClient, publicBaseURL),
+		WebhookStore: webhooks.NewStore(rdb),
+		Policies:     policy.NewStore(rdb),
+		ShareLinks:   sharing.NewStore(rdb),
+
+		ResultRetention: config.Duration("TASK_RESULT_RETENTION", 24*time.Hour),
+		JobWebhooks:     config.String("WEBHOOK_SECRET", "") != "",
+		PublicBaseURL:   publicBaseURL,
+		CDN:             cdn,
+		SegmentDelivery: config.String("PLAYBACK_SEGMENT_DELIVERY", segmentDeliveryRedirect),
+
+		Playlists:        playback.NewPlaylistCache(config.Int("PLAYLIST_CACHE_SIZE", 10000), s3Client.GetObjectIfChanged),
+		PlaylistCacheTTL: config.Duration("PLAYLIST_CACHE_TTL", 10*time.Minute),
+	}
+	if api.SegmentDelivery != segmentDeliveryRedirect && api.SegmentDelivery != segmentDeliveryStream {
+		log.Printf("WARN invalid PLAYBACK_SEGMENT_DELIVERY=%q, using %s", api.SegmentDelivery, segmentDeliveryRedirect)
+		api.SegmentDelivery = segmentDeliveryRedirect
+	}
+	if secret := config.String("PLAYBACK_TOKEN_SECRET", ""); secret != "" {
+		api.PlaybackTokens = playback.NewSigner(secret)
+		api.Watermarks = playback.NewWatermarker(config.String("WATERMARK_SECRET", secret))
+	}
+	if geoipFile := config.String("GEOIP_DATABASE_FILE", ""); geoipFile != "" {
+		if api.GeoIP, err = policy.OpenGeoIP(geoipFile); err != nil {
+			log.Fatalf("failed to load GEOIP_DATABASE_FILE: %v", err)
+		}
+		log.Printf("Loaded %d GeoIP ranges from %s", api.GeoIP.Len(), geoipFile)
+	}
+	if kek := config.String("KEY_ENCRYPTION_KEY", ""); kek != "" {
+		store, err := keys.NewStore(s3Client, kek)
+		if err != nil {
+			log.Fatalf("failed to configure the key store: %v", err)
+		}
+		api.Keys = store
 	}
 
 	// Version 1
@@ -57,17 +125,79 @@ func main() {
 	{
 		v1.POST("/uploads", api.handleCreateUpload)
 		v1.POST("/jobs/transcoding", api.handleCreateTranscodingJob)
+		// Custom methods use the "resource:method" form, e.g. POST /v1/jobs/transcoding:batch.
+		// The router sees the colon as a parameter, see handleTranscodingJobsMethod.
+		v1.POST("/jobs/transcoding:method", api.handleTranscodingJobsMethod)
+		v1.GET("/jobs", api.handleListJobs)
+		v1.GET("/jobs/:taskId", api.handleGetJob)
+		v1.POST("/jobs/:taskId/retry", api.handleRetryJob)
+
+		v1.POST("/webhooks", api.handleCreateWebhook)
+		v1.GET("/webhooks", api.handleListWebhooks)
+		v1.GET("/webhooks/deliveries", api.handleListWebhookDeliveries)
+		v1.DELETE("/webhooks/:webhookId", api.handleDeleteWebhook)
+
+		v1.GET("/sources/:sha256", api.handleLookupSource)
 
 		v1.GET("/videos/:videoId", api.handleGetVideoDetails)
+		v1.POST("/videos/:videoId/playback-tokens", api.handleCreatePlaybackToken)
+		v1.PUT("/videos/:videoId/visibility", api.handleSetVisibility)
+		v1.POST("/videos/:videoId/share-links", api.handleCreateShareLink)
+		v1.GET("/share-links/:linkId", api.handleGetShareLink)
+		v1.DELETE("/share-links/:linkId", api.handleDeleteShareLink)
+		v1.POST("/share-links/:linkId/token", api.handleRedeemShareLink)
+		v1.GET("/videos/:videoId/playback-policy", api.handleGetPlaybackPolicy)
+		v1.PUT("/videos/:videoId/playback-policy", api.handlePutPlaybackPolicy)
+		v1.DELETE("/videos/:videoId/playback-policy", api.handleDeletePlaybackPolicy)
 		v1.GET("/videos/:videoId/playback/*assetPath", api.handlePlaybackProxy)
+		v1.HEAD("/videos/:videoId/playback/*assetPath", api.handlePlaybackProxy)
+		v1.GET("/videos/:videoId/keys/:keyId", api.handleGetKey)
+		v1.POST("/videos/:videoId/license/clearkey", api.handleClearKeyLicense)
 	}
 
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+
 	router.Run(":8080")
 }
 
 type API struct {
-	S3Client    *storage.S3Client
-	AsynqClient *asynq.Client
+	S3Client     *storage.S3Client
+	AsynqClient  *asynq.Client
+	Inspector    *asynq.Inspector
+	Redis        *redis.Client
+	Jobs         *jobs.Graph
+	Catalog      *catalog.Catalog
+	Webhooks     *webhooks.Publisher
+	WebhookStore *webhooks.Store
+	Policies     *policy.Store
+	ShareLinks   *sharing.Store
+
+	// ResultRetention keeps completed jobs and their results in asynq for the job API
+	ResultRetention time.Duration
+	// JobWebhooks accepts per job webhook_urls, which are only signed with WEBHOOK_SECRET
+	JobWebhooks bool
+
+	// PlaybackTokens signs and verifies playback tokens, nil leaves playback open
+	PlaybackTokens *playback.Signer
+	// GeoIP looks up the country of viewers for playback policies, nil without a database
+	GeoIP *policy.GeoIP
+	// Watermarks assembles per viewer segment sequences of forensically watermarked videos
+	Watermarks *playback.Watermarker
+	// Keys serves the keys of encrypted renditions, nil when encryption is not configured
+	Keys keys.Provider
+
+	// PublicBaseURL is where clients reach the API, the base of every playback URL
+	PublicBaseURL string
+	// CDN serves segments when set, instead of redirects to presigned bucket URLs
+	CDN *playback.CDN
+	// SegmentDelivery is how segments are served without a CDN, segmentDeliveryRedirect
+	// or segmentDeliveryStream
+	SegmentDelivery string
+
+	// Playlists caches playlists read from the bucket, media playlists for
+	// PlaylistCacheTTL before they are revalidated
+	Playlists        *playback.PlaylistCache
+	PlaylistCacheTTL time.Duration
 }
 
 func (api *API) handleCreateUpload(c *gin.Context) {
@@ -81,6 +211,12 @@ func (api *API) handleCreateUpload(c *gin.Context) {
 
 	log.Printf("received request text: %s", req.FileName)
 
+	if err := api.Catalog.RecordUpload(c.Request.Context(), videoId, tenantID(c)); err != nil {
+		log.Printf("Error recording upload of %s: %v", videoId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate presigned URL"})
+		return
+	}
+
 	objectKey := filepath.Join(videoId, "source", req.FileName)
 
 	validDuration := time.Minute * 15
@@ -105,25 +241,224 @@ func (api *API) handleCreateTranscodingJob(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
-	task, err := models.NewVideoEncodingTask(req)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create task"})
+
+	idempotencyKey := c.GetHeader(idempotencyHeader)
+	respond := func(status int, body gin.H) {
+		if idempotencyKey != "" {
+			api.finishIdempotent(c, idempotencyKey, req, status, body)
+			return
+		}
+		c.JSON(status, body)
+	}
+	if idempotencyKey != "" && !api.beginIdempotent(c, idempotencyKey, req) {
 		return
 	}
-	info, err := api.AsynqClient.Enqueue(task, asynq.MaxRetry(0))
+
+	respond(api.enqueueEncodingJob(c.Request.Context(), tenantID(c), req))
+}
+
+// enqueueEncodingJob validates and queues one job, returning the HTTP status and body that
+// describe the outcome. It is shared by the single and the batch endpoints.
+func (api *API) enqueueEncodingJob(ctx context.Context, tenant string, req models.VideoEncodingPayload) (int, gin.H) {
+	queue, err := models.QueueForPriority(req.Priority)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enqueue task"})
-		return
+		return http.StatusBadRequest, gin.H{"error": err.Error()}
+	}
+	schedule, err := req.ScheduleOption()
+	if err != nil {
+		return http.StatusBadRequest, gin.H{"error": err.Error()}
+	}
+	// Scheduling is a property of the submission, not of the job
+	req.ProcessAt, req.ProcessIn = nil, ""
+
+	// The worker drops events it cannot sign
+	if req.WebhookURL != "" && !api.JobWebhooks {
+		return http.StatusBadRequest, gin.H{"error": "webhook_url requires WEBHOOK_SECRET"}
+	}
+	// Keys the API cannot serve would make the video unplayable
+	if req.Encryption != nil && api.Keys == nil {
+		return http.StatusBadRequest, gin.H{"error": "Segment encryption is not configured"}
+	}
+	if req.Encryption != nil && req.Encryption.Method == models.EncryptionCBCS {
+		return http.StatusBadRequest, gin.H{"error": "cbcs encryption is not supported, use cenc"}
+	}
+	if req.Encryption != nil && req.Encryption.Method == models.EncryptionCENC {
+		switch {
+		case req.Encryption.KeyRotationSegments > 0:
+			return http.StatusBadRequest, gin.H{"error": "key_rotation_segments cannot be used with cenc"}
+		case req.ChunkDuration > 0:
+			return http.StatusBadRequest, gin.H{"error": "cenc encryption cannot be used with chunk_duration"}
+		case req.ForensicWatermark:
+			return http.StatusBadRequest, gin.H{"error": "cenc encryption cannot be used with forensic_watermark"}
+		}
+	}
+	if req.Visibility == catalog.VisibilityPrivate && api.PlaybackTokens == nil {
+		return http.StatusBadRequest, gin.H{"error": "Private videos require PLAYBACK_TOKEN_SECRET"}
+	}
+	if req.ForensicWatermark && req.ChunkDuration > 0 {
+		return http.StatusBadRequest, gin.H{"error": "forensic_watermark cannot be used with chunk_duration"}
+	}
+	if req.Overlay != nil && req.ChunkDuration > 0 {
+		return http.StatusBadRequest, gin.H{"error": "overlay cannot be used with chunk_duration"}
+	}
+	if req.Overlay != nil && req.Overlay.End > 0 && req.Overlay.End <= req.Overlay.Start {
+		return http.StatusBadRequest, gin.H{"error": "overlay end must be after its start"}
+	}
+
+	sourceKey := path.Join(req.VideoID, "source", req.InputFile)
+	if _, err := api.S3Client.ObjectSize(ctx, sourceKey); err != nil {
+		if storage.IsNotFound(err) {
+			return http.StatusNotFound, gin.H{"error": "Source file not found: " + sourceKey}
+		}
+		log.Printf("Error checking source %s: %v", sourceKey, err)
+		return http.StatusInternalServerError, gin.H{"error": "Failed to check source file"}
+	}
+	if req.Overlay != nil {
+		if status, body := api.checkOverlayImage(ctx, tenant, req.VideoID, req.Overlay.Image); status != http.StatusOK {
+			return status, body
+		}
+	}
+
+	// Like scheduling, the visibility belongs to the video rather than to the job
+	visibility := req.Visibility
+	req.Visibility = ""
+	if visibility != "" {
+		owner, err := api.videoOwner(ctx, req.VideoID)
+		if err != nil {
+			log.Printf("Error looking up the owner of video %s: %v", req.VideoID, err)
+			return http.StatusInternalServerError, gin.H{"error": "Failed to look up video"}
+		}
+		if owner != "" && owner != tenant {
+			return http.StatusNotFound, gin.H{"error": "Video not found"}
+		}
+	}
+
+	// The task ID is derived from the video and its profile, so submitting the same job
+	// twice while the first one is still queued is rejected by asynq itself
+	taskID := req.EncodingTaskID()
+	req.JobID = uuid.New().String()
+	req.TenantID = tenant
+
+	task, err := models.NewEncodingJobTask(req)
+	if err != nil {
+		return http.StatusInternalServerError, gin.H{"error": "Failed to create task"}
+	}
+	request, err := json.Marshal(req)
+	if err != nil {
+		return http.StatusInternalServerError, gin.H{"error": "Failed to create task"}
+	}
+
+	opts := []asynq.Option{asynq.MaxRetry(models.JobMaxRetry), asynq.Queue(queue), asynq.TaskID(taskID), asynq.Retention(api.ResultRetention)}
+	if schedule != nil {
+		opts = append(opts, schedule)
+	}
+
+	// The visibility must hold before the first rendition is published, so it is stored
+	// before the job can start, and put back if the job is not queued after all
+	restoreVisibility := func() {}
+	if visibility != "" {
+		previous, err := api.Catalog.SetInitialVisibility(ctx, req.VideoID, visibility)
+		if err != nil {
+			log.Printf("Error setting visibility of %s: %v", req.VideoID, err)
+			return http.StatusInternalServerError, gin.H{"error": "Failed to set visibility"}
+		}
+		restoreVisibility = func() {
+			if err := api.Catalog.RestoreVisibility(ctx, req.VideoID, previous); err != nil {
+				log.Printf("WARN failed to restore the visibility of %s: %v", req.VideoID, err)
+			}
+		}
+	}
+
+	info, err := api.AsynqClient.EnqueueContext(ctx, task, opts...)
+	if errors.Is(err, asynq.ErrTaskIDConflict) && api.releaseCompletedTask(taskID) {
+		info, err = api.AsynqClient.EnqueueContext(ctx, task, opts...)
+	}
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		restoreVisibility()
+		return http.StatusConflict, gin.H{"error": "An identical encoding job for this video is already queued", "task_id": taskID}
+	}
+	if err != nil {
+		restoreVisibility()
+		return http.StatusInternalServerError, gin.H{"error": "Failed to enqueue task"}
 	}
 	log.Printf("Enqueued task: id=%s queue=%s", info.ID, info.Queue)
-	c.JSON(http.StatusOK, gin.H{"message": "Encoding job has been queued", "task_id": info.ID})
+
+	err = api.Jobs.Create(ctx, jobs.Job{
+		ID:         req.JobID,
+		VideoID:    req.VideoID,
+		TenantID:   req.TenantID,
+		WebhookURL: req.WebhookURL,
+		Request:    request,
+	})
+	if err != nil {
+		log.Printf("WARN failed to register job %s: %v", req.JobID, err)
+	}
+	api.Webhooks.Publish(ctx, req.JobID, webhooks.EventJobQueued, webhooks.EventData{})
+
+	if info.State == asynq.TaskStateScheduled {
+		return http.StatusOK, gin.H{"message": "Encoding job has been scheduled", "task_id": info.ID, "job_id": req.JobID, "process_at": info.NextProcessAt}
+	}
+	return http.StatusOK, gin.H{"message": "Encoding job has been queued", "task_id": info.ID, "job_id": req.JobID}
+}
+
+// checkOverlayImage makes sure the image of an overlay exists and belongs to the tenant,
+// as another tenant's frames could otherwise be burned into this video. The video an image
+// is stored under belongs to the tenant it is cataloged for, its ID was issued to or that
+// created jobs for it.
+func (api *API) checkOverlayImage(ctx context.Context, tenant, videoId, key string) (int, gin.H) {
+	notFound := gin.H{"error": "Overlay image not found: " + key}
+
+	imageVideoId, _, _ := strings.Cut(key, "/")
+	if imageVideoId+"/" == keys.Prefix {
+		return http.StatusNotFound, notFound
+	}
+	owner, err := api.videoOwner(ctx, imageVideoId)
+	if err != nil {
+		log.Printf("Error looking up the owner of video %s: %v", imageVideoId, err)
+		return http.StatusInternalServerError, gin.H{"error": "Failed to check overlay image"}
+	}
+	// Only the video of the job itself may have no known owner yet
+	if owner != tenant && !(owner == "" && imageVideoId == videoId) {
+		return http.StatusNotFound, notFound
+	}
+
+	if _, err := api.S3Client.ObjectSize(ctx, key); err != nil {
+		if storage.IsNotFound(err) {
+			return http.StatusNotFound, notFound
+		}
+		log.Printf("Error checking overlay image %s: %v", key, err)
+		return http.StatusInternalServerError, gin.H{"error": "Failed to check overlay image"}
+	}
+	return http.StatusOK, nil
+}
+
+// releaseCompletedTask frees the ID of a task that is only kept for its result, so the same
+// job can be submitted again once the previous run is done.
+func (api *API) releaseCompletedTask(taskID string) bool {
+	info, err := api.findTask(taskID, "")
+	if err != nil || info.State != asynq.TaskStateCompleted {
+		return false
+	}
+	if err := api.Inspector.DeleteTask(info.Queue, info.ID); err != nil {
+		log.Printf("Error releasing completed task %s: %v", taskID, err)
+		return false
+	}
+	return true
+}
+
+// tenantID identifies the customer a request is made for. There is no authentication yet,
+// so it is taken from the X-Tenant-ID header as is.
+func tenantID(c *gin.Context) string {
+	if tenant := strings.TrimSpace(c.GetHeader("X-Tenant-ID")); tenant != "" {
+		return tenant
+	}
+	return "default"
 }
 
 func (api *API) handleGetVideoDetails(c *gin.Context) {
 	videoId := c.Param("videoId")
 
-	appBaseURL := "http://localhost:8080"
-	playbackUrl := fmt.Sprintf("%s/v1/videos/%s/playback/hls/master.m3u8", appBaseURL, videoId)
+	playbackUrl := api.Webhooks.PlaybackURL(videoId)
 
 	c.JSON(http.StatusOK, gin.H{
 		"videoId":     videoId,
@@ -139,15 +474,64 @@ func (api *API) handlePlaybackProxy(c *gin.Context) {
 
 	isMasterPlaylist := strings.HasSuffix(assetPath, "master.m3u8")
 
-	if !strings.HasSuffix(assetPath, ".m3u8") && !strings.HasSuffix(assetPath, ".ts") {
+	isPlaylist := strings.HasSuffix(assetPath, ".m3u8")
+	if _, isMedia := mediaContentTypes[path.Ext(assetPath)]; !isPlaylist && !isMedia {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid asset type"})
 		return
 	}
 
+	claims, ok := api.authorizePlayback(c, videoId)
+	if !ok || !api.enforcePlaybackPolicy(c, videoId) {
+		return
+	}
+
+	filter := newVariantFilter(claims, c.Query)
+	allowed, err := api.variantAllowed(c.Request.Context(), videoId, assetPath, filter)
+	if err != nil {
+		log.Printf("Error checking variant access to %s of %s: %v", assetPath, videoId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access to this rendition"})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This rendition is not allowed"})
+		return
+	}
+
+	if !isPlaylist && !api.checkForensicVariant(c, videoId, assetPath, claims) {
+		return
+	}
+
 	keyInBucket := path.Join(videoId, strings.TrimPrefix(assetPath, "/"))
 
-	if strings.HasSuffix(assetPath, ".ts") {
-		presignedURL, err := api.S3Client.GeneratePresignedGet(c.Request.Context(), keyInBucket, 1*time.Hour)
+	// Rewritten playlists embed the viewer's token, so shared caches must not keep them,
+	// nor anything else a token was checked for
+	cacheScope := ""
+	if claims != nil {
+		cacheScope = "private, "
+	}
+
+	if !isPlaylist && api.CDN != nil {
+		query := c.Request.URL.Query()
+		query.Del("token")
+
+		var signErr error
+		cdnURL := api.cdnMediaURL(c.Request.Context(), videoId, time.Now().Add(segmentURLTTL(claims)), &signErr)(assetPath, query)
+		if signErr != nil {
+			log.Printf("Error signing CDN URL for %s: %v", keyInBucket, signErr)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign segment URL"})
+			return
+		}
+		c.Redirect(http.StatusTemporaryRedirect, cdnURL)
+		return
+	}
+
+	if !isPlaylist && api.SegmentDelivery == segmentDeliveryStream {
+		api.streamSegment(c, keyInBucket, cacheScope)
+		return
+	}
+
+	if !isPlaylist {
+		presignedURL, err := api.S3Client.GeneratePresignedGet(c.Request.Context(), keyInBucket, segmentURLTTL(claims))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign segment URL"})
 			return
@@ -156,45 +540,83 @@ func (api *API) handlePlaybackProxy(c *gin.Context) {
 		return
 	}
 
-	playlistContent, err := api.S3Client.GetObject(c.Request.Context(), keyInBucket)
+	// master.m3u8 changes while renditions are published, media playlists do not
+	ttl := api.PlaylistCacheTTL
+	if isMasterPlaylist {
+		ttl = masterPlaylistCacheTTL
+	}
+	playlist, err := api.Playlists.Get(c.Request.Context(), keyInBucket, ttl)
 	if err != nil {
+		var syntaxErr *m3u8.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			log.Printf("Invalid playlist %s: %v", keyInBucket, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read playlist"})
+			return
+		}
 		log.Printf("!!! S3 GET FAILED !!! Key: [%s], Error: [%v]", keyInBucket, err)
 		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
 		return
 	}
-	defer playlistContent.Close()
 
 	if isMasterPlaylist {
 
-		c.Header("Cache-Control", "max-age=2, must-revalidate")
+		c.Header("Cache-Control", cacheScope+"max-age=2, must-revalidate")
 		log.Printf("Serving master playlist for %s with short cache time.", videoId)
 	} else {
-		c.Header("Cache-Control", "max-age=3600")
+		c.Header("Cache-Control", cacheScope+"max-age=3600")
 	}
 
-	var rewrittenPlaylist strings.Builder
-	scanner := bufio.NewScanner(playlistContent)
-
-	relativeDir := path.Dir(strings.TrimPrefix(assetPath, "/"))
-	appBaseURL := "http://localhost:8080"
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		if strings.HasPrefix(line, "#") || len(strings.TrimSpace(line)) == 0 {
-			rewrittenPlaylist.WriteString(line + "\n")
-			continue
+	token := ""
+	if claims != nil {
+		token = c.Query("token")
+	}
+	// With a CDN, segments are fetched from the edge rather than through the proxy
+	var mediaURL func(string, url.Values) string
+	var signErr error
+	if api.CDN != nil {
+		expires := time.Now().Add(segmentURLTTL(claims))
+		mediaURL = api.cdnMediaURL(c.Request.Context(), videoId, expires, &signErr)
+
+		cookies, err := api.CDN.Cookies(videoId, expires)
+		if err != nil {
+			log.Printf("Error signing CDN cookies for %s: %v", videoId, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign CDN cookies"})
+			return
+		}
+		for _, cookie := range cookies {
+			http.SetCookie(c.Writer, cookie)
+		}
+	}
+	rewrite := playlistURIRewriter(api.PublicBaseURL, videoId, assetPath, token, mediaURL)
+
+	// Variants the token or query does not allow are left out of the master playlist
+	if master, ok := playlist.(*m3u8.MasterPlaylist); ok && !filter.empty() {
+		hadVariants := len(master.Variants) > 0
+		filter.apply(master)
+		if hadVariants && len(master.Variants) == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "No variant of this video is allowed"})
+			return
 		}
+	}
 
-		nextAssetPath := path.Join("/", relativeDir, line)
-		newURL := fmt.Sprintf("%s/v1/videos/%s/playback%s", appBaseURL, videoId, nextAssetPath)
-		rewrittenPlaylist.WriteString(newURL + "\n")
+	if media, ok := playlist.(*m3u8.MediaPlaylist); ok {
+		if err := api.applyForensicWatermark(c.Request.Context(), media, videoId, claims); err != nil {
+			if errors.Is(err, errViewerRequired) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Playback token must name a viewer to play this video"})
+				return
+			}
+			log.Printf("Error looking up video %s: %v", videoId, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read playlist"})
+			return
+		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read playlist"})
+	playlist.RewriteURIs(rewrite)
+	if signErr != nil {
+		log.Printf("Error signing CDN URLs for %s: %v", keyInBucket, signErr)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign segment URLs"})
 		return
 	}
 
-	c.Header("Content-Type", "application/vnd.apple.mpegurl")
-	c.String(http.StatusOK, rewrittenPlaylist.String())
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", playlist.Encode().Bytes())
 }
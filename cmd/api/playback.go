@@ -0,0 +1,178 @@
+package main
+
+import (
+	"better-media/internal/config"
+	"better-media/internal/keys"
+	"better-media/internal/playback"
+	"better-media/internal/storage"
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mediaContentTypes are the assets a playlist may reference besides other playlists:
+// MPEG-TS and fMP4 segments, init sections, packed audio and subtitles. They are served
+// from the bucket, see SegmentDelivery.
+var mediaContentTypes = map[string]string{
+	".ts":  "video/mp2t",
+	".m4s": "video/iso.segment",
+	".mp4": "video/mp4",
+	".aac": "audio/aac",
+	".vtt": "text/vtt",
+}
+
+// masterPlaylistCacheTTL matches the max-age of master.m3u8, which gains variants as the
+// renditions of a job are published
+const masterPlaylistCacheTTL = 2 * time.Second
+
+// Ways the proxy serves segments when there is no CDN
+const (
+	// segmentDeliveryRedirect redirects to a presigned bucket URL
+	segmentDeliveryRedirect = "redirect"
+	// segmentDeliveryStream streams the bytes through the API, for clients that do not
+	// follow redirects and to keep bucket URLs private
+	segmentDeliveryStream = "stream"
+)
+
+// playlistURIRewriter maps the URIs of the playlist at assetPath onto the playback proxy.
+// Relative URIs are resolved against the playlist, keep their query string and get the
+// viewer's token. Absolute URLs and root-relative paths into the proxy are normalized the
+// same way, anything else (a CDN, an skd:// key, data:, another path on the host) is left
+// alone. mediaURL, if not nil, gives the URL of media assets instead, e.g. on a CDN.
+// Keys of encrypted renditions point at the key endpoint.
+func playlistURIRewriter(appBaseURL, videoId, assetPath, token string, mediaURL func(assetPath string, query url.Values) string) func(string) string {
+	proxyBase := appBaseURL + "/v1/videos/" + videoId + "/playback"
+	proxyPath := strings.TrimPrefix(proxyBase, appBaseURL)
+	if base, err := url.Parse(proxyBase); err == nil {
+		proxyPath = base.Path
+	}
+	playlistDir := path.Dir(path.Join("/", assetPath))
+
+	return func(uri string) string {
+		if keyID, ok := keys.ParseURI(uri); ok {
+			keyURL := appBaseURL + "/v1/videos/" + videoId + "/keys/" + keyID
+			if token != "" {
+				keyURL += "?" + url.Values{"token": {token}}.Encode()
+			}
+			return keyURL
+		}
+
+		u, err := url.Parse(uri)
+		if err != nil {
+			return uri
+		}
+
+		var assetPath string
+		switch {
+		case u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, proxyPath+"/"):
+			assetPath = path.Join("/", strings.TrimPrefix(u.Path, proxyPath))
+		case u.Scheme == "" && u.Host == "" && !strings.HasPrefix(u.Path, "/"):
+			assetPath = path.Join(playlistDir, u.Path)
+		case strings.HasPrefix(uri, proxyBase+"/"):
+			assetPath = path.Join("/", strings.TrimPrefix(u.Path, proxyPath))
+		default:
+			return uri
+		}
+
+		query := u.Query()
+		if _, isMedia := mediaContentTypes[path.Ext(assetPath)]; mediaURL != nil && isMedia {
+			return mediaURL(assetPath, query)
+		}
+		if token != "" {
+			query.Set("token", token)
+		}
+
+		rewritten := proxyBase + assetPath
+		if len(query) > 0 {
+			rewritten += "?" + query.Encode()
+		}
+		return rewritten
+	}
+}
+
+// newCDN configures CDN delivery of segments from the environment, nil when CDN_BASE_URL
+// is not set
+func newCDN() (*playback.CDN, error) {
+	baseURL := config.String("CDN_BASE_URL", "")
+	if baseURL == "" {
+		return nil, nil
+	}
+
+	cdn := &playback.CDN{
+		BaseURL:       strings.TrimSuffix(baseURL, "/"),
+		SignedCookies: config.Bool("CDN_SIGNED_COOKIES", false),
+		CookieDomain:  config.String("CDN_COOKIE_DOMAIN", ""),
+	}
+
+	keyFile := config.String("CDN_PRIVATE_KEY_FILE", "")
+	if keyFile == "" {
+		return cdn, nil
+	}
+	privateKey, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cdn.Signer, err = playback.NewCloudFrontSigner(config.String("CDN_KEY_PAIR_ID", ""), privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return cdn, nil
+}
+
+// cdnMediaURL points media assets of a video at the CDN. The version of the output is
+// added so that a re-encode, which writes the same keys, is not served from the CDN cache.
+// Signing errors are stored in *signErr for the caller to fail the request.
+func (api *API) cdnMediaURL(ctx context.Context, videoId string, expires time.Time, signErr *error) func(string, url.Values) string {
+	version := ""
+	if video, err := api.Catalog.Get(ctx, videoId); err == nil {
+		version = strconv.FormatInt(video.EncodedAt.Unix(), 10)
+	}
+
+	return func(assetPath string, query url.Values) string {
+		if version != "" {
+			query.Set("v", version)
+		}
+		u, err := api.CDN.URL(path.Join(videoId, assetPath), query, expires)
+		if err != nil {
+			*signErr = err
+			return ""
+		}
+		return u
+	}
+}
+
+// streamSegment serves a media asset from the bucket through the API. http.ServeContent
+// answers Range, If-None-Match, If-Modified-Since and HEAD requests, reading only the
+// bytes it sends.
+func (api *API) streamSegment(c *gin.Context, key string, cacheScope string) {
+	ctx := c.Request.Context()
+
+	object, err := api.S3Client.StatObject(ctx, key)
+	if err != nil {
+		if storage.IsNotFound(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+			return
+		}
+		log.Printf("Error reading segment %s: %v", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read segment"})
+		return
+	}
+
+	reader := api.S3Client.NewObjectReader(ctx, object)
+	defer reader.Close()
+
+	c.Header("Content-Type", mediaContentTypes[path.Ext(key)])
+	c.Header("Cache-Control", cacheScope+"max-age=3600")
+	if object.ETag != "" {
+		c.Header("ETag", object.ETag)
+	}
+	http.ServeContent(c.Writer, c.Request, "", object.LastModified, reader)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"better-media/pkg/m3u8"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	testAppBaseURL = "https://api.example.com"
+	testKeyID      = "0123456789abcdef0123456789abcdef"
+)
+
+// testCDNURL stands in for cdnMediaURL
+func testCDNURL(assetPath string, query url.Values) string {
+	query.Set("sig", "s")
+	return "https://cdn.example.com/vid1" + assetPath + "?" + query.Encode()
+}
+
+func TestPlaylistURIRewriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		assetPath string
+		token     string
+		mediaURL  func(string, url.Values) string
+		playlist  string
+		want      string
+	}{
+		{
+			name:      "master with alternative renditions, session keys and i-frame variants",
+			assetPath: "/hls/master.m3u8",
+			token:     "tok",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-SESSION-DATA:DATA-ID="com.example.chapters",URI="chapters.json"
+#EXT-X-SESSION-KEY:METHOD=SAMPLE-AES,URI="skd://key65",KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"
+#EXT-X-SESSION-KEY:METHOD=AES-128,URI="better-media-key:` + testKeyID + `"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",LANGUAGE="en",NAME="English, stereo",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="audio/en/playlist.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",LANGUAGE="fr",NAME="Français",AUTOSELECT=YES,URI="subs/fr.m3u8?lang=fr"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="CC1",INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:BANDWIDTH=2800000,AVERAGE-BANDWIDTH=2500000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=1280x720,FRAME-RATE=29.970,AUDIO="aud",SUBTITLES="subs",CLOSED-CAPTIONS="cc"
+720p/playlist.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1.4d401e,mp4a.40.2",RESOLUTION=640x360,AUDIO="aud",SUBTITLES="subs",CLOSED-CAPTIONS="cc"
+https://api.example.com/v1/videos/vid1/playback/hls/360p/playlist.m3u8?token=stale
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=200000,CODECS="avc1.64001f",RESOLUTION=1280x720,URI="720p/iframes.m3u8"
+`,
+			want: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-SESSION-DATA:DATA-ID="com.example.chapters",URI="https://api.example.com/v1/videos/vid1/playback/hls/chapters.json?token=tok"
+#EXT-X-SESSION-KEY:METHOD=SAMPLE-AES,URI="skd://key65",KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"
+#EXT-X-SESSION-KEY:METHOD=AES-128,URI="https://api.example.com/v1/videos/vid1/keys/` + testKeyID + `?token=tok"
+#EXT-X-MEDIA:TYPE=AUDIO,URI="https://api.example.com/v1/videos/vid1/playback/hls/audio/en/playlist.m3u8?token=tok",GROUP-ID="aud",LANGUAGE="en",NAME="English, stereo",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2"
+#EXT-X-MEDIA:TYPE=SUBTITLES,URI="https://api.example.com/v1/videos/vid1/playback/hls/subs/fr.m3u8?lang=fr&token=tok",GROUP-ID="subs",LANGUAGE="fr",NAME="Français",AUTOSELECT=YES
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="CC1",INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:BANDWIDTH=2800000,AVERAGE-BANDWIDTH=2500000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=1280x720,FRAME-RATE=29.970,AUDIO="aud",SUBTITLES="subs",CLOSED-CAPTIONS="cc"
+https://api.example.com/v1/videos/vid1/playback/hls/720p/playlist.m3u8?token=tok
+#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1.4d401e,mp4a.40.2",RESOLUTION=640x360,AUDIO="aud",SUBTITLES="subs",CLOSED-CAPTIONS="cc"
+https://api.example.com/v1/videos/vid1/playback/hls/360p/playlist.m3u8?token=tok
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=200000,CODECS="avc1.64001f",RESOLUTION=1280x720,URI="https://api.example.com/v1/videos/vid1/playback/hls/720p/iframes.m3u8?token=tok"
+`,
+		},
+		{
+			name:      "encrypted MPEG-TS media playlist with rotating keys",
+			assetPath: "/hls/720p/playlist.m3u8",
+			token:     "tok",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-KEY:METHOD=AES-128,URI="better-media-key:` + testKeyID + `"
+#EXTINF:4.000000,
+segment000.ts
+#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example.net/k2",IV=0x00000000000000000000000000000001
+#EXTINF:3.500000,
+segment001.ts
+#EXT-X-ENDLIST
+`,
+			want: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-KEY:METHOD=AES-128,URI="https://api.example.com/v1/videos/vid1/keys/` + testKeyID + `?token=tok"
+#EXTINF:4,
+https://api.example.com/v1/videos/vid1/playback/hls/720p/segment000.ts?token=tok
+#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example.net/k2",IV=0x00000000000000000000000000000001
+#EXTINF:3.5,
+https://api.example.com/v1/videos/vid1/playback/hls/720p/segment001.ts?token=tok
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name:      "absolute URLs, query strings and relative paths",
+			assetPath: "/hls/720p/playlist.m3u8",
+			token:     "tok",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4,
+b/segment000.ts?part=1
+#EXTINF:4,
+../shared/intro.ts
+#EXTINF:4,
+https://api.example.com/v1/videos/vid1/playback/hls/720p/segment002.ts?token=old&x=1
+#EXTINF:4,
+https://api.example.com/v1/videos/other/playback/hls/720p/segment003.ts
+#EXTINF:4,
+https://cdn.example.net/ads/spot.ts?campaign=7
+#EXTINF:4,
+/v1/videos/vid1/playback/hls/720p/segment005.ts
+#EXTINF:4,
+/static/slate.ts
+#EXT-X-ENDLIST
+`,
+			want: `#EXTM3U
+#EXT-X-VERSION:1
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:0
+#EXTINF:4,
+https://api.example.com/v1/videos/vid1/playback/hls/720p/b/segment000.ts?part=1&token=tok
+#EXTINF:4,
+https://api.example.com/v1/videos/vid1/playback/hls/shared/intro.ts?token=tok
+#EXTINF:4,
+https://api.example.com/v1/videos/vid1/playback/hls/720p/segment002.ts?token=tok&x=1
+#EXTINF:4,
+https://api.example.com/v1/videos/other/playback/hls/720p/segment003.ts
+#EXTINF:4,
+https://cdn.example.net/ads/spot.ts?campaign=7
+#EXTINF:4,
+https://api.example.com/v1/videos/vid1/playback/hls/720p/segment005.ts?token=tok
+#EXTINF:4,
+/static/slate.ts
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name:      "fMP4 media playlist with EXT-X-MAP served by a CDN",
+			assetPath: "/hls/1080p/playlist.m3u8",
+			token:     "tok",
+			mediaURL:  testCDNURL,
+			playlist: `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="better-media-key:` + testKeyID + `",KEYFORMAT="identity"
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXTINF:6.006,
+#EXT-X-BYTERANGE:1000000@720
+media.m4s
+#EXTINF:6.006,
+#EXT-X-BYTERANGE:1000000
+media.m4s
+#EXT-X-ENDLIST
+`,
+			want: `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="https://api.example.com/v1/videos/vid1/keys/` + testKeyID + `?token=tok",KEYFORMAT="identity"
+#EXT-X-MAP:URI="https://cdn.example.com/vid1/hls/1080p/init.mp4?sig=s",BYTERANGE="720@0"
+#EXTINF:6.006,
+#EXT-X-BYTERANGE:1000000@720
+https://cdn.example.com/vid1/hls/1080p/media.m4s?sig=s
+#EXTINF:6.006,
+#EXT-X-BYTERANGE:1000000
+https://cdn.example.com/vid1/hls/1080p/media.m4s?sig=s
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name:      "without a token",
+			assetPath: "/hls/master.m3u8",
+			playlist: `#EXTM3U
+#EXT-X-SESSION-KEY:METHOD=AES-128,URI="better-media-key:` + testKeyID + `"
+#EXT-X-STREAM-INF:BANDWIDTH=800000
+360p/playlist.m3u8?v=2
+`,
+			want: `#EXTM3U
+#EXT-X-VERSION:1
+#EXT-X-SESSION-KEY:METHOD=AES-128,URI="https://api.example.com/v1/videos/vid1/keys/` + testKeyID + `"
+#EXT-X-STREAM-INF:BANDWIDTH=800000
+https://api.example.com/v1/videos/vid1/playback/hls/360p/playlist.m3u8?v=2
+`,
+		},
+		{
+			name:      "key URIs that are not ours",
+			assetPath: "/hls/360p/playlist.m3u8",
+			token:     "tok",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=AES-128,URI="better-media-key:not-a-key-id"
+#EXTINF:4,
+segment000.ts
+#EXT-X-KEY:METHOD=AES-128,URI="data:text/plain;base64,AAECAwQFBgcICQoLDA0ODw=="
+#EXTINF:4,
+segment001.ts
+#EXT-X-KEY:METHOD=AES-128,URI="keys/segment002.key"
+#EXTINF:4,
+segment002.ts
+`,
+			want: `#EXTM3U
+#EXT-X-VERSION:1
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-KEY:METHOD=AES-128,URI="better-media-key:not-a-key-id"
+#EXTINF:4,
+https://api.example.com/v1/videos/vid1/playback/hls/360p/segment000.ts?token=tok
+#EXT-X-KEY:METHOD=AES-128,URI="data:text/plain;base64,AAECAwQFBgcICQoLDA0ODw=="
+#EXTINF:4,
+https://api.example.com/v1/videos/vid1/playback/hls/360p/segment001.ts?token=tok
+#EXT-X-KEY:METHOD=AES-128,URI="https://api.example.com/v1/videos/vid1/playback/hls/360p/keys/segment002.key?token=tok"
+#EXTINF:4,
+https://api.example.com/v1/videos/vid1/playback/hls/360p/segment002.ts?token=tok
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			playlist, err := m3u8.Decode(strings.NewReader(tt.playlist))
+			if err != nil {
+				t.Fatalf("Decode() = %v", err)
+			}
+
+			playlist.RewriteURIs(playlistURIRewriter(testAppBaseURL, "vid1", tt.assetPath, tt.token, tt.mediaURL))
+
+			if got := playlist.Encode().String(); got != tt.want {
+				t.Errorf("rewritten playlist:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"better-media/internal/catalog"
+	"better-media/internal/playback"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPlaybackTokenTTL = time.Hour
+	maxPlaybackTokenTTL     = 24 * time.Hour
+	// maxSegmentURLTTL is how long a presigned segment URL lives at most, it never outlives
+	// the token it was issued for
+	maxSegmentURLTTL = time.Hour
+)
+
+type PlaybackTokenRequest struct {
+	TTLSeconds int    `json:"ttl_seconds" binding:"omitempty,min=1"`
+	ViewerID   string `json:"viewer_id"`
+	// IP binds the token to the viewer's address, as seen by the API
+	IP string `json:"ip" binding:"omitempty,ip"`
+	// MaxResolution caps the rendition height the token can play
+	MaxResolution int `json:"max_resolution" binding:"omitempty,min=1"`
+	// MaxBandwidth caps the BANDWIDTH of the variants the token can play, in bits per second
+	MaxBandwidth int `json:"max_bandwidth" binding:"omitempty,min=1"`
+	// Codecs are the video codec families the token can play, e.g. ["avc1"]
+	Codecs []string `json:"codecs" binding:"omitempty,dive,required"`
+}
+
+func (api *API) handleCreatePlaybackToken(c *gin.Context) {
+	if api.PlaybackTokens == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Playback tokens are not configured"})
+		return
+	}
+
+	videoId := c.Param("videoId")
+
+	var req PlaybackTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	ttl := defaultPlaybackTokenTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl > maxPlaybackTokenTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl_seconds must be at most " + strconv.Itoa(int(maxPlaybackTokenTTL.Seconds()))})
+		return
+	}
+
+	if !api.authorizeVideoOwner(c, videoId) {
+		return
+	}
+
+	token, expiresAt, err := api.PlaybackTokens.Issue(playback.Claims{
+		VideoID:      videoId,
+		ViewerID:     req.ViewerID,
+		IP:           req.IP,
+		MaxHeight:    req.MaxResolution,
+		MaxBandwidth: req.MaxBandwidth,
+		Codecs:       req.Codecs,
+	}, ttl)
+	if err != nil {
+		log.Printf("Error signing playback token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue playback token"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":        token,
+		"expires_at":   expiresAt,
+		"playback_url": api.Webhooks.PlaybackURL(videoId) + "?" + url.Values{"token": {token}}.Encode(),
+	})
+}
+
+// authorizePlayback verifies the playback token of a proxy request. Public and unlisted
+// videos play without one, private videos always need one, and the others only when a
+// secret is configured. Without a token claims is nil. On failure the response is already
+// written.
+func (api *API) authorizePlayback(c *gin.Context, videoId string) (claims *playback.Claims, ok bool) {
+	token := c.Query("token")
+	if token == "" || api.PlaybackTokens == nil {
+		visibility, err := api.Catalog.Visibility(c.Request.Context(), videoId)
+		if err != nil {
+			log.Printf("Error reading visibility of %s: %v", videoId, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up video"})
+			return nil, false
+		}
+		switch {
+		case visibility == catalog.VisibilityPrivate && api.PlaybackTokens == nil:
+			c.JSON(http.StatusForbidden, gin.H{"error": "Private videos cannot be played without playback tokens configured"})
+			return nil, false
+		case api.PlaybackTokens == nil, visibility == catalog.VisibilityPublic, visibility == catalog.VisibilityUnlisted:
+			return nil, true
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Playback token required"})
+		return nil, false
+	}
+
+	claims, err := api.PlaybackTokens.Verify(token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired playback token"})
+		return nil, false
+	}
+	if err := claims.Allows(videoId, c.ClientIP()); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Playback token does not grant access to this video"})
+		return nil, false
+	}
+
+	return claims, true
+}
+
+var renditionDirPattern = regexp.MustCompile(`(?:^|/)(\d+)p/`)
+
+// renditionHeight returns the height of the rendition an asset belongs to, e.g. 720 for
+// /hls/720p/segment001.ts, or 0 for assets outside a rendition such as master.m3u8.
+func renditionHeight(assetPath string) int {
+	match := renditionDirPattern.FindStringSubmatch(assetPath)
+	if match == nil {
+		return 0
+	}
+	height, _ := strconv.Atoi(match[1])
+	return height
+}
+
+// segmentURLTTL keeps presigned segment URLs from outliving the token they were issued for
+func segmentURLTTL(claims *playback.Claims) time.Duration {
+	if claims == nil || claims.ExpiresAt == nil {
+		return maxSegmentURLTTL
+	}
+	return max(time.Minute, min(maxSegmentURLTTL, time.Until(claims.ExpiresAt.Time)))
+}
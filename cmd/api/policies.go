@@ -0,0 +1,138 @@
+package main
+
+import (
+	"better-media/internal/policy"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+
+	"github.com/gin-gonic/gin"
+)
+
+// videoOwner returns the tenant of a video: the one it is cataloged for or its ID was issued
+// to, or else the one that created jobs for it. It is empty when none is known.
+func (api *API) videoOwner(ctx context.Context, videoId string) (string, error) {
+	owner, err := api.Catalog.Owner(ctx, videoId)
+	if err == nil && owner == "" {
+		owner, err = api.Jobs.VideoTenant(ctx, videoId)
+	}
+	return owner, err
+}
+
+// authorizeVideoOwner checks that the tenant of the request owns a video, including one
+// that is still being encoded. Videos without a known owner are not found for anyone. On
+// failure the response is already written.
+func (api *API) authorizeVideoOwner(c *gin.Context, videoId string) bool {
+	owner, err := api.videoOwner(c.Request.Context(), videoId)
+	if err != nil {
+		log.Printf("Error looking up the owner of video %s: %v", videoId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up video"})
+		return false
+	}
+	if owner == "" || owner != tenantID(c) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+		return false
+	}
+	return true
+}
+
+func (api *API) handleGetPlaybackPolicy(c *gin.Context) {
+	videoId := c.Param("videoId")
+	if !api.authorizeVideoOwner(c, videoId) {
+		return
+	}
+
+	p, err := api.Policies.Get(c.Request.Context(), videoId)
+	if errors.Is(err, policy.ErrPolicyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "This video has no playback policy"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading playback policy of %s: %v", videoId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read playback policy"})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+func (api *API) handlePutPlaybackPolicy(c *gin.Context) {
+	videoId := c.Param("videoId")
+	if !api.authorizeVideoOwner(c, videoId) {
+		return
+	}
+
+	var p policy.Policy
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if err := p.Normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Without a database every viewer would be denied by an allowlist, or let through a
+	// blocklist
+	if p.NeedsGeoIP() && api.GeoIP == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Country restrictions require GEOIP_DATABASE_FILE"})
+		return
+	}
+
+	if err := api.Policies.Set(c.Request.Context(), videoId, &p); err != nil {
+		log.Printf("Error storing playback policy of %s: %v", videoId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store playback policy"})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+func (api *API) handleDeletePlaybackPolicy(c *gin.Context) {
+	videoId := c.Param("videoId")
+	if !api.authorizeVideoOwner(c, videoId) {
+		return
+	}
+
+	deleted, err := api.Policies.Delete(c.Request.Context(), videoId)
+	if err != nil {
+		log.Printf("Error deleting playback policy of %s: %v", videoId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete playback policy"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "This video has no playback policy"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// enforcePlaybackPolicy checks a playback request against the policy of the video, if it
+// has one. Denials are answered with 403 and the reason. On failure the response is
+// already written.
+func (api *API) enforcePlaybackPolicy(c *gin.Context, videoId string) bool {
+	p, err := api.Policies.Get(c.Request.Context(), videoId)
+	if errors.Is(err, policy.ErrPolicyNotFound) {
+		return true
+	}
+	if err != nil {
+		log.Printf("Error reading playback policy of %s: %v", videoId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check playback policy"})
+		return false
+	}
+
+	// ClientIP only follows X-Forwarded-For from TRUSTED_PROXIES, so viewers cannot
+	// pick the address their country and network are looked up for
+	clientIP, _ := netip.ParseAddr(c.ClientIP())
+	err = p.Check(policy.Request{
+		ClientIP: clientIP,
+		Referer:  c.GetHeader("Referer"),
+		Origin:   c.GetHeader("Origin"),
+	}, api.GeoIP)
+
+	var denial *policy.Denial
+	if errors.As(err, &denial) {
+		c.JSON(http.StatusForbidden, gin.H{"error": denial.Message, "reason": denial.Reason})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"better-media/internal/catalog"
+	"better-media/internal/playback"
+	"better-media/internal/sharing"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultShareLinkTTL = 7 * 24 * time.Hour
+	maxShareLinkTTL     = 90 * 24 * time.Hour
+	// shareTokenTTL is how long the playback token of a redeemed share link lives at most,
+	// long enough to start playing
+	shareTokenTTL = 10 * time.Minute
+)
+
+type VisibilityRequest struct {
+	Visibility string `json:"visibility" binding:"required,oneof=public unlisted private"`
+}
+
+func (api *API) handleSetVisibility(c *gin.Context) {
+	videoId := c.Param("videoId")
+
+	var req VisibilityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if req.Visibility == catalog.VisibilityPrivate && api.PlaybackTokens == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Private videos require PLAYBACK_TOKEN_SECRET"})
+		return
+	}
+
+	if !api.authorizeVideoOwner(c, videoId) {
+		return
+	}
+
+	err := api.Catalog.SetVisibility(c.Request.Context(), videoId, req.Visibility)
+	if errors.Is(err, catalog.ErrVideoNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error setting visibility of %s: %v", videoId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set visibility"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"video_id": videoId, "visibility": req.Visibility})
+}
+
+type ShareLinkRequest struct {
+	TTLSeconds int `json:"ttl_seconds" binding:"omitempty,min=1"`
+	// MaxViews is how many times the link can be redeemed, 0 means no limit
+	MaxViews int    `json:"max_views" binding:"omitempty,min=1"`
+	Password string `json:"password" binding:"omitempty,max=256"`
+}
+
+func (api *API) handleCreateShareLink(c *gin.Context) {
+	if api.PlaybackTokens == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Playback tokens are not configured"})
+		return
+	}
+
+	videoId := c.Param("videoId")
+
+	var req ShareLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	ttl := defaultShareLinkTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl > maxShareLinkTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl_seconds must be at most " + strconv.Itoa(int(maxShareLinkTTL.Seconds()))})
+		return
+	}
+
+	if !api.authorizeVideoOwner(c, videoId) {
+		return
+	}
+
+	link, err := api.ShareLinks.Create(c.Request.Context(), videoId, tenantID(c), ttl, req.MaxViews, req.Password)
+	if err != nil {
+		log.Printf("Error creating share link for %s: %v", videoId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"link": link,
+		"url":  api.PublicBaseURL + "/v1/share-links/" + link.ID + "/token",
+	})
+}
+
+// shareLinkOwned gets a link of the tenant of the request. On failure the response is
+// already written.
+func (api *API) shareLinkOwned(c *gin.Context, linkId string) (*sharing.Link, bool) {
+	link, err := api.ShareLinks.Get(c.Request.Context(), linkId)
+	if err == nil && link.TenantID != tenantID(c) {
+		err = sharing.ErrLinkNotFound
+	}
+	if errors.Is(err, sharing.ErrLinkNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error reading share link %s: %v", linkId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read share link"})
+		return nil, false
+	}
+	return link, true
+}
+
+func (api *API) handleGetShareLink(c *gin.Context) {
+	if link, ok := api.shareLinkOwned(c, c.Param("linkId")); ok {
+		c.JSON(http.StatusOK, link)
+	}
+}
+
+func (api *API) handleDeleteShareLink(c *gin.Context) {
+	linkId := c.Param("linkId")
+	if _, ok := api.shareLinkOwned(c, linkId); !ok {
+		return
+	}
+
+	if _, err := api.ShareLinks.Delete(c.Request.Context(), linkId); err != nil {
+		log.Printf("Error deleting share link %s: %v", linkId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete share link"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type RedeemShareLinkRequest struct {
+	Password string `json:"password"`
+}
+
+// handleRedeemShareLink is called by viewers rather than tenants. Every call counts a view
+// and returns a playback token that lives for shareTokenTTL at most.
+func (api *API) handleRedeemShareLink(c *gin.Context) {
+	if api.PlaybackTokens == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Playback tokens are not configured"})
+		return
+	}
+
+	linkId := c.Param("linkId")
+
+	var req RedeemShareLinkRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+	}
+
+	link, err := api.ShareLinks.Redeem(c.Request.Context(), linkId, req.Password, c.ClientIP())
+	switch {
+	case errors.Is(err, sharing.ErrLinkNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found or expired"})
+		return
+	case errors.Is(err, sharing.ErrWrongPassword):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Wrong password"})
+		return
+	case errors.Is(err, sharing.ErrTooManyAttempts):
+		c.Header("Retry-After", strconv.Itoa(int(sharing.AttemptWindow.Seconds())))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many password attempts, try again later"})
+		return
+	case errors.Is(err, sharing.ErrViewLimitReached):
+		c.JSON(http.StatusGone, gin.H{"error": "Share link has no views left"})
+		return
+	case err != nil:
+		log.Printf("Error redeeming share link %s: %v", linkId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem share link"})
+		return
+	}
+
+	// The link ID stands in for the viewer, so watermarked copies trace back to the link
+	token, expiresAt, err := api.PlaybackTokens.Issue(playback.Claims{
+		VideoID:  link.VideoID,
+		ViewerID: "share:" + link.ID,
+	}, min(shareTokenTTL, time.Until(link.ExpiresAt)))
+	if err != nil {
+		log.Printf("Error signing playback token for share link %s: %v", linkId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue playback token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"video_id":     link.VideoID,
+		"token":        token,
+		"expires_at":   expiresAt,
+		"playback_url": api.Webhooks.PlaybackURL(link.VideoID) + "?" + url.Values{"token": {token}}.Encode(),
+	})
+}
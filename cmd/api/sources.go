@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleLookupSource lists the tenant's videos encoded from a source with the given
+// SHA-256, one per encoding profile.
+func (api *API) handleLookupSource(c *gin.Context) {
+	sha256 := strings.ToLower(c.Param("sha256"))
+	if decoded, err := hex.DecodeString(sha256); err != nil || len(decoded) != 32 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a hex encoded SHA-256"})
+		return
+	}
+
+	videos, err := api.Catalog.BySource(c.Request.Context(), tenantID(c), sha256)
+	if err != nil {
+		log.Printf("Error looking up source %s: %v", sha256, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up source"})
+		return
+	}
+	if len(videos) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No video has been encoded from this source"})
+		return
+	}
+
+	results := make([]gin.H, 0, len(videos))
+	for _, video := range videos {
+		results = append(results, gin.H{
+			"video_id":     video.ID,
+			"profile_key":  video.Request.ProfileKey(),
+			"job_id":       video.JobID,
+			"renditions":   video.Renditions,
+			"encoded_at":   video.EncodedAt,
+			"playback_url": api.Webhooks.PlaybackURL(video.ID),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sha256": sha256, "videos": results})
+}
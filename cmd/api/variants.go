@@ -0,0 +1,189 @@
+package main
+
+import (
+	"better-media/internal/playback"
+	"better-media/pkg/m3u8"
+	"context"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// masterPlaylistPath is where the worker writes the master playlist of a video, relative
+// to the video. Variant URIs in it are relative to its directory.
+const masterPlaylistPath = "/hls/master.m3u8"
+
+// variantFilter limits the variants a request may play. Limits come from the playback
+// token, which the viewer cannot change, and from query parameters, which can only narrow
+// them further, e.g. for a data saver setting in the player.
+type variantFilter struct {
+	MaxHeight    int
+	MaxBandwidth int
+	// Codecs are the video codec families allowed, e.g. avc1 or hvc1, none allows all
+	Codecs []string
+}
+
+// videoCodecFamilies are the CODECS entries a codec filter applies to, audio and text
+// codecs are never filtered
+var videoCodecFamilies = map[string]bool{
+	"avc1": true, "avc3": true,
+	"hvc1": true, "hev1": true,
+	"dvh1": true, "dvhe": true,
+	"av01": true,
+	"vp09": true,
+}
+
+// defaultVideoCodec is assumed for variants without CODECS, which the worker encodes in H.264
+const defaultVideoCodec = "avc1"
+
+// newVariantFilter combines the limits of the token with those of the max_height,
+// max_bandwidth and codecs query parameters, keeping the strictest of each
+func newVariantFilter(claims *playback.Claims, query func(string) string) variantFilter {
+	var filter variantFilter
+	if claims != nil {
+		filter.MaxHeight = claims.MaxHeight
+		filter.MaxBandwidth = claims.MaxBandwidth
+		filter.Codecs = normalizeCodecs(claims.Codecs)
+	}
+
+	filter.MaxHeight = strictestLimit(filter.MaxHeight, query("max_height"))
+	filter.MaxBandwidth = strictestLimit(filter.MaxBandwidth, query("max_bandwidth"))
+
+	if requested := normalizeCodecs(strings.Split(query("codecs"), ",")); len(requested) > 0 {
+		if len(filter.Codecs) == 0 {
+			filter.Codecs = requested
+		} else {
+			// An empty intersection allows nothing rather than everything
+			filter.Codecs = slices.DeleteFunc(requested, func(codec string) bool {
+				return !slices.Contains(filter.Codecs, codec)
+			})
+			if len(filter.Codecs) == 0 {
+				filter.Codecs = []string{"none"}
+			}
+		}
+	}
+
+	return filter
+}
+
+// strictestLimit lowers limit to the query value, invalid values and 0 are ignored
+func strictestLimit(limit int, value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return limit
+	}
+	if limit == 0 {
+		return n
+	}
+	return min(limit, n)
+}
+
+func normalizeCodecs(codecs []string) []string {
+	var normalized []string
+	for _, codec := range codecs {
+		codec = strings.ToLower(strings.TrimSpace(codec))
+		if codec != "" && !slices.Contains(normalized, codec) {
+			normalized = append(normalized, codec)
+		}
+	}
+	return normalized
+}
+
+func (f variantFilter) empty() bool {
+	return f.MaxHeight == 0 && f.MaxBandwidth == 0 && len(f.Codecs) == 0
+}
+
+func (f variantFilter) allows(resolution *m3u8.Resolution, bandwidth int, codecs string) bool {
+	if f.MaxHeight > 0 && resolution != nil && resolution.Height > f.MaxHeight {
+		return false
+	}
+	if f.MaxBandwidth > 0 && bandwidth > f.MaxBandwidth {
+		return false
+	}
+	if len(f.Codecs) == 0 {
+		return true
+	}
+
+	found := false
+	for _, codec := range strings.Split(codecs, ",") {
+		family, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(codec)), ".")
+		if !videoCodecFamilies[family] {
+			continue
+		}
+		found = true
+		if !slices.Contains(f.Codecs, family) {
+			return false
+		}
+	}
+	return found || slices.Contains(f.Codecs, defaultVideoCodec)
+}
+
+func (f variantFilter) allowsVariant(v m3u8.Variant) bool {
+	return f.allows(v.Resolution, v.Bandwidth, v.Codecs)
+}
+
+func (f variantFilter) allowsIFrameVariant(v m3u8.IFrameVariant) bool {
+	return f.allows(v.Resolution, v.Bandwidth, v.Codecs)
+}
+
+// apply removes the variants the filter does not allow from a master playlist
+func (f variantFilter) apply(master *m3u8.MasterPlaylist) {
+	master.Variants = slices.DeleteFunc(master.Variants, func(v m3u8.Variant) bool {
+		return !f.allowsVariant(v)
+	})
+	master.IFrameVariants = slices.DeleteFunc(master.IFrameVariants, func(v m3u8.IFrameVariant) bool {
+		return !f.allowsIFrameVariant(v)
+	})
+}
+
+// variantAllowed reports whether an asset below the master playlist, a media playlist or
+// a segment, belongs to a variant the filter allows. The variant is looked up in the
+// master playlist; assets of no variant, such as alternative audio, are allowed.
+func (api *API) variantAllowed(ctx context.Context, videoId, assetPath string, filter variantFilter) (bool, error) {
+	if filter.empty() || path.Clean(assetPath) == masterPlaylistPath {
+		return true, nil
+	}
+
+	// The height is in the path of the worker's renditions, which saves reading the master
+	// for the most common limit
+	if height := renditionHeight(assetPath); filter.MaxHeight > 0 && height > filter.MaxHeight {
+		return false, nil
+	}
+	if filter.MaxBandwidth == 0 && len(filter.Codecs) == 0 {
+		return true, nil
+	}
+
+	playlist, err := api.Playlists.Get(ctx, path.Join(videoId, masterPlaylistPath), masterPlaylistCacheTTL)
+	if err != nil {
+		return false, err
+	}
+	master, ok := playlist.(*m3u8.MasterPlaylist)
+	if !ok {
+		return true, nil
+	}
+
+	masterDir := path.Dir(masterPlaylistPath)
+	inVariant := func(uri string) bool {
+		return strings.HasPrefix(path.Clean(assetPath), path.Dir(path.Join(masterDir, uri))+"/")
+	}
+
+	matched := false
+	for _, v := range master.Variants {
+		if inVariant(v.URI) {
+			if filter.allowsVariant(v) {
+				return true, nil
+			}
+			matched = true
+		}
+	}
+	for _, v := range master.IFrameVariants {
+		if inVariant(v.URI) {
+			if filter.allowsIFrameVariant(v) {
+				return true, nil
+			}
+			matched = true
+		}
+	}
+	return !matched, nil
+}
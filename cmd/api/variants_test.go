@@ -0,0 +1,146 @@
+package main
+
+import (
+	"better-media/internal/playback"
+	"better-media/pkg/m3u8"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestNewVariantFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims *playback.Claims
+		query  string
+		want   variantFilter
+	}{
+		{
+			name: "no limits",
+		},
+		{
+			name:   "token only",
+			claims: &playback.Claims{MaxHeight: 720, MaxBandwidth: 3000000, Codecs: []string{" AVC1", "avc1", "hvc1"}},
+			want:   variantFilter{MaxHeight: 720, MaxBandwidth: 3000000, Codecs: []string{"avc1", "hvc1"}},
+		},
+		{
+			name:  "query only",
+			query: "max_height=480&max_bandwidth=800000&codecs=hvc1,avc1",
+			want:  variantFilter{MaxHeight: 480, MaxBandwidth: 800000, Codecs: []string{"hvc1", "avc1"}},
+		},
+		{
+			name:   "query narrows the token",
+			claims: &playback.Claims{MaxHeight: 720, MaxBandwidth: 3000000, Codecs: []string{"avc1", "hvc1"}},
+			query:  "max_height=480&max_bandwidth=5000000&codecs=hvc1,av01",
+			want:   variantFilter{MaxHeight: 480, MaxBandwidth: 3000000, Codecs: []string{"hvc1"}},
+		},
+		{
+			name:   "query cannot widen the token",
+			claims: &playback.Claims{MaxHeight: 720, Codecs: []string{"avc1"}},
+			query:  "max_height=0&codecs=av01",
+			want:   variantFilter{MaxHeight: 720, Codecs: []string{"none"}},
+		},
+		{
+			name:  "invalid query values are ignored",
+			query: "max_height=-1&max_bandwidth=lots&codecs=,",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := newVariantFilter(tt.claims, query.Get); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newVariantFilter() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVariantFilterApply(t *testing.T) {
+	master := func() *m3u8.MasterPlaylist {
+		return &m3u8.MasterPlaylist{
+			Variants: []m3u8.Variant{
+				{URI: "1080p/playlist.m3u8", Bandwidth: 5000000, Codecs: "avc1.640028,mp4a.40.2", Resolution: &m3u8.Resolution{Width: 1920, Height: 1080}},
+				{URI: "1080p-hevc/playlist.m3u8", Bandwidth: 3500000, Codecs: "hvc1.2.4.L123.B0,mp4a.40.2", Resolution: &m3u8.Resolution{Width: 1920, Height: 1080}},
+				{URI: "720p/playlist.m3u8", Bandwidth: 2800000, Codecs: "avc1.64001f,mp4a.40.2", Resolution: &m3u8.Resolution{Width: 1280, Height: 720}},
+				{URI: "360p/playlist.m3u8", Bandwidth: 800000},
+			},
+			IFrameVariants: []m3u8.IFrameVariant{
+				{URI: "1080p/iframes.m3u8", Bandwidth: 200000, Codecs: "avc1.640028", Resolution: &m3u8.Resolution{Width: 1920, Height: 1080}},
+				{URI: "720p/iframes.m3u8", Bandwidth: 100000, Codecs: "avc1.64001f", Resolution: &m3u8.Resolution{Width: 1280, Height: 720}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		filter   variantFilter
+		variants []string
+		iframes  []string
+	}{
+		{
+			name:     "max height",
+			filter:   variantFilter{MaxHeight: 720},
+			variants: []string{"720p/playlist.m3u8", "360p/playlist.m3u8"},
+			iframes:  []string{"720p/iframes.m3u8"},
+		},
+		{
+			name:     "max bandwidth",
+			filter:   variantFilter{MaxBandwidth: 3000000},
+			variants: []string{"720p/playlist.m3u8", "360p/playlist.m3u8"},
+			iframes:  []string{"1080p/iframes.m3u8", "720p/iframes.m3u8"},
+		},
+		{
+			name:     "hevc only leaves out variants without CODECS",
+			filter:   variantFilter{Codecs: []string{"hvc1"}},
+			variants: []string{"1080p-hevc/playlist.m3u8"},
+		},
+		{
+			name:     "avc1 keeps variants without CODECS",
+			filter:   variantFilter{Codecs: []string{"avc1"}},
+			variants: []string{"1080p/playlist.m3u8", "720p/playlist.m3u8", "360p/playlist.m3u8"},
+			iframes:  []string{"1080p/iframes.m3u8", "720p/iframes.m3u8"},
+		},
+		{
+			name:   "empty intersection",
+			filter: variantFilter{Codecs: []string{"none"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			playlist := master()
+			tt.filter.apply(playlist)
+
+			var variants, iframes []string
+			for _, v := range playlist.Variants {
+				variants = append(variants, v.URI)
+			}
+			for _, v := range playlist.IFrameVariants {
+				iframes = append(iframes, v.URI)
+			}
+			if !reflect.DeepEqual(variants, tt.variants) {
+				t.Errorf("variants = %v, want %v", variants, tt.variants)
+			}
+			if !reflect.DeepEqual(iframes, tt.iframes) {
+				t.Errorf("i-frame variants = %v, want %v", iframes, tt.iframes)
+			}
+		})
+	}
+}
+
+func TestRenditionHeight(t *testing.T) {
+	for assetPath, want := range map[string]int{
+		"/hls/720p/playlist.m3u8":     720,
+		"/hls/1080p/b/segment001.ts":  1080,
+		"/hls/master.m3u8":            0,
+		"/hls/audio/en/playlist.m3u8": 0,
+	} {
+		if got := renditionHeight(assetPath); got != want {
+			t.Errorf("renditionHeight(%s) = %d, want %d", assetPath, got, want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"better-media/internal/catalog"
+	"better-media/internal/playback"
+	"better-media/pkg/m3u8"
+	"better-media/pkg/models"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errViewerRequired refuses tokens without a viewer for forensically watermarked videos,
+// as a copy served to them could not be traced
+var errViewerRequired = errors.New("playback token must name a viewer to play this video")
+
+// applyForensicWatermark gives the viewer of a watermarked video their own sequence of A
+// and B segments. Videos are known to be watermarked once their job has completed; open
+// playback, without tokens, has no viewer to trace and always gets the A segments.
+func (api *API) applyForensicWatermark(ctx context.Context, media *m3u8.MediaPlaylist, videoId string, claims *playback.Claims) error {
+	viewerId, err := api.watermarkViewer(ctx, videoId, claims)
+	if err != nil || viewerId == "" {
+		return err
+	}
+
+	api.Watermarks.Apply(media, videoId, viewerId)
+	return nil
+}
+
+// watermarkViewer returns the viewer whose sequence of segments a video is served with, ""
+// when the video is not watermarked or there is no token
+func (api *API) watermarkViewer(ctx context.Context, videoId string, claims *playback.Claims) (string, error) {
+	if claims == nil || api.Watermarks == nil {
+		return "", nil
+	}
+
+	video, err := api.Catalog.Get(ctx, videoId)
+	if errors.Is(err, catalog.ErrVideoNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !video.Request.ForensicWatermark {
+		return "", nil
+	}
+	if claims.ViewerID == "" {
+		return "", errViewerRequired
+	}
+	return claims.ViewerID, nil
+}
+
+// checkForensicVariant refuses segments of a watermarked video that are not in the viewer's
+// sequence, so that a viewer cannot fetch both variants and mix them to hide their mark.
+// The position of a segment is looked up in the playlist of its rendition. On failure the
+// response is already written.
+func (api *API) checkForensicVariant(c *gin.Context, videoId, assetPath string, claims *playback.Claims) bool {
+	ctx := c.Request.Context()
+
+	viewerId, err := api.watermarkViewer(ctx, videoId, claims)
+	if errors.Is(err, errViewerRequired) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Playback token must name a viewer to play this video"})
+		return false
+	}
+	if err != nil {
+		log.Printf("Error looking up video %s: %v", videoId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access to this segment"})
+		return false
+	}
+	if viewerId == "" {
+		return true
+	}
+
+	renditionDir := path.Dir(path.Join("/", assetPath))
+	if path.Base(renditionDir) == models.ForensicVariantDir {
+		renditionDir = path.Dir(renditionDir)
+	}
+	playlistKey := path.Join(videoId, strings.TrimPrefix(renditionDir, "/"), "playlist.m3u8")
+	playlist, err := api.Playlists.Get(ctx, playlistKey, api.PlaylistCacheTTL)
+	if err != nil {
+		log.Printf("Error reading playlist %s: %v", playlistKey, err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return false
+	}
+	media, ok := playlist.(*m3u8.MediaPlaylist)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return false
+	}
+
+	uri := strings.TrimPrefix(path.Join("/", assetPath), renditionDir+"/")
+	if !api.Watermarks.Assigned(media, videoId, viewerId, uri) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This segment variant is not assigned to the viewer"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"better-media/internal/webhooks"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url" binding:"required,url"`
+	Events []string `json:"events"`
+}
+
+func (api *API) handleCreateWebhook(c *gin.Context) {
+	var req CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	for _, event := range req.Events {
+		if !slices.Contains(webhooks.EventTypes, event) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event type: " + event, "events": webhooks.EventTypes})
+			return
+		}
+	}
+
+	endpoint, err := api.WebhookStore.CreateEndpoint(c.Request.Context(), tenantID(c), req.URL, req.Events)
+	if err != nil {
+		log.Printf("Error creating webhook endpoint: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+
+	// The secret is only ever returned here
+	c.JSON(http.StatusCreated, endpoint)
+}
+
+func (api *API) handleListWebhooks(c *gin.Context) {
+	endpoints, err := api.WebhookStore.ListEndpoints(c.Request.Context(), tenantID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list webhooks"})
+		return
+	}
+
+	for i := range endpoints {
+		endpoints[i].Secret = ""
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": endpoints})
+}
+
+func (api *API) handleDeleteWebhook(c *gin.Context) {
+	err := api.WebhookStore.DeleteEndpoint(c.Request.Context(), tenantID(c), c.Param("webhookId"))
+	if errors.Is(err, webhooks.ErrEndpointNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (api *API) handleListWebhookDeliveries(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+
+	deliveries, err := api.WebhookStore.ListDeliveries(c.Request.Context(), tenantID(c), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list deliveries"})
+		return
+	}
+
+	// Optional filters, applied on the most recent attempts
+	if jobID := c.Query("job_id"); jobID != "" {
+		deliveries = slices.DeleteFunc(deliveries, func(d webhooks.Delivery) bool { return d.JobID != jobID })
+	}
+	if endpointID := c.Query("webhook_id"); endpointID != "" {
+		deliveries = slices.DeleteFunc(deliveries, func(d webhooks.Delivery) bool { return d.EndpointID != endpointID })
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
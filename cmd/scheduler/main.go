@@ -0,0 +1,73 @@
+package main
+
+import (
+	"better-media/internal/config"
+	"better-media/pkg/models"
+	"log"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/joho/godotenv"
+)
+
+// The scheduler enqueues recurring maintenance tasks, which the workers then run like any
+// other task. Run a single instance: every instance enqueues every schedule, Unique only
+// protects against overlapping runs.
+
+func main() {
+	godotenv.Load()
+
+	redisAddr := config.String("REDIS_ADDR", "127.0.0.1:6379")
+	// Reports of maintenance runs are their task results
+	retention := asynq.Retention(config.Duration("TASK_RESULT_RETENTION", 24*time.Hour))
+
+	location, err := time.LoadLocation(config.String("SCHEDULER_TIMEZONE", "UTC"))
+	if err != nil {
+		log.Fatalf("invalid SCHEDULER_TIMEZONE: %v", err)
+	}
+
+	scheduler := asynq.NewScheduler(asynq.RedisClientOpt{Addr: redisAddr}, &asynq.SchedulerOpts{
+		Location: location,
+		PostEnqueueFunc: func(info *asynq.TaskInfo, err error) {
+			if err != nil {
+				log.Printf("ERROR failed to enqueue scheduled task: %v", err)
+				return
+			}
+			log.Printf("Enqueued scheduled task: type=%s id=%s", info.Type, info.ID)
+		},
+	})
+
+	// Off-peak by default, "off" disables a schedule
+	if spec := config.String("SCHEDULE_REENCODE_OUTDATED", "0 3 * * *"); spec != "off" {
+		task, err := models.NewReencodeOutdatedTask(models.ReencodeOutdatedPayload{
+			Limit: config.Int("SCHEDULE_REENCODE_LIMIT", 100),
+		})
+		if err != nil {
+			log.Fatalf("failed to create re-encode task: %v", err)
+		}
+		entryID, err := scheduler.Register(spec, task, asynq.Queue(models.QueueBulk), asynq.MaxRetry(0), asynq.Unique(time.Hour), retention)
+		if err != nil {
+			log.Fatalf("invalid SCHEDULE_REENCODE_OUTDATED %q: %v", spec, err)
+		}
+		log.Printf("Scheduled re-encode of outdated videos at %q (%s), entry %s", spec, location, entryID)
+	}
+
+	if spec := config.String("SCHEDULE_GC", "0 4 * * *"); spec != "off" {
+		task, err := models.NewGarbageCollectionTask(models.GarbageCollectionPayload{
+			OlderThanHours: config.Int("GC_OLDER_THAN_HOURS", 48),
+			DryRun:         config.Bool("GC_DRY_RUN", true),
+		})
+		if err != nil {
+			log.Fatalf("failed to create garbage collection task: %v", err)
+		}
+		entryID, err := scheduler.Register(spec, task, asynq.Queue(models.QueueBulk), asynq.MaxRetry(0), asynq.Unique(time.Hour), retention)
+		if err != nil {
+			log.Fatalf("invalid SCHEDULE_GC %q: %v", spec, err)
+		}
+		log.Printf("Scheduled garbage collection at %q (%s), entry %s", spec, location, entryID)
+	}
+
+	if err := scheduler.Run(); err != nil {
+		log.Fatalf("could not run scheduler: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"better-media/internal/config"
+	"better-media/internal/playback"
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// watermark-trace finds the viewer a leaked copy of a forensically watermarked video was
+// served to. Read the mark of each segment of the copy in order, A or B, or ? where it
+// cannot be told, and compare that sequence with the viewers who were issued tokens:
+//
+//	go run ./cmd/watermark-trace -video abc123 -viewers viewers.txt -sequence ABBA?BAAB...
+//
+// The secret is WATERMARK_SECRET, or PLAYBACK_TOKEN_SECRET when it is not set, as on the
+// API. A copy served to a viewer matches all of its known segments, any other viewer
+// about half of them.
+
+// minKnownSegments is how many segments it takes before a match means anything
+const minKnownSegments = 32
+
+type candidate struct {
+	viewerID        string
+	known, matching int
+}
+
+func main() {
+	godotenv.Load()
+
+	videoID := flag.String("video", "", "ID of the leaked video")
+	viewersFile := flag.String("viewers", "", "file with one candidate viewer ID per line")
+	sequence := flag.String("sequence", "", "marks of the leaked copy, one A, B or ? per segment from the first one")
+	top := flag.Int("top", 5, "number of candidates to print")
+	flag.Parse()
+
+	secret := config.String("WATERMARK_SECRET", config.String("PLAYBACK_TOKEN_SECRET", ""))
+	if *videoID == "" || *viewersFile == "" || *sequence == "" || secret == "" {
+		flag.Usage()
+		log.Fatal("video, viewers, sequence and WATERMARK_SECRET or PLAYBACK_TOKEN_SECRET are required")
+	}
+
+	viewers, err := readViewers(*viewersFile)
+	if err != nil {
+		log.Fatalf("failed to read viewers: %v", err)
+	}
+
+	watermarks := playback.NewWatermarker(secret)
+	candidates := make([]candidate, 0, len(viewers))
+	for _, viewerID := range viewers {
+		known, matching := watermarks.Match(*videoID, viewerID, *sequence)
+		candidates = append(candidates, candidate{viewerID: viewerID, known: known, matching: matching})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].matching > candidates[j].matching
+	})
+
+	if len(candidates) > 0 && candidates[0].known < minKnownSegments {
+		log.Printf("WARN only %d segments have a known mark, at least %d are needed to tell viewers apart", candidates[0].known, minKnownSegments)
+	}
+	for _, c := range candidates[:min(*top, len(candidates))] {
+		fmt.Printf("%s\t%d/%d segments match (%.0f%%)\n", c.viewerID, c.matching, c.known, 100*float64(c.matching)/float64(max(1, c.known)))
+	}
+}
+
+func readViewers(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var viewers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if viewerID := strings.TrimSpace(scanner.Text()); viewerID != "" {
+			viewers = append(viewers, viewerID)
+		}
+	}
+	return viewers, scanner.Err()
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"better-media/internal/keys"
 	"better-media/internal/storage"
+	"better-media/internal/webhooks"
 	"better-media/internal/worker"
 	"better-media/pkg/models"
 	"log"
@@ -9,15 +11,18 @@ import (
 
 	"github.com/hibiken/asynq"
 	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
 )
 
-const redisAddr = "127.0.0.1:6379"
-
 func main() {
 	godotenv.Load()
 
 	log.Println("Starting transcoder worker...")
 
+	cfg := worker.LoadConfig()
+	log.Printf("Worker config: concurrency=%d queues=%v strict=%t tenant_max_active=%d ffmpeg_threads=%d threads_per_encode=%d",
+		cfg.Concurrency, cfg.Queues, cfg.StrictPriority, cfg.TenantMaxActive, cfg.FFmpegThreads, cfg.ThreadsPerEncode)
+
 	s3Client, err := storage.NewS3Client(
 		os.Getenv("S3_BUCKET_NAME"),
 		os.Getenv("S3_ENDPOINT"),
@@ -28,15 +33,53 @@ func main() {
 		log.Fatalf("failed to create s3 client: %v", err)
 	}
 
-	asynqServer := asynq.NewServer(asynq.RedisClientOpt{Addr: redisAddr}, asynq.Config{
-		Concurrency: 1,
+	asynqServer := asynq.NewServer(asynq.RedisClientOpt{Addr: cfg.RedisAddr}, asynq.Config{
+		Concurrency:    cfg.Concurrency,
+		Queues:         cfg.Queues,
+		StrictPriority: cfg.StrictPriority,
+		RetryDelayFunc: worker.RetryDelay,
+		IsFailure:      worker.IsFailure,
 	})
 
+	// Job graphs fan out follow-up tasks and track their progress in Redis
+	asynqClient := asynq.NewClient(asynq.RedisClientOpt{Addr: cfg.RedisAddr})
+	defer asynqClient.Close()
+
+	rdb := redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
+	defer rdb.Close()
+
 	mux := asynq.NewServeMux()
 
-	processor := worker.NewTaskProcessor(s3Client)
+	// Every task that downloads the source or encodes counts, the coordinators too
+	limiter := worker.NewTenantLimiter(rdb, cfg.TenantMaxActive, cfg.TenantLease,
+		models.TaskEncodeVideo,
+		models.TaskProbeVideo,
+		models.TaskEncodeRendition,
+		models.TaskSplitVideo,
+		models.TaskEncodeChunk,
+	)
+	mux.Use(limiter.Middleware)
+
+	publisher := webhooks.NewPublisher(rdb, asynqClient, cfg.PublicBaseURL)
+	processor := worker.NewTaskProcessor(s3Client, asynqClient, rdb, worker.NewResources(cfg), publisher)
+	processor.ResultRetention = cfg.ResultRetention
+	if cfg.KeyEncryptionKey != "" {
+		if processor.Keys, err = keys.NewStore(s3Client, cfg.KeyEncryptionKey); err != nil {
+			log.Fatalf("failed to configure the key store: %v", err)
+		}
+	}
+	deliverer := webhooks.NewDeliverer(rdb, cfg.WebhookSecret)
 
 	mux.HandleFunc(models.TaskEncodeVideo, processor.HandleVideoEncodeTask)
+	mux.HandleFunc(models.TaskProbeVideo, processor.HandleProbeVideoTask)
+	mux.HandleFunc(models.TaskEncodeRendition, processor.HandleRenditionEncodeTask)
+	mux.HandleFunc(models.TaskFinalizeVideo, processor.HandleFinalizeTask)
+	mux.HandleFunc(models.TaskSplitVideo, processor.HandleSplitVideoTask)
+	mux.HandleFunc(models.TaskEncodeChunk, processor.HandleChunkEncodeTask)
+	mux.HandleFunc(models.TaskStitchVideo, processor.HandleStitchTask)
+	mux.HandleFunc(models.TaskDeliverWebhook, deliverer.HandleDeliverWebhookTask)
+	mux.HandleFunc(models.TaskReencodeOutdated, processor.HandleReencodeOutdatedTask)
+	mux.HandleFunc(models.TaskCollectGarbage, processor.HandleCollectGarbageTask)
 
 	if err := asynqServer.Run(mux); err != nil {
 		log.Fatalf("could not run transcoder worker: %v", err)
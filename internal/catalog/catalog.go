@@ -0,0 +1,292 @@
+package catalog
+
+import (
+	"better-media/pkg/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The catalog records every video that has been encoded successfully, with the request
+// that produced its current output. It is what maintenance tasks work from, since the
+// bucket alone does not tell which settings a video was encoded with.
+//
+//	better-media:video:[videoId]              hash  tenant_id, job_id, request, renditions, source_sha256, profile_version, encoded_at, visibility
+//	better-media:videos                       set   every cataloged video ID
+//	better-media:source:[tenantId]:[sha256]   hash  profile key -> video ID encoded from that source
+//	better-media:upload:[videoId]             string  tenant the upload endpoint issued the video ID to, until
+//	                                                  the video is cataloged, collected or uploadTTL passes
+//
+// Sources are indexed per tenant, so a tenant can never learn about another's content by
+// uploading the same file. A job can set the visibility of a video before it is encoded, so
+// its hash may hold nothing else until the job completes.
+
+var ErrVideoNotFound = errors.New("video not found")
+
+// Visibility decides who can play a video. Public and unlisted videos play without a
+// playback token, unlisted ones are just not meant to be listed anywhere; private videos
+// always need one. Videos without a visibility follow the API's configuration.
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+type Video struct {
+	ID             string                      `json:"id"`
+	TenantID       string                      `json:"tenant_id,omitempty"`
+	JobID          string                      `json:"job_id"`
+	Request        models.VideoEncodingPayload `json:"request"`
+	Renditions     []int                       `json:"renditions,omitempty"`
+	SourceSHA256   string                      `json:"source_sha256,omitempty"`
+	ProfileVersion int                         `json:"profile_version"`
+	EncodedAt      time.Time                   `json:"encoded_at"`
+	Visibility     string                      `json:"visibility,omitempty"`
+}
+
+type Catalog struct {
+	rdb *redis.Client
+}
+
+func New(rdb *redis.Client) *Catalog {
+	return &Catalog{rdb: rdb}
+}
+
+func videoKey(videoID string) string {
+	return "better-media:video:" + videoID
+}
+
+const videosKey = "better-media:videos"
+
+func sourceKey(tenantID, sha256 string) string {
+	return "better-media:source:" + tenantID + ":" + sha256
+}
+
+func uploadKey(videoID string) string {
+	return "better-media:upload:" + videoID
+}
+
+// uploadTTL is how long the owner of a video ID is kept if it is never encoded, well past
+// the age at which garbage collection deletes an abandoned upload
+const uploadTTL = 7 * 24 * time.Hour
+
+// RecordEncoded stores the output of a completed job as the current version of its video
+func (c *Catalog) RecordEncoded(ctx context.Context, video Video) error {
+	request, err := json.Marshal(video.Request)
+	if err != nil {
+		return err
+	}
+	renditions, err := json.Marshal(video.Renditions)
+	if err != nil {
+		return err
+	}
+
+	pipe := c.rdb.TxPipeline()
+	pipe.HSet(ctx, videoKey(video.ID),
+		"tenant_id", video.TenantID,
+		"job_id", video.JobID,
+		"request", request,
+		"renditions", renditions,
+		"source_sha256", video.SourceSHA256,
+		"profile_version", video.ProfileVersion,
+		"encoded_at", video.EncodedAt.UnixMilli(),
+	)
+	pipe.SAdd(ctx, videosKey, video.ID)
+	// The catalog knows the owner from now on
+	pipe.Del(ctx, uploadKey(video.ID))
+	if video.SourceSHA256 != "" {
+		pipe.HSet(ctx, sourceKey(video.TenantID, video.SourceSHA256), video.Request.ProfileKey(), video.ID)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (c *Catalog) Get(ctx context.Context, videoID string) (*Video, error) {
+	fields, err := c.rdb.HGetAll(ctx, videoKey(videoID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if fields["encoded_at"] == "" {
+		return nil, ErrVideoNotFound
+	}
+	return parseVideo(videoID, fields)
+}
+
+func parseVideo(videoID string, fields map[string]string) (*Video, error) {
+	video := &Video{
+		ID:           videoID,
+		TenantID:     fields["tenant_id"],
+		JobID:        fields["job_id"],
+		SourceSHA256: fields["source_sha256"],
+		Visibility:   fields["visibility"],
+	}
+	if err := json.Unmarshal([]byte(fields["request"]), &video.Request); err != nil {
+		return nil, err
+	}
+	if renditions := fields["renditions"]; renditions != "" {
+		json.Unmarshal([]byte(renditions), &video.Renditions)
+	}
+	video.ProfileVersion, _ = strconv.Atoi(fields["profile_version"])
+	encodedAt, _ := strconv.ParseInt(fields["encoded_at"], 10, 64)
+	video.EncodedAt = time.UnixMilli(encodedAt)
+	return video, nil
+}
+
+// RecordUpload remembers the tenant a new video ID was issued to, so that its files have an
+// owner before the video is encoded
+func (c *Catalog) RecordUpload(ctx context.Context, videoID, tenantID string) error {
+	return c.rdb.Set(ctx, uploadKey(videoID), tenantID, uploadTTL).Err()
+}
+
+// ForgetUpload removes the owner of a video ID that was collected as garbage
+func (c *Catalog) ForgetUpload(ctx context.Context, videoID string) error {
+	return c.rdb.Del(ctx, uploadKey(videoID)).Err()
+}
+
+// Owner returns the tenant of a video: the one it is cataloged for, or else the one its ID
+// was issued to. It is empty when neither is known.
+func (c *Catalog) Owner(ctx context.Context, videoID string) (string, error) {
+	video, err := c.Get(ctx, videoID)
+	if err == nil {
+		return video.TenantID, nil
+	}
+	if !errors.Is(err, ErrVideoNotFound) {
+		return "", err
+	}
+
+	tenantID, err := c.rdb.Get(ctx, uploadKey(videoID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return tenantID, err
+}
+
+// setVisibilityScript only sets the field of videos that are cataloged already, or whose
+// job has set it
+var setVisibilityScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'visibility', ARGV[1])
+return 1
+`)
+
+// SetVisibility changes who can play a video. It is kept when the video is encoded again.
+func (c *Catalog) SetVisibility(ctx context.Context, videoID, visibility string) error {
+	ok, err := setVisibilityScript.Run(ctx, c.rdb, []string{videoKey(videoID)}, visibility).Bool()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrVideoNotFound
+	}
+	return nil
+}
+
+// swapVisibilityScript sets the visibility field and returns the previous one, false when
+// there was none
+var swapVisibilityScript = redis.NewScript(`
+local previous = redis.call('HGET', KEYS[1], 'visibility')
+redis.call('HSET', KEYS[1], 'visibility', ARGV[1])
+return previous
+`)
+
+// SetInitialVisibility sets the visibility of a video that may not be cataloged yet, for a
+// job that sets it before its first rendition is published. It returns the previous
+// visibility for RestoreVisibility, empty when there was none.
+func (c *Catalog) SetInitialVisibility(ctx context.Context, videoID, visibility string) (string, error) {
+	previous, err := swapVisibilityScript.Run(ctx, c.rdb, []string{videoKey(videoID)}, visibility).Text()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return previous, err
+}
+
+// RestoreVisibility undoes SetInitialVisibility for a job that was not queued after all
+func (c *Catalog) RestoreVisibility(ctx context.Context, videoID, previous string) error {
+	if previous == "" {
+		// A hash left empty is removed by Redis
+		return c.rdb.HDel(ctx, videoKey(videoID), "visibility").Err()
+	}
+	return c.rdb.HSet(ctx, videoKey(videoID), "visibility", previous).Err()
+}
+
+// Visibility returns the visibility of a video, empty when none was set
+func (c *Catalog) Visibility(ctx context.Context, videoID string) (string, error) {
+	visibility, err := c.rdb.HGet(ctx, videoKey(videoID), "visibility").Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return visibility, err
+}
+
+// Outdated returns up to limit videos encoded with a profile older than version
+func (c *Catalog) Outdated(ctx context.Context, version, limit int) ([]*Video, error) {
+	var outdated []*Video
+
+	iter := c.rdb.SScan(ctx, videosKey, 0, "", 100).Iterator()
+	for iter.Next(ctx) && len(outdated) < limit {
+		video, err := c.Get(ctx, iter.Val())
+		if errors.Is(err, ErrVideoNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if video.ProfileVersion < version {
+			outdated = append(outdated, video)
+		}
+	}
+	return outdated, iter.Err()
+}
+
+// FindBySource returns the video of the tenant last encoded from the same source with the
+// same profile.
+func (c *Catalog) FindBySource(ctx context.Context, tenantID, sha256, profileKey string) (*Video, error) {
+	videoID, err := c.rdb.HGet(ctx, sourceKey(tenantID, sha256), profileKey).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrVideoNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.current(ctx, videoID, sha256, profileKey)
+}
+
+// BySource returns every video of the tenant encoded from the source, one per profile
+func (c *Catalog) BySource(ctx context.Context, tenantID, sha256 string) ([]*Video, error) {
+	videoIDs, err := c.rdb.HGetAll(ctx, sourceKey(tenantID, sha256)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	videos := []*Video{}
+	for profileKey, videoID := range videoIDs {
+		video, err := c.current(ctx, videoID, sha256, profileKey)
+		if errors.Is(err, ErrVideoNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, nil
+}
+
+// current returns a video only while its output still comes from the given source and
+// profile. The index is not cleaned up when a video is encoded again differently.
+func (c *Catalog) current(ctx context.Context, videoID, sha256, profileKey string) (*Video, error) {
+	video, err := c.Get(ctx, videoID)
+	if err != nil {
+		return nil, err
+	}
+	if video.SourceSHA256 != sha256 || video.Request.ProfileKey() != profileKey {
+		return nil, ErrVideoNotFound
+	}
+	return video, nil
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Small helpers to read settings from the environment (or .env through godotenv).
+// Invalid values are logged and replaced by the default instead of aborting startup.
+
+func String(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && strings.TrimSpace(v) != "" {
+		return strings.TrimSpace(v)
+	}
+	return def
+}
+
+func Int(key string, def int) int {
+	v := String(key, "")
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("WARN invalid integer for %s=%q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+func Int64(key string, def int64) int64 {
+	v := String(key, "")
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Printf("WARN invalid integer for %s=%q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+func Float(key string, def float64) float64 {
+	v := String(key, "")
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("WARN invalid number for %s=%q, using %v", key, v, def)
+		return def
+	}
+	return f
+}
+
+func Bool(key string, def bool) bool {
+	v := String(key, "")
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("WARN invalid boolean for %s=%q, using %t", key, v, def)
+		return def
+	}
+	return b
+}
+
+func Duration(key string, def time.Duration) time.Duration {
+	v := String(key, "")
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("WARN invalid duration for %s=%q, using %v", key, v, def)
+		return def
+	}
+	return d
+}
+
+// List parses "a,b,c", dropping empty entries.
+func List(key string, def []string) []string {
+	v := String(key, "")
+	if v == "" {
+		return def
+	}
+
+	var list []string
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	if len(list) == 0 {
+		return def
+	}
+	return list
+}
+
+// Weights parses "name:weight,name:weight", e.g. "critical:6,default:3,bulk:1".
+// A name without a weight counts as 1.
+func Weights(key string, def map[string]int) map[string]int {
+	v := String(key, "")
+	if v == "" {
+		return def
+	}
+
+	weights := map[string]int{}
+	for _, entry := range strings.Split(v, ",") {
+		name, weight, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if name == "" {
+			continue
+		}
+		n := 1
+		if found {
+			parsed, err := strconv.Atoi(weight)
+			if err != nil || parsed <= 0 {
+				log.Printf("WARN invalid weight for %s in %s=%q, using %v", name, key, v, def)
+				return def
+			}
+			n = parsed
+		}
+		weights[name] = n
+	}
+
+	if len(weights) == 0 {
+		return def
+	}
+	return weights
+}
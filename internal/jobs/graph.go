@@ -0,0 +1,356 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A job is a fan-out/fan-in graph: a single parent job owns a set of nodes (renditions,
+// chunks, ...) that can run on any worker. The node that completes last is told so, and
+// is responsible for queueing the finalize step. Any node failing marks the parent job as
+// failed, which the remaining nodes observe before doing more work.
+//
+// State is kept in Redis so that every worker in the cluster sees the same graph:
+//
+//	better-media:job:[jobId]        hash  video_id, tenant_id, webhook_url, request, source_sha256, status, pending, error, timestamps
+//	better-media:job:[jobId]:nodes  hash  node -> status
+//	better-media:job:[jobId]:results  hash  node -> result JSON of the node's task
+//	better-media:video:[videoId]:jobs set   jobs created for the video
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusCompleted Status = "completed"
+	StatusFailed    Status = "failed"
+)
+
+const jobTTL = 7 * 24 * time.Hour
+
+var (
+	ErrJobFailed   = errors.New("job has failed")
+	ErrJobNotFound = errors.New("job not found")
+)
+
+type Job struct {
+	ID        string            `json:"id"`
+	VideoID   string            `json:"video_id"`
+	TenantID  string            `json:"tenant_id,omitempty"`
+	Status    Status            `json:"status"`
+	Error     string            `json:"error,omitempty"`
+	Pending   int               `json:"pending"`
+	Nodes     map[string]Status `json:"nodes"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+
+	// WebhookURL receives the lifecycle events of this job, on top of the tenant's endpoints
+	WebhookURL string `json:"webhook_url,omitempty"`
+
+	// Request is the submission that created the job, so its last task can catalog it
+	Request json.RawMessage `json:"request,omitempty"`
+	// SourceSHA256 is the hash of the source, once the first task computed it
+	SourceSHA256 string `json:"source_sha256,omitempty"`
+
+	// Results holds what each node produced, as written by its task
+	Results map[string]json.RawMessage `json:"results,omitempty"`
+}
+
+type Graph struct {
+	rdb *redis.Client
+}
+
+func NewGraph(rdb *redis.Client) *Graph {
+	return &Graph{rdb: rdb}
+}
+
+func jobKey(jobID string) string {
+	return "better-media:job:" + jobID
+}
+
+func nodesKey(jobID string) string {
+	return jobKey(jobID) + ":nodes"
+}
+
+func resultsKey(jobID string) string {
+	return jobKey(jobID) + ":results"
+}
+
+func videoJobsKey(videoID string) string {
+	return "better-media:video:" + videoID + ":jobs"
+}
+
+// Create registers a job as pending. It is a no-op if the job already exists, so both the
+// API and a (retried) coordinator task can call it.
+func (g *Graph) Create(ctx context.Context, job Job) error {
+	now := time.Now().UnixMilli()
+
+	created, err := g.rdb.HSetNX(ctx, jobKey(job.ID), "created_at", now).Result()
+	if err != nil || !created {
+		return err
+	}
+
+	pipe := g.rdb.TxPipeline()
+	pipe.HSet(ctx, jobKey(job.ID),
+		"video_id", job.VideoID,
+		"tenant_id", job.TenantID,
+		"webhook_url", job.WebhookURL,
+		"request", string(job.Request),
+		"status", string(StatusPending),
+		"pending", 0,
+		"updated_at", now,
+	)
+	pipe.Expire(ctx, jobKey(job.ID), jobTTL)
+	pipe.SAdd(ctx, videoJobsKey(job.VideoID), job.ID)
+	pipe.Expire(ctx, videoJobsKey(job.VideoID), jobTTL)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// HasActiveJobs reports whether a job for the video is still pending or running. Jobs are
+// tracked per video for as long as the jobs themselves are kept.
+func (g *Graph) HasActiveJobs(ctx context.Context, videoID string) (bool, error) {
+	jobIDs, err := g.rdb.SMembers(ctx, videoJobsKey(videoID)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	for _, jobID := range jobIDs {
+		status, err := g.rdb.HGet(ctx, jobKey(jobID), "status").Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if Status(status) == StatusPending || Status(status) == StatusRunning {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// VideoTenant returns the tenant that created jobs for a video, empty when the video has no
+// jobs that are still kept
+func (g *Graph) VideoTenant(ctx context.Context, videoID string) (string, error) {
+	jobIDs, err := g.rdb.SMembers(ctx, videoJobsKey(videoID)).Result()
+	if err != nil {
+		return "", err
+	}
+
+	for _, jobID := range jobIDs {
+		tenantID, err := g.rdb.HGet(ctx, jobKey(jobID), "tenant_id").Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return tenantID, nil
+	}
+	return "", nil
+}
+
+var addNodesScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('job not found')
+end
+if redis.call('HGET', KEYS[1], 'status') == 'failed' then
+	return -1
+end
+local added = 0
+for i = 2, #ARGV do
+	added = added + redis.call('HSETNX', KEYS[2], ARGV[i], 'pending')
+end
+redis.call('HINCRBY', KEYS[1], 'pending', added)
+redis.call('HSET', KEYS[1], 'status', 'running', 'updated_at', ARGV[1])
+redis.call('EXPIRE', KEYS[2], redis.call('TTL', KEYS[1]))
+return added
+`)
+
+// AddNodes attaches nodes to a job. Nodes that already exist are left untouched.
+func (g *Graph) AddNodes(ctx context.Context, jobID string, nodes ...string) error {
+	args := []any{time.Now().UnixMilli()}
+	for _, node := range nodes {
+		args = append(args, node)
+	}
+
+	res, err := addNodesScript.Run(ctx, g.rdb, []string{jobKey(jobID), nodesKey(jobID)}, args...).Int()
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return ErrJobFailed
+	}
+	return nil
+}
+
+var startNodeScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'status') == 'failed' then
+	return -1
+end
+if redis.call('HGET', KEYS[2], ARGV[1]) == 'pending' then
+	redis.call('HSET', KEYS[2], ARGV[1], 'running')
+end
+redis.call('HSET', KEYS[1], 'updated_at', ARGV[2])
+return 0
+`)
+
+// Start marks a node as running. It returns ErrJobFailed if a sibling already failed the
+// job, in which case the caller should not do any work.
+func (g *Graph) Start(ctx context.Context, jobID, node string) error {
+	res, err := startNodeScript.Run(ctx, g.rdb, []string{jobKey(jobID), nodesKey(jobID)}, node, time.Now().UnixMilli()).Int()
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return ErrJobFailed
+	}
+	return nil
+}
+
+var completeNodeScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'status') == 'failed' then
+	return -1
+end
+local prev = redis.call('HGET', KEYS[2], ARGV[1])
+if not prev then
+	return redis.error_reply('unknown node ' .. ARGV[1])
+end
+if prev == 'completed' then
+	return 0
+end
+redis.call('HSET', KEYS[2], ARGV[1], 'completed')
+redis.call('HSET', KEYS[1], 'updated_at', ARGV[2])
+if redis.call('HINCRBY', KEYS[1], 'pending', -1) == 0 then
+	return 1
+end
+return 0
+`)
+
+// Complete marks a node as done and reports whether it was the last pending node of the
+// job. Completing the same node twice is a no-op, so retried tasks never double count.
+func (g *Graph) Complete(ctx context.Context, jobID, node string) (bool, error) {
+	res, err := completeNodeScript.Run(ctx, g.rdb, []string{jobKey(jobID), nodesKey(jobID)}, node, time.Now().UnixMilli()).Int()
+	if err != nil {
+		return false, err
+	}
+	if res < 0 {
+		return false, ErrJobFailed
+	}
+	return res == 1, nil
+}
+
+// Fail marks the node and its parent job as failed, and releases the job's video lock. The
+// first failure wins, later ones only update their own node. first reports whether this
+// call is the one that failed the job.
+func (g *Graph) Fail(ctx context.Context, jobID, node string, cause error) (first bool, err error) {
+	now := time.Now().UnixMilli()
+
+	pipe := g.rdb.TxPipeline()
+	pipe.HSet(ctx, nodesKey(jobID), node, string(StatusFailed))
+	firstCmd := pipe.HSetNX(ctx, jobKey(jobID), "error", fmt.Sprintf("%s: %v", node, cause))
+	pipe.HSet(ctx, jobKey(jobID), "status", string(StatusFailed), "updated_at", now)
+	videoID := pipe.HGet(ctx, jobKey(jobID), "video_id")
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+
+	return firstCmd.Val(), g.UnlockVideo(ctx, videoID.Val(), jobID)
+}
+
+// Finish marks the whole job as completed, after the finalize step has run, and releases
+// the job's video lock.
+func (g *Graph) Finish(ctx context.Context, jobID string) error {
+	pipe := g.rdb.TxPipeline()
+	pipe.HSet(ctx, jobKey(jobID), "status", string(StatusCompleted), "updated_at", time.Now().UnixMilli())
+	videoID := pipe.HGet(ctx, jobKey(jobID), "video_id")
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	return g.UnlockVideo(ctx, videoID.Val(), jobID)
+}
+
+func (g *Graph) Get(ctx context.Context, jobID string) (*Job, error) {
+	pipe := g.rdb.Pipeline()
+	jobCmd := pipe.HGetAll(ctx, jobKey(jobID))
+	nodesCmd := pipe.HGetAll(ctx, nodesKey(jobID))
+	resultsCmd := pipe.HGetAll(ctx, resultsKey(jobID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	fields := jobCmd.Val()
+	if len(fields) == 0 {
+		return nil, ErrJobNotFound
+	}
+
+	job := &Job{
+		ID:         jobID,
+		VideoID:    fields["video_id"],
+		TenantID:   fields["tenant_id"],
+		Status:     Status(fields["status"]),
+		Error:      fields["error"],
+		Nodes:      map[string]Status{},
+		WebhookURL: fields["webhook_url"],
+
+		SourceSHA256: fields["source_sha256"],
+	}
+	if request := fields["request"]; request != "" {
+		job.Request = json.RawMessage(request)
+	}
+	fmt.Sscan(fields["pending"], &job.Pending)
+
+	var createdAt, updatedAt int64
+	fmt.Sscan(fields["created_at"], &createdAt)
+	fmt.Sscan(fields["updated_at"], &updatedAt)
+	job.CreatedAt = time.UnixMilli(createdAt)
+	job.UpdatedAt = time.UnixMilli(updatedAt)
+
+	for node, status := range nodesCmd.Val() {
+		job.Nodes[node] = Status(status)
+	}
+	if results := resultsCmd.Val(); len(results) > 0 {
+		job.Results = map[string]json.RawMessage{}
+		for node, result := range results {
+			job.Results[node] = json.RawMessage(result)
+		}
+	}
+
+	return job, nil
+}
+
+func (g *Graph) SetSourceHash(ctx context.Context, jobID, sha256 string) error {
+	return g.rdb.HSet(ctx, jobKey(jobID), "source_sha256", sha256).Err()
+}
+
+// SetResult stores the result of a node, replacing any previous one from a retried task
+func (g *Graph) SetResult(ctx context.Context, jobID, node string, result []byte) error {
+	pipe := g.rdb.TxPipeline()
+	pipe.HSet(ctx, resultsKey(jobID), node, result)
+	pipe.Expire(ctx, resultsKey(jobID), jobTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+var resetScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'status') ~= 'failed' then
+	return 0
+end
+redis.call('DEL', KEYS[2], KEYS[3])
+redis.call('HDEL', KEYS[1], 'error')
+redis.call('HSET', KEYS[1], 'status', 'pending', 'pending', 0, 'updated_at', ARGV[1])
+return 1
+`)
+
+// Reset clears the nodes of a failed job so that its first task can run it again from
+// scratch. Jobs that did not fail are left untouched.
+func (g *Graph) Reset(ctx context.Context, jobID string) error {
+	return resetScript.Run(ctx, g.rdb, []string{jobKey(jobID), nodesKey(jobID), resultsKey(jobID)}, time.Now().UnixMilli()).Err()
+}
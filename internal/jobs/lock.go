@@ -0,0 +1,104 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A video lock makes a job the only writer of its video's prefix in the bucket. Two jobs
+// encoding the same video at once would interleave segments and overwrite each other's
+// master.m3u8. The lock belongs to a job rather than a task because a job writes from many
+// tasks on many workers; each of them refreshes it before touching the prefix and keeps
+// refreshing it while it runs.
+
+const VideoLockTTL = 30 * time.Minute
+
+var ErrVideoLocked = errors.New("video is locked by another job")
+
+func videoLockKey(videoID string) string {
+	return "better-media:lock:video:" + videoID
+}
+
+var lockVideoScript = redis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if holder and holder ~= ARGV[1] then
+	return holder
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return ARGV[1]
+`)
+
+// LockVideo acquires (or, for its current holder, extends) the lock on a video's prefix.
+// When another job holds it, the error wraps ErrVideoLocked and names that job.
+func (g *Graph) LockVideo(ctx context.Context, videoID, jobID string) error {
+	holder, err := lockVideoScript.Run(ctx, g.rdb, []string{videoLockKey(videoID)}, jobID, VideoLockTTL.Milliseconds()).Text()
+	if err != nil {
+		return err
+	}
+	if holder != jobID {
+		return &VideoLockedError{VideoID: videoID, HolderJobID: holder}
+	}
+	return nil
+}
+
+// A lock that expired while the job's tasks were queued is taken again, as long as no other
+// job took it and the job is still going.
+var refreshVideoLockScript = redis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if holder and holder ~= ARGV[1] then
+	return holder
+end
+if not holder then
+	local status = redis.call('HGET', KEYS[2], 'status')
+	if status ~= 'pending' and status ~= 'running' then
+		return ''
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return ARGV[1]
+`)
+
+// RefreshVideoLock extends the lock held by jobID. It fails with ErrVideoLocked if the job
+// lost the lock, because another job took over after it expired or the job has ended.
+// Workers refresh it every VideoLockTTL/3 while a task of the job runs.
+func (g *Graph) RefreshVideoLock(ctx context.Context, videoID, jobID string) error {
+	holder, err := refreshVideoLockScript.Run(ctx, g.rdb, []string{videoLockKey(videoID), jobKey(jobID)}, jobID, VideoLockTTL.Milliseconds()).Text()
+	if err != nil {
+		return err
+	}
+	if holder != jobID {
+		return &VideoLockedError{VideoID: videoID, HolderJobID: holder}
+	}
+	return nil
+}
+
+var unlockVideoScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// UnlockVideo releases the lock if jobID still holds it.
+func (g *Graph) UnlockVideo(ctx context.Context, videoID, jobID string) error {
+	return unlockVideoScript.Run(ctx, g.rdb, []string{videoLockKey(videoID)}, jobID).Err()
+}
+
+type VideoLockedError struct {
+	VideoID     string
+	HolderJobID string
+}
+
+func (e *VideoLockedError) Error() string {
+	if e.HolderJobID == "" {
+		return "lost the lock on video " + e.VideoID
+	}
+	return "video " + e.VideoID + " is being encoded by job " + e.HolderJobID
+}
+
+func (e *VideoLockedError) Unwrap() error {
+	return ErrVideoLocked
+}
@@ -0,0 +1,106 @@
+package jobs
+
+import (
+	"better-media/internal/config"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testGraph connects to the Redis at REDIS_ADDR, the test is skipped without one
+func testGraph(t *testing.T) *Graph {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: config.String("REDIS_ADDR", "127.0.0.1:6379")})
+	t.Cleanup(func() { rdb.Close() })
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("Redis is not available: %v", err)
+	}
+	return NewGraph(rdb)
+}
+
+func createJob(t *testing.T, g *Graph, videoID string) string {
+	t.Helper()
+	jobID := fmt.Sprintf("test-job-%d", time.Now().UnixNano())
+	if err := g.Create(context.Background(), Job{ID: jobID, VideoID: videoID}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		g.rdb.Del(context.Background(), jobKey(jobID), nodesKey(jobID), videoJobsKey(videoID))
+	})
+	return jobID
+}
+
+func expireLock(t *testing.T, g *Graph, videoID string) {
+	t.Helper()
+	ctx := context.Background()
+	if err := g.rdb.PExpire(ctx, videoLockKey(videoID), 20*time.Millisecond).Err(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n, _ := g.rdb.Exists(ctx, videoLockKey(videoID)).Result(); n != 0 {
+		t.Fatal("lock did not expire")
+	}
+}
+
+func TestRefreshVideoLock(t *testing.T) {
+	g := testGraph(t)
+	ctx := context.Background()
+	videoID := fmt.Sprintf("test-video-%d", time.Now().UnixNano())
+	t.Cleanup(func() { g.rdb.Del(context.Background(), videoLockKey(videoID)) })
+
+	first := createJob(t, g, videoID)
+	second := createJob(t, g, videoID)
+
+	if err := g.LockVideo(ctx, videoID, first); err != nil {
+		t.Fatalf("LockVideo() = %v", err)
+	}
+	if err := g.LockVideo(ctx, videoID, second); !errors.Is(err, ErrVideoLocked) {
+		t.Fatalf("LockVideo() by another job = %v, want ErrVideoLocked", err)
+	}
+
+	t.Run("extends", func(t *testing.T) {
+		g.rdb.PExpire(ctx, videoLockKey(videoID), time.Minute)
+		if err := g.RefreshVideoLock(ctx, videoID, first); err != nil {
+			t.Fatalf("RefreshVideoLock() = %v", err)
+		}
+		if ttl := g.rdb.PTTL(ctx, videoLockKey(videoID)).Val(); ttl < VideoLockTTL-time.Minute {
+			t.Errorf("lock TTL = %v after refresh, want about %v", ttl, VideoLockTTL)
+		}
+	})
+
+	t.Run("takes back a lapsed lock", func(t *testing.T) {
+		expireLock(t, g, videoID)
+		if err := g.RefreshVideoLock(ctx, videoID, first); err != nil {
+			t.Fatalf("RefreshVideoLock() = %v", err)
+		}
+		if holder := g.rdb.Get(ctx, videoLockKey(videoID)).Val(); holder != first {
+			t.Errorf("lock holder = %q, want %q", holder, first)
+		}
+	})
+
+	t.Run("lost to another job", func(t *testing.T) {
+		expireLock(t, g, videoID)
+		if err := g.LockVideo(ctx, videoID, second); err != nil {
+			t.Fatalf("LockVideo() = %v", err)
+		}
+
+		err := g.RefreshVideoLock(ctx, videoID, first)
+		var locked *VideoLockedError
+		if !errors.As(err, &locked) || locked.HolderJobID != second {
+			t.Fatalf("RefreshVideoLock() = %v, want the lock held by %s", err, second)
+		}
+	})
+
+	t.Run("ended job", func(t *testing.T) {
+		if err := g.Finish(ctx, second); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.RefreshVideoLock(ctx, videoID, second); !errors.Is(err, ErrVideoLocked) {
+			t.Fatalf("RefreshVideoLock() after Finish = %v, want ErrVideoLocked", err)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package keys
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Provider hands out the content keys of a video for playback. Store is the built-in
+// provider; a commercial DRM license server is plugged in by implementing it.
+type Provider interface {
+	// Keys returns the keys of a video with the given IDs, or ErrKeyNotFound if one of
+	// them does not exist
+	Keys(ctx context.Context, videoID string, keyIDs []string) ([]Key, error)
+}
+
+// Keys gets several keys of a video from the bucket
+func (s *Store) Keys(ctx context.Context, videoID string, keyIDs []string) ([]Key, error) {
+	found := make([]Key, 0, len(keyIDs))
+	for _, id := range keyIDs {
+		value, err := s.Get(ctx, videoID, id)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, Key{ID: id, Value: value})
+	}
+	return found, nil
+}
+
+// ClearKeySystemID is the W3C common PSSH system ID, used by ClearKey
+var ClearKeySystemID = [16]byte{
+	0x10, 0x77, 0xef, 0xec, 0xc0, 0xb2, 0x4d, 0x02,
+	0xac, 0xe3, 0x3c, 0x1e, 0x52, 0xe2, 0xfb, 0x4b,
+}
+
+// IDBytes is the 16 byte key ID (KID) of a key, as written in tenc and pssh boxes
+func IDBytes(keyID string) ([]byte, error) {
+	if !validID(keyID) {
+		return nil, ErrInvalidID
+	}
+	return hex.DecodeString(keyID)
+}
+
+// PSSH builds a version 1 Protection System Specific Header box, which lists the key IDs
+// it applies to, for the init segment of an fMP4 rendition or the cenc:pssh element of a
+// DASH manifest. data is specific to the DRM system, nil for ClearKey.
+func PSSH(systemID [16]byte, keyIDs []string, data []byte) ([]byte, error) {
+	kids := make([][]byte, 0, len(keyIDs))
+	for _, id := range keyIDs {
+		kid, err := IDBytes(id)
+		if err != nil {
+			return nil, err
+		}
+		kids = append(kids, kid)
+	}
+	if len(kids) == 0 {
+		return nil, errors.New("a pssh box needs at least one key ID")
+	}
+
+	size := 8 + 4 + 16 + 4 + 16*len(kids) + 4 + len(data)
+	box := make([]byte, 0, size)
+	box = binary.BigEndian.AppendUint32(box, uint32(size))
+	box = append(box, "pssh"...)
+	// Version 1, no flags
+	box = binary.BigEndian.AppendUint32(box, 1<<24)
+	box = append(box, systemID[:]...)
+	box = binary.BigEndian.AppendUint32(box, uint32(len(kids)))
+	for _, kid := range kids {
+		box = append(box, kid...)
+	}
+	box = binary.BigEndian.AppendUint32(box, uint32(len(data)))
+	box = append(box, data...)
+	return box, nil
+}
+
+// InsertPSSH adds pssh boxes at the end of the moov box of an fMP4 init segment, where
+// EME players look for the key IDs to request licenses for
+func InsertPSSH(initSegment []byte, boxes ...[]byte) ([]byte, error) {
+	for offset := 0; offset+8 <= len(initSegment); {
+		size := int(binary.BigEndian.Uint32(initSegment[offset:]))
+		if size < 8 || offset+size > len(initSegment) {
+			// 64-bit and to-end-of-file sizes are not used by init segments
+			return nil, fmt.Errorf("invalid box size %d at offset %d", size, offset)
+		}
+		if string(initSegment[offset+4:offset+8]) != "moov" {
+			offset += size
+			continue
+		}
+
+		added := 0
+		for _, box := range boxes {
+			added += len(box)
+		}
+		out := make([]byte, 0, len(initSegment)+added)
+		out = append(out, initSegment[:offset+size]...)
+		for _, box := range boxes {
+			out = append(out, box...)
+		}
+		out = append(out, initSegment[offset+size:]...)
+		binary.BigEndian.PutUint32(out[offset:], uint32(size+added))
+		return out, nil
+	}
+	return nil, errors.New("init segment has no moov box")
+}
@@ -0,0 +1,87 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// box builds an ISO BMFF box
+func box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	b = append(b, boxType...)
+	return append(b, body...)
+}
+
+func TestPSSH(t *testing.T) {
+	kid1 := "0123456789abcdef0123456789abcdef"
+	kid2 := "fedcba9876543210fedcba9876543210"
+
+	got, err := PSSH(ClearKeySystemID, []string{kid1, kid2}, []byte{0xaa, 0xbb})
+	if err != nil {
+		t.Fatalf("PSSH() = %v", err)
+	}
+
+	want, _ := hex.DecodeString("" +
+		"00000046" + "70737368" + // size 70, "pssh"
+		"01000000" + // version 1, no flags
+		"1077efecc0b24d02ace33c1e52e2fb4b" + // system ID
+		"00000002" + // KID count
+		kid1 + kid2 +
+		"00000002" + "aabb") // data size and data
+	if !bytes.Equal(got, want) {
+		t.Errorf("PSSH() =\n%x\nwant\n%x", got, want)
+	}
+
+	if _, err := PSSH(ClearKeySystemID, nil, nil); err == nil {
+		t.Error("PSSH() without key IDs succeeded")
+	}
+	if _, err := PSSH(ClearKeySystemID, []string{"not-a-key-id"}, nil); err != ErrInvalidID {
+		t.Errorf("PSSH() with an invalid key ID = %v, want ErrInvalidID", err)
+	}
+}
+
+func TestInsertPSSH(t *testing.T) {
+	pssh, err := PSSH(ClearKeySystemID, []string{"0123456789abcdef0123456789abcdef"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ftyp := box("ftyp", []byte("iso6\x00\x00\x00\x00iso6dash"))
+	mvhd := box("mvhd", make([]byte, 100))
+	trak := box("trak", box("tkhd", make([]byte, 84)))
+	mvex := box("mvex", box("trex", make([]byte, 24)))
+	initSegment := append(append([]byte{}, ftyp...), box("moov", mvhd, trak, mvex)...)
+
+	got, err := InsertPSSH(initSegment, pssh)
+	if err != nil {
+		t.Fatalf("InsertPSSH() = %v", err)
+	}
+	want := append(append([]byte{}, ftyp...), box("moov", mvhd, trak, mvex, pssh)...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("InsertPSSH() =\n%x\nwant\n%x", got, want)
+	}
+
+	// Boxes after moov are kept
+	withFree := append(append([]byte{}, initSegment...), box("free")...)
+	got, err = InsertPSSH(withFree, pssh, pssh)
+	if err != nil {
+		t.Fatalf("InsertPSSH() = %v", err)
+	}
+	want = append(append(append([]byte{}, ftyp...), box("moov", mvhd, trak, mvex, pssh, pssh)...), box("free")...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("InsertPSSH() with a trailing box =\n%x\nwant\n%x", got, want)
+	}
+
+	for name, invalid := range map[string][]byte{
+		"no moov":   ftyp,
+		"truncated": initSegment[:len(initSegment)-1],
+		"zero size": append(append([]byte{}, ftyp...), 0, 0, 0, 0, 'm', 'o', 'o', 'v'),
+	} {
+		if _, err := InsertPSSH(invalid, pssh); err == nil {
+			t.Errorf("InsertPSSH() of %s succeeded", name)
+		}
+	}
+}
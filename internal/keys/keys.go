@@ -0,0 +1,148 @@
+// Package keys stores the content keys HLS segments are encrypted with.
+//
+// Keys live in the bucket under .keys/{videoId}/{keyId}, outside the video prefix that
+// segments are served from, and are sealed with a key encryption key (AES-256-GCM) that
+// only the worker and the API know. A copy of the bucket or a CDN that serves it by
+// mistake does not reveal them.
+package keys
+
+import (
+	"better-media/internal/storage"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Size is the size of an AES-128 content key
+const Size = 16
+
+// Prefix is the top level prefix of the bucket that holds every key
+const Prefix = ".keys/"
+
+// uriScheme marks a key URI the worker writes into playlists, which the API replaces with
+// the URL of its key endpoint when it serves the playlist
+const uriScheme = "better-media-key:"
+
+var (
+	ErrKeyNotFound = errors.New("key not found")
+	ErrInvalidID   = errors.New("invalid key id")
+)
+
+type Key struct {
+	ID    string
+	Value []byte
+}
+
+type Store struct {
+	s3  *storage.S3Client
+	kek cipher.AEAD
+}
+
+// NewStore takes the key encryption key as 32 bytes in hex or base64
+func NewStore(s3c *storage.S3Client, kek string) (*Store, error) {
+	secret, err := hex.DecodeString(kek)
+	if err != nil {
+		secret, err = base64.StdEncoding.DecodeString(kek)
+	}
+	if err != nil || len(secret) != 32 {
+		return nil, errors.New("the key encryption key must be 32 bytes in hex or base64")
+	}
+
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{s3: s3c, kek: aead}, nil
+}
+
+// VideoPrefix is where the keys of a video are stored
+func VideoPrefix(videoID string) string {
+	return Prefix + videoID + "/"
+}
+
+func objectKey(videoID, keyID string) string {
+	return VideoPrefix(videoID) + keyID
+}
+
+// Create generates a new key for a video and stores it
+func (s *Store) Create(ctx context.Context, videoID string) (Key, error) {
+	id := make([]byte, 16)
+	value := make([]byte, Size)
+	if _, err := rand.Read(id); err != nil {
+		return Key{}, err
+	}
+	if _, err := rand.Read(value); err != nil {
+		return Key{}, err
+	}
+	key := Key{ID: hex.EncodeToString(id), Value: value}
+
+	// The key ID is authenticated rather than the video, so that keys stay valid when the
+	// output of a video is copied to another one
+	nonce := make([]byte, s.kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return Key{}, err
+	}
+	sealed := s.kek.Seal(nonce, nonce, key.Value, []byte(key.ID))
+
+	if err := s.s3.PutObject(ctx, objectKey(videoID, key.ID), sealed, "application/octet-stream"); err != nil {
+		return Key{}, fmt.Errorf("failed to store key: %w", err)
+	}
+	return key, nil
+}
+
+// Get returns the value of a key of a video, or ErrKeyNotFound
+func (s *Store) Get(ctx context.Context, videoID, keyID string) ([]byte, error) {
+	if !validID(keyID) {
+		return nil, ErrInvalidID
+	}
+
+	body, err := s.s3.GetObject(ctx, objectKey(videoID, keyID))
+	if storage.IsNotFound(err) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	sealed, err := io.ReadAll(io.LimitReader(body, 1024))
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := s.kek.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("stored key is truncated")
+	}
+	value, err := s.kek.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key %s: %w", keyID, err)
+	}
+	return value, nil
+}
+
+// URI is the key URI to write into a playlist for a key
+func URI(keyID string) string {
+	return uriScheme + keyID
+}
+
+// ParseURI returns the ID of the key a URI written by URI refers to
+func ParseURI(uri string) (string, bool) {
+	id, ok := strings.CutPrefix(uri, uriScheme)
+	return id, ok && validID(id)
+}
+
+func validID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32 && id == strings.ToLower(id)
+}
@@ -0,0 +1,146 @@
+package playback
+
+import (
+	"better-media/internal/storage"
+	"better-media/pkg/m3u8"
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// PlaylistFetcher gets a playlist and its ETag, or storage.ErrNotModified when etag is not
+// empty and still matches, as storage.S3Client.GetObjectIfChanged does.
+type PlaylistFetcher func(ctx context.Context, key, etag string) (io.ReadCloser, string, error)
+
+// playlistCacheStats are published under /debug/vars
+var playlistCacheStats = expvar.NewMap("playlist_cache")
+
+// PlaylistCache keeps parsed playlists in memory, so that serving one does not cost a
+// bucket request and a parse every time. Entries expire after the TTL given when they are
+// loaded, then they are revalidated with their ETag; an unchanged playlist is not
+// transferred again. The least recently used entries are evicted beyond the capacity.
+type PlaylistCache struct {
+	capacity int
+	fetch    PlaylistFetcher
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	loads singleflight.Group
+}
+
+type cachedPlaylist struct {
+	key      string
+	etag     string
+	playlist m3u8.Playlist
+	expires  time.Time
+}
+
+// NewPlaylistCache keeps up to capacity playlists, 0 disables caching but still shares
+// concurrent loads
+func NewPlaylistCache(capacity int, fetch PlaylistFetcher) *PlaylistCache {
+	c := &PlaylistCache{
+		capacity: capacity,
+		fetch:    fetch,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+	playlistCacheStats.Set("entries", expvar.Func(func() any { return c.Len() }))
+	return c
+}
+
+// Get returns a copy of the playlist at key, which the caller may change. A miss loads the
+// playlist once no matter how many requests are waiting for it.
+func (c *PlaylistCache) Get(ctx context.Context, key string, ttl time.Duration) (m3u8.Playlist, error) {
+	entry := c.lookup(key)
+	if entry != nil && time.Now().Before(entry.expires) {
+		playlistCacheStats.Add("hits", 1)
+		return entry.playlist.Clone(), nil
+	}
+	playlistCacheStats.Add("misses", 1)
+
+	loaded, err, _ := c.loads.Do(key, func() (any, error) {
+		// The load is shared, so it must not be cancelled with the request that started it
+		return c.load(context.WithoutCancel(ctx), key, entry, ttl)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loaded.(m3u8.Playlist).Clone(), nil
+}
+
+func (c *PlaylistCache) load(ctx context.Context, key string, stale *cachedPlaylist, ttl time.Duration) (m3u8.Playlist, error) {
+	etag := ""
+	if stale != nil {
+		etag = stale.etag
+	}
+
+	body, etag, err := c.fetch(ctx, key, etag)
+	if stale != nil && errors.Is(err, storage.ErrNotModified) {
+		playlistCacheStats.Add("revalidations", 1)
+		c.store(&cachedPlaylist{key: key, etag: stale.etag, playlist: stale.playlist, expires: time.Now().Add(ttl)})
+		return stale.playlist, nil
+	}
+	if err != nil {
+		playlistCacheStats.Add("errors", 1)
+		return nil, err
+	}
+	defer body.Close()
+
+	playlist, err := m3u8.Decode(body)
+	if err != nil {
+		playlistCacheStats.Add("errors", 1)
+		return nil, err
+	}
+
+	c.store(&cachedPlaylist{key: key, etag: etag, playlist: playlist, expires: time.Now().Add(ttl)})
+	return playlist, nil
+}
+
+func (c *PlaylistCache) lookup(key string) *cachedPlaylist {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cachedPlaylist)
+}
+
+func (c *PlaylistCache) store(entry *cachedPlaylist) {
+	if c.capacity <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedPlaylist).key)
+		playlistCacheStats.Add("evictions", 1)
+	}
+}
+
+func (c *PlaylistCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
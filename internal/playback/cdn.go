@@ -0,0 +1,198 @@
+package playback
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CDN serves segments straight from a CDN in front of the bucket, so that players fetch
+// them from the edge instead of being redirected to presigned bucket URLs. Playlists still
+// go through the proxy, which checks playback tokens and points segment URIs at the CDN.
+type CDN struct {
+	// BaseURL is where the CDN serves the bucket, an object key is appended to it
+	BaseURL string
+
+	// Signer signs segment URLs or cookies, nil for a CDN that serves without signatures
+	Signer *CloudFrontSigner
+
+	// SignedCookies grants access to all segments of a video with cookies set on the
+	// playlist response, instead of signing every segment URL. The cookies are set for
+	// CookieDomain, a parent domain of both the API and the CDN.
+	SignedCookies bool
+	CookieDomain  string
+}
+
+// URL returns the CDN URL of an object, signed until expires unless cookies are used
+func (c *CDN) URL(key string, query url.Values, expires time.Time) (string, error) {
+	u := strings.TrimSuffix(c.BaseURL, "/") + "/" + strings.TrimPrefix(key, "/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	if c.Signer == nil || c.SignedCookies {
+		return u, nil
+	}
+
+	signature, err := c.Signer.SignURL(u, expires)
+	if err != nil {
+		return "", err
+	}
+	if len(query) > 0 {
+		return u + "&" + signature.Encode(), nil
+	}
+	return u + "?" + signature.Encode(), nil
+}
+
+// Cookies returns the signed cookies that grant access to every object under prefix
+// until expires, or nil when the CDN does not use signed cookies.
+func (c *CDN) Cookies(prefix string, expires time.Time) ([]*http.Cookie, error) {
+	if c.Signer == nil || !c.SignedCookies {
+		return nil, nil
+	}
+
+	resource := strings.TrimSuffix(c.BaseURL, "/") + "/" + strings.Trim(prefix, "/") + "/*"
+	values, err := c.Signer.SignCookies(resource, expires)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/"
+	if base, err := url.Parse(c.BaseURL); err == nil {
+		path = strings.TrimSuffix(base.Path, "/") + "/" + strings.Trim(prefix, "/") + "/"
+	}
+
+	cookies := make([]*http.Cookie, 0, len(values))
+	for _, name := range []string{"CloudFront-Policy", "CloudFront-Signature", "CloudFront-Key-Pair-Id"} {
+		cookies = append(cookies, &http.Cookie{
+			Name:     name,
+			Value:    values[name],
+			Domain:   c.CookieDomain,
+			Path:     path,
+			Expires:  expires,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteNoneMode,
+		})
+	}
+	return cookies, nil
+}
+
+// CloudFrontSigner signs URLs and cookies with a CloudFront key pair (RSA-SHA1), see
+// https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/PrivateContent.html
+type CloudFrontSigner struct {
+	keyPairID string
+	key       *rsa.PrivateKey
+}
+
+// NewCloudFrontSigner takes the ID of the public key registered with CloudFront and the
+// PEM encoded private key (PKCS #1 or PKCS #8)
+func NewCloudFrontSigner(keyPairID string, privateKeyPEM []byte) (*CloudFrontSigner, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return &CloudFrontSigner{keyPairID: keyPairID, key: key}, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("CloudFront keys must be RSA")
+	}
+	return &CloudFrontSigner{keyPairID: keyPairID, key: key}, nil
+}
+
+type cloudFrontPolicy struct {
+	Statement []cloudFrontStatement `json:"Statement"`
+}
+
+type cloudFrontStatement struct {
+	Resource  string `json:"Resource"`
+	Condition struct {
+		DateLessThan struct {
+			EpochTime int64 `json:"AWS:EpochTime"`
+		} `json:"DateLessThan"`
+	} `json:"Condition"`
+}
+
+func newCloudFrontPolicy(resource string, expires time.Time) ([]byte, error) {
+	statement := cloudFrontStatement{Resource: resource}
+	statement.Condition.DateLessThan.EpochTime = expires.Unix()
+
+	// CloudFront rebuilds canned policies from the request URL, so a & in the query must
+	// not be escaped the way json.Marshal does
+	var policy bytes.Buffer
+	encoder := json.NewEncoder(&policy)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(cloudFrontPolicy{Statement: []cloudFrontStatement{statement}}); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(policy.Bytes(), []byte("\n")), nil
+}
+
+// SignURL signs a single URL with a canned policy and returns the query parameters to
+// append to it
+func (s *CloudFrontSigner) SignURL(rawURL string, expires time.Time) (url.Values, error) {
+	policy, err := newCloudFrontPolicy(rawURL, expires)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := s.sign(policy)
+	if err != nil {
+		return nil, err
+	}
+	return url.Values{
+		"Expires":     {strconv.FormatInt(expires.Unix(), 10)},
+		"Signature":   {signature},
+		"Key-Pair-Id": {s.keyPairID},
+	}, nil
+}
+
+// SignCookies signs a custom policy for resource, which may end in a * wildcard, and
+// returns the values of the CloudFront cookies
+func (s *CloudFrontSigner) SignCookies(resource string, expires time.Time) (map[string]string, error) {
+	policy, err := newCloudFrontPolicy(resource, expires)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := s.sign(policy)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"CloudFront-Policy":      cloudFrontEncode(policy),
+		"CloudFront-Signature":   signature,
+		"CloudFront-Key-Pair-Id": s.keyPairID,
+	}, nil
+}
+
+func (s *CloudFrontSigner) sign(policy []byte) (string, error) {
+	hash := sha1.Sum(policy)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return cloudFrontEncode(signature), nil
+}
+
+// cloudFrontEncode is base64 with the characters CloudFront cannot take in a URL replaced
+func cloudFrontEncode(b []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(b))
+}
@@ -0,0 +1,73 @@
+package playback
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Playback tokens are HS256 JWTs that grant access to a single video. The API issues them
+// to customer backends, which hand them to their players; the playback proxy verifies the
+// token on every request and carries it into the URLs of the playlists it rewrites.
+
+var ErrInvalidToken = errors.New("invalid playback token")
+
+type Claims struct {
+	VideoID string `json:"vid"`
+	// ViewerID identifies the viewer for the customer's own analytics, it is not checked
+	ViewerID string `json:"viewer,omitempty"`
+	// IP binds the token to a single client address
+	IP string `json:"ip,omitempty"`
+	// MaxHeight and MaxBandwidth cap the variants the token can play, 0 means no cap
+	MaxHeight    int `json:"max_height,omitempty"`
+	MaxBandwidth int `json:"max_bandwidth,omitempty"`
+	// Codecs limits the variants to these video codec families, e.g. avc1
+	Codecs []string `json:"codecs,omitempty"`
+
+	jwt.RegisteredClaims
+}
+
+type Signer struct {
+	secret []byte
+}
+
+func NewSigner(secret string) *Signer {
+	return &Signer{secret: []byte(secret)}
+}
+
+// Issue signs claims valid for ttl from now
+func (s *Signer) Issue(claims Claims, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(expiresAt)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secret)
+	return token, expiresAt, err
+}
+
+// Verify checks the signature and expiry of a token and returns its claims
+func (s *Signer) Verify(token string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return s.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	return &claims, nil
+}
+
+// Allows checks that the claims grant access to a video from a client address
+func (c *Claims) Allows(videoID, clientIP string) error {
+	if c.VideoID != videoID {
+		return fmt.Errorf("%w: issued for another video", ErrInvalidToken)
+	}
+	if c.IP != "" && c.IP != clientIP {
+		return fmt.Errorf("%w: bound to another address", ErrInvalidToken)
+	}
+	return nil
+}
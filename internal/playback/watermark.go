@@ -0,0 +1,89 @@
+package playback
+
+import (
+	"better-media/pkg/m3u8"
+	"better-media/pkg/models"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"path"
+	"strings"
+)
+
+// Watermarker assembles the segments of forensically watermarked videos into a sequence of
+// A and B variants that is unique to each viewer. A leaked copy carries that sequence in
+// its marks; Match finds the viewer it was served to.
+//
+// The sequence is an HMAC of the video and viewer IDs, so viewers cannot work out each
+// other's sequence, and it depends on the position of a segment only, so a copy that
+// switched renditions while it was recorded still decodes.
+type Watermarker struct {
+	secret []byte
+}
+
+func NewWatermarker(secret string) *Watermarker {
+	return &Watermarker{secret: []byte(secret)}
+}
+
+// Sequence returns the variant of each of the first n segments served to a viewer, false
+// for A and true for B
+func (w *Watermarker) Sequence(videoID, viewerID string, n int) []bool {
+	sequence := make([]bool, 0, n)
+	for block := uint32(0); len(sequence) < n; block++ {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write([]byte(videoID))
+		mac.Write([]byte{0})
+		mac.Write([]byte(viewerID))
+		mac.Write(binary.BigEndian.AppendUint32(nil, block))
+
+		for _, b := range mac.Sum(nil) {
+			for bit := 7; bit >= 0 && len(sequence) < n; bit-- {
+				sequence = append(sequence, b>>bit&1 == 1)
+			}
+		}
+	}
+	return sequence
+}
+
+// Apply points the segments of a media playlist at the variants of a viewer's sequence.
+// The B variants are in models.ForensicVariantDir next to the A segments.
+func (w *Watermarker) Apply(media *m3u8.MediaPlaylist, videoID, viewerID string) {
+	sequence := w.Sequence(videoID, viewerID, media.MediaSequence+len(media.Segments))
+	for i := range media.Segments {
+		segment := &media.Segments[i]
+		if !sequence[media.MediaSequence+i] || strings.Contains(segment.URI, "://") {
+			continue
+		}
+		segment.URI = path.Join(path.Dir(segment.URI), models.ForensicVariantDir, path.Base(segment.URI))
+	}
+}
+
+// Assigned reports whether uri, relative to a media playlist, is a segment of the viewer's
+// sequence: one that the playlist refers to once Apply has rewritten it for them
+func (w *Watermarker) Assigned(media *m3u8.MediaPlaylist, videoID, viewerID, uri string) bool {
+	assigned := media.Clone().(*m3u8.MediaPlaylist)
+	w.Apply(assigned, videoID, viewerID)
+	for _, segment := range assigned.Segments {
+		if path.Clean(segment.URI) == path.Clean(uri) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match compares the sequence read from a leaked copy, one A, B or ? per segment from the
+// first one on, with the sequence of a viewer. It returns how many segments had a known
+// variant and how many of those match. A copy served to someone else matches about half.
+func (w *Watermarker) Match(videoID, viewerID, observed string) (known, matching int) {
+	sequence := w.Sequence(videoID, viewerID, len(observed))
+	for i, variant := range strings.ToUpper(observed) {
+		if variant != 'A' && variant != 'B' {
+			continue
+		}
+		known++
+		if (variant == 'B') == sequence[i] {
+			matching++
+		}
+	}
+	return known, matching
+}
@@ -0,0 +1,39 @@
+package playback
+
+import (
+	"better-media/pkg/m3u8"
+	"fmt"
+	"testing"
+)
+
+func TestWatermarkerAssigned(t *testing.T) {
+	w := NewWatermarker("secret")
+	media := &m3u8.MediaPlaylist{TargetDuration: 4, MediaSequence: 0}
+	for i := range 16 {
+		media.Segments = append(media.Segments, m3u8.Segment{URI: fmt.Sprintf("segment%03d.ts", i), Duration: 4})
+	}
+
+	for _, viewer := range []string{"alice", "bob"} {
+		sequence := w.Sequence("vid1", viewer, len(media.Segments))
+		for i, b := range sequence {
+			a, other := fmt.Sprintf("segment%03d.ts", i), fmt.Sprintf("b/segment%03d.ts", i)
+			if b {
+				a, other = other, a
+			}
+			if !w.Assigned(media, "vid1", viewer, a) {
+				t.Errorf("Assigned(%s, %s) = false, want true", viewer, a)
+			}
+			if w.Assigned(media, "vid1", viewer, other) {
+				t.Errorf("Assigned(%s, %s) = true, want false", viewer, other)
+			}
+		}
+	}
+
+	if w.Assigned(media, "vid1", "alice", "segment099.ts") {
+		t.Error("Assigned() of a segment outside the playlist = true")
+	}
+	// The cached playlist is left alone
+	if media.Segments[0].URI != "segment000.ts" {
+		t.Errorf("Assigned() changed the playlist: %s", media.Segments[0].URI)
+	}
+}
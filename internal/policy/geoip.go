@@ -0,0 +1,87 @@
+package policy
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// GeoIP maps client addresses to countries from a local IP range database in CSV, one
+// range per line: first address, last address and ISO 3166 country code, as in the DB-IP
+// and IP2Location Lite country files. Further columns are ignored.
+type GeoIP struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	first, last netip.Addr
+	country     string
+}
+
+// OpenGeoIP loads a database file in memory
+func OpenGeoIP(path string) (*GeoIP, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	var ranges []ipRange
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: expected first address, last address and country", line)
+		}
+
+		first, errFirst := netip.ParseAddr(strings.TrimSpace(record[0]))
+		last, errLast := netip.ParseAddr(strings.TrimSpace(record[1]))
+		if errFirst != nil || errLast != nil {
+			// A header line
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: invalid address range", line)
+		}
+		ranges = append(ranges, ipRange{first: first.Unmap(), last: last.Unmap(), country: strings.ToUpper(strings.TrimSpace(record[2]))})
+	}
+
+	slices.SortFunc(ranges, func(a, b ipRange) int { return a.first.Compare(b.first) })
+	return &GeoIP{ranges: ranges}, nil
+}
+
+// Country returns the country code of an address, or "" when the database has no range
+// for it
+func (g *GeoIP) Country(addr netip.Addr) string {
+	addr = addr.Unmap()
+	i, found := slices.BinarySearchFunc(g.ranges, addr, func(r ipRange, addr netip.Addr) int {
+		return r.first.Compare(addr)
+	})
+	if !found {
+		// The range starting before the address, if any, may contain it
+		i--
+	}
+	if i < 0 || g.ranges[i].last.Compare(addr) < 0 || g.ranges[i].first.BitLen() != addr.BitLen() {
+		return ""
+	}
+	return g.ranges[i].country
+}
+
+// Len is the number of ranges loaded
+func (g *GeoIP) Len() int {
+	return len(g.ranges)
+}
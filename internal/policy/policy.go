@@ -0,0 +1,219 @@
+// Package policy restricts where a video can be played from: the country and network of
+// the viewer and the site that embeds the player.
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Policies are stored per video:
+//
+//	better-media:policy:[videoId]  string  Policy JSON
+
+var ErrPolicyNotFound = errors.New("playback policy not found")
+
+// Policy lists the restrictions of a video. Every list that is set must allow a request;
+// an empty policy allows everything.
+type Policy struct {
+	// AllowedCountries and BlockedCountries are ISO 3166 codes, looked up in the GeoIP
+	// database. A viewer whose country is unknown is only let through a blocklist.
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+	BlockedCountries []string `json:"blocked_countries,omitempty"`
+	// AllowedCIDRs are the networks viewers must be in, e.g. 203.0.113.0/24
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
+	// AllowedReferrers are the hosts of the pages allowed to embed the player, a leading
+	// *. also allows every subdomain. Requests without a Referer are denied.
+	AllowedReferrers []string `json:"allowed_referrers,omitempty"`
+	// AllowedOrigins are origins such as https://example.com or https://*.example.com,
+	// checked against the Origin header, or the origin of the Referer without it
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+}
+
+// Reasons of a denial, for clients to tell them apart
+const (
+	ReasonCountryNotAllowed  = "country_not_allowed"
+	ReasonCountryBlocked     = "country_blocked"
+	ReasonNetworkNotAllowed  = "network_not_allowed"
+	ReasonReferrerNotAllowed = "referrer_not_allowed"
+	ReasonOriginNotAllowed   = "origin_not_allowed"
+)
+
+// Denial explains why a request is not allowed
+type Denial struct {
+	Reason  string
+	Message string
+}
+
+func (d *Denial) Error() string {
+	return d.Message
+}
+
+// Request is what a policy is checked against
+type Request struct {
+	ClientIP netip.Addr
+	Referer  string
+	Origin   string
+}
+
+// NeedsGeoIP reports whether the policy restricts countries
+func (p *Policy) NeedsGeoIP() bool {
+	return len(p.AllowedCountries) > 0 || len(p.BlockedCountries) > 0
+}
+
+// Normalize validates the policy and puts its entries in canonical form
+func (p *Policy) Normalize() error {
+	for _, countries := range []*[]string{&p.AllowedCountries, &p.BlockedCountries} {
+		for i, country := range *countries {
+			country = strings.ToUpper(strings.TrimSpace(country))
+			if len(country) != 2 {
+				return fmt.Errorf("invalid country code %q, expected ISO 3166 alpha-2", country)
+			}
+			(*countries)[i] = country
+		}
+	}
+	for i, cidr := range p.AllowedCIDRs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		// Client addresses are unmapped before they are checked, so IPv4-mapped networks
+		// are stored as the IPv4 networks they stand for
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		p.AllowedCIDRs[i] = prefix.Masked().String()
+	}
+	for i, host := range p.AllowedReferrers {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" || strings.ContainsAny(host, "/:") {
+			return fmt.Errorf("invalid referrer host %q, expected a host such as example.com", host)
+		}
+		p.AllowedReferrers[i] = host
+	}
+	for i, origin := range p.AllowedOrigins {
+		u, err := url.Parse(strings.ToLower(strings.TrimSpace(origin)))
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("invalid origin %q, expected a scheme and host such as https://example.com", origin)
+		}
+		p.AllowedOrigins[i] = u.Scheme + "://" + u.Host
+	}
+	return nil
+}
+
+// Check returns a *Denial if the policy does not allow the request. geo may be nil when
+// the policy does not restrict countries.
+func (p *Policy) Check(req Request, geo *GeoIP) error {
+	if p.NeedsGeoIP() {
+		country := ""
+		if geo != nil && req.ClientIP.IsValid() {
+			country = geo.Country(req.ClientIP)
+		}
+		if len(p.AllowedCountries) > 0 && !slices.Contains(p.AllowedCountries, country) {
+			return &Denial{Reason: ReasonCountryNotAllowed, Message: "This video is not available in your country" + countrySuffix(country)}
+		}
+		if country != "" && slices.Contains(p.BlockedCountries, country) {
+			return &Denial{Reason: ReasonCountryBlocked, Message: "This video is not available in your country" + countrySuffix(country)}
+		}
+	}
+
+	if len(p.AllowedCIDRs) > 0 && !slices.ContainsFunc(p.AllowedCIDRs, func(cidr string) bool {
+		prefix, err := netip.ParsePrefix(cidr)
+		return err == nil && req.ClientIP.IsValid() && prefix.Contains(req.ClientIP.Unmap())
+	}) {
+		return &Denial{Reason: ReasonNetworkNotAllowed, Message: "This video cannot be played from your network"}
+	}
+
+	referer, _ := url.Parse(req.Referer)
+	if len(p.AllowedReferrers) > 0 {
+		if referer == nil || !slices.ContainsFunc(p.AllowedReferrers, func(host string) bool {
+			return hostMatches(host, referer.Hostname())
+		}) {
+			return &Denial{Reason: ReasonReferrerNotAllowed, Message: "This video cannot be played on this site"}
+		}
+	}
+
+	if len(p.AllowedOrigins) > 0 {
+		origin, _ := url.Parse(strings.ToLower(req.Origin))
+		if req.Origin == "" || req.Origin == "null" {
+			origin = referer
+		}
+		if origin == nil || !slices.ContainsFunc(p.AllowedOrigins, func(allowed string) bool {
+			a, err := url.Parse(allowed)
+			return err == nil && a.Scheme == origin.Scheme && a.Port() == origin.Port() && hostMatches(a.Hostname(), origin.Hostname())
+		}) {
+			return &Denial{Reason: ReasonOriginNotAllowed, Message: "This video cannot be played from this origin"}
+		}
+	}
+
+	return nil
+}
+
+func countrySuffix(country string) string {
+	if country == "" {
+		return ""
+	}
+	return " (" + country + ")"
+}
+
+// hostMatches matches a host against example.com or *.example.com
+func hostMatches(pattern, host string) bool {
+	host = strings.ToLower(host)
+	if host == "" {
+		return false
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+type Store struct {
+	rdb *redis.Client
+}
+
+func NewStore(rdb *redis.Client) *Store {
+	return &Store{rdb: rdb}
+}
+
+func policyKey(videoID string) string {
+	return "better-media:policy:" + videoID
+}
+
+// Get returns the policy of a video, or ErrPolicyNotFound
+func (s *Store) Get(ctx context.Context, videoID string) (*Policy, error) {
+	data, err := s.rdb.Get(ctx, policyKey(videoID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrPolicyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (s *Store) Set(ctx context.Context, videoID string, policy *Policy) error {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, policyKey(videoID), data, 0).Err()
+}
+
+// Delete removes the policy of a video, it reports whether there was one
+func (s *Store) Delete(ctx context.Context, videoID string) (bool, error) {
+	n, err := s.rdb.Del(ctx, policyKey(videoID)).Result()
+	return n > 0, err
+}
@@ -0,0 +1,277 @@
+package policy
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testGeoIP(t *testing.T) *GeoIP {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "geoip.csv")
+	database := "ip_start,ip_end,country\n" +
+		"192.0.2.0,192.0.2.255,FR\n" +
+		"198.51.100.0,198.51.100.255,US\n" +
+		"2001:db8::,2001:db8::ffff,BE\n"
+	if err := os.WriteFile(file, []byte(database), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	geo, err := OpenGeoIP(file)
+	if err != nil {
+		t.Fatalf("OpenGeoIP() = %v", err)
+	}
+	return geo
+}
+
+func TestNormalize(t *testing.T) {
+	p := Policy{
+		AllowedCountries: []string{" fr", "Be"},
+		BlockedCountries: []string{"us"},
+		AllowedCIDRs:     []string{"203.0.113.7/24", " 2001:DB8::1/32", "::ffff:198.51.100.0/120"},
+		AllowedReferrers: []string{" Example.com", "*.example.com"},
+		AllowedOrigins:   []string{"HTTPS://Player.Example.com/", "http://localhost:3000"},
+	}
+	if err := p.Normalize(); err != nil {
+		t.Fatalf("Normalize() = %v", err)
+	}
+	want := Policy{
+		AllowedCountries: []string{"FR", "BE"},
+		BlockedCountries: []string{"US"},
+		AllowedCIDRs:     []string{"203.0.113.0/24", "2001:db8::/32", "198.51.100.0/24"},
+		AllowedReferrers: []string{"example.com", "*.example.com"},
+		AllowedOrigins:   []string{"https://player.example.com", "http://localhost:3000"},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("Normalize() =\n%+v\nwant\n%+v", p, want)
+	}
+
+	for name, invalid := range map[string]Policy{
+		"country name":          {AllowedCountries: []string{"France"}},
+		"blocked country":       {BlockedCountries: []string{""}},
+		"address":               {AllowedCIDRs: []string{"203.0.113.7"}},
+		"CIDR":                  {AllowedCIDRs: []string{"203.0.113.0/33"}},
+		"referrer URL":          {AllowedReferrers: []string{"https://example.com"}},
+		"referrer with port":    {AllowedReferrers: []string{"example.com:8080"}},
+		"empty referrer":        {AllowedReferrers: []string{" "}},
+		"origin without scheme": {AllowedOrigins: []string{"example.com"}},
+		"origin with path":      {AllowedOrigins: []string{"https://example.com/player"}},
+	} {
+		if err := invalid.Normalize(); err == nil {
+			t.Errorf("Normalize() of an invalid %s succeeded", name)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	geo := testGeoIP(t)
+	france := netip.MustParseAddr("192.0.2.10")
+	us := netip.MustParseAddr("198.51.100.10")
+	unknown := netip.MustParseAddr("203.0.113.10")
+
+	tests := []struct {
+		name   string
+		policy Policy
+		req    Request
+		geo    *GeoIP
+		reason string
+	}{
+		{
+			name: "empty policy",
+			req:  Request{ClientIP: us},
+		},
+		{
+			name:   "allowed country",
+			policy: Policy{AllowedCountries: []string{"FR", "BE"}},
+			req:    Request{ClientIP: france},
+		},
+		{
+			name:   "IPv6 country",
+			policy: Policy{AllowedCountries: []string{"BE"}},
+			req:    Request{ClientIP: netip.MustParseAddr("2001:db8::42")},
+		},
+		{
+			name:   "IPv4-mapped address in an allowed country",
+			policy: Policy{AllowedCountries: []string{"FR"}},
+			req:    Request{ClientIP: netip.MustParseAddr("::ffff:192.0.2.10")},
+		},
+		{
+			name:   "country not allowed",
+			policy: Policy{AllowedCountries: []string{"FR"}},
+			req:    Request{ClientIP: us},
+			reason: ReasonCountryNotAllowed,
+		},
+		{
+			name:   "unknown country denied by an allowlist",
+			policy: Policy{AllowedCountries: []string{"FR"}},
+			req:    Request{ClientIP: unknown},
+			reason: ReasonCountryNotAllowed,
+		},
+		{
+			name:   "no address denied by an allowlist",
+			policy: Policy{AllowedCountries: []string{"FR"}},
+			reason: ReasonCountryNotAllowed,
+		},
+		{
+			name:   "no database denies an allowlist",
+			policy: Policy{AllowedCountries: []string{"FR"}},
+			req:    Request{ClientIP: france},
+			geo:    &GeoIP{},
+			reason: ReasonCountryNotAllowed,
+		},
+		{
+			name:   "blocked country",
+			policy: Policy{BlockedCountries: []string{"US"}},
+			req:    Request{ClientIP: us},
+			reason: ReasonCountryBlocked,
+		},
+		{
+			name:   "blocked IPv4-mapped address",
+			policy: Policy{BlockedCountries: []string{"US"}},
+			req:    Request{ClientIP: netip.MustParseAddr("::ffff:198.51.100.10")},
+			reason: ReasonCountryBlocked,
+		},
+		{
+			name:   "unknown country let through a blocklist",
+			policy: Policy{BlockedCountries: []string{"US"}},
+			req:    Request{ClientIP: unknown},
+		},
+		{
+			name:   "blocklist wins over the allowlist",
+			policy: Policy{AllowedCountries: []string{"US"}, BlockedCountries: []string{"US"}},
+			req:    Request{ClientIP: us},
+			reason: ReasonCountryBlocked,
+		},
+		{
+			name:   "allowed network",
+			policy: Policy{AllowedCIDRs: []string{"10.0.0.0/8", "203.0.113.0/24"}},
+			req:    Request{ClientIP: unknown},
+		},
+		{
+			name:   "IPv4-mapped address in an allowed network",
+			policy: Policy{AllowedCIDRs: []string{"203.0.113.0/24"}},
+			req:    Request{ClientIP: netip.MustParseAddr("::ffff:203.0.113.10")},
+		},
+		{
+			name:   "IPv6 network",
+			policy: Policy{AllowedCIDRs: []string{"2001:db8::/32"}},
+			req:    Request{ClientIP: netip.MustParseAddr("2001:db8::42")},
+		},
+		{
+			name:   "network not allowed",
+			policy: Policy{AllowedCIDRs: []string{"203.0.113.0/24"}},
+			req:    Request{ClientIP: us},
+			reason: ReasonNetworkNotAllowed,
+		},
+		{
+			name:   "no address denied by a network",
+			policy: Policy{AllowedCIDRs: []string{"0.0.0.0/0"}},
+			reason: ReasonNetworkNotAllowed,
+		},
+		{
+			name:   "allowed country on a network that is not allowed",
+			policy: Policy{AllowedCountries: []string{"FR"}, AllowedCIDRs: []string{"203.0.113.0/24"}},
+			req:    Request{ClientIP: france},
+			reason: ReasonNetworkNotAllowed,
+		},
+		{
+			name:   "allowed referrer",
+			policy: Policy{AllowedReferrers: []string{"example.com"}},
+			req:    Request{Referer: "https://Example.com/watch?v=1"},
+		},
+		{
+			name:   "allowed referrer subdomain",
+			policy: Policy{AllowedReferrers: []string{"*.example.com"}},
+			req:    Request{Referer: "https://blog.example.com/post"},
+		},
+		{
+			name:   "wildcard does not allow the domain itself",
+			policy: Policy{AllowedReferrers: []string{"*.example.com"}},
+			req:    Request{Referer: "https://example.com/"},
+			reason: ReasonReferrerNotAllowed,
+		},
+		{
+			name:   "lookalike referrer",
+			policy: Policy{AllowedReferrers: []string{"example.com"}},
+			req:    Request{Referer: "https://example.com.evil.test/"},
+			reason: ReasonReferrerNotAllowed,
+		},
+		{
+			name:   "missing referrer",
+			policy: Policy{AllowedReferrers: []string{"example.com"}},
+			reason: ReasonReferrerNotAllowed,
+		},
+		{
+			name:   "allowed origin",
+			policy: Policy{AllowedOrigins: []string{"https://player.example.com"}},
+			req:    Request{Origin: "https://player.example.com"},
+		},
+		{
+			name:   "allowed origin pattern",
+			policy: Policy{AllowedOrigins: []string{"https://*.example.com"}},
+			req:    Request{Origin: "https://player.example.com"},
+		},
+		{
+			name:   "origin with another scheme",
+			policy: Policy{AllowedOrigins: []string{"https://player.example.com"}},
+			req:    Request{Origin: "http://player.example.com"},
+			reason: ReasonOriginNotAllowed,
+		},
+		{
+			name:   "origin with another port",
+			policy: Policy{AllowedOrigins: []string{"https://player.example.com"}},
+			req:    Request{Origin: "https://player.example.com:8443"},
+			reason: ReasonOriginNotAllowed,
+		},
+		{
+			name:   "origin taken from the referrer",
+			policy: Policy{AllowedOrigins: []string{"https://player.example.com"}},
+			req:    Request{Origin: "null", Referer: "https://player.example.com/embed"},
+		},
+		{
+			name:   "missing origin",
+			policy: Policy{AllowedOrigins: []string{"https://player.example.com"}},
+			reason: ReasonOriginNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := geo
+			if tt.geo != nil {
+				g = tt.geo
+			}
+			err := tt.policy.Check(tt.req, g)
+
+			var denial *Denial
+			switch {
+			case tt.reason == "" && err != nil:
+				t.Errorf("Check() = %v, want nil", err)
+			case tt.reason != "" && !errors.As(err, &denial):
+				t.Errorf("Check() = %v, want a denial with reason %s", err, tt.reason)
+			case tt.reason != "" && denial.Reason != tt.reason:
+				t.Errorf("Check() reason = %s, want %s", denial.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	geo := testGeoIP(t)
+	for addr, want := range map[string]string{
+		"192.0.2.0":           "FR",
+		"192.0.2.255":         "FR",
+		"192.0.3.0":           "",
+		"198.51.100.200":      "US",
+		"::ffff:198.51.100.1": "US",
+		"2001:db8::1":         "BE",
+		"2001:db8::1:0":       "",
+		"10.0.0.1":            "",
+	} {
+		if got := geo.Country(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Country(%s) = %q, want %q", addr, got, want)
+		}
+	}
+}
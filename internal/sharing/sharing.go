@@ -0,0 +1,280 @@
+// Package sharing stores share links, which let anyone holding the link play a video for a
+// limited time and number of views, optionally behind a password. A link does not grant
+// playback itself; redeeming it counts a view and the API answers with a short-lived
+// playback token.
+package sharing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Links are stored per ID and expire from Redis with the link. Password attempts are
+// counted in windows of AttemptWindow:
+//
+//	better-media:share:[linkId]           hash    video_id, tenant_id, expires_at, max_views, views, password
+//	better-media:share:[linkId]:failures  string  wrong passwords given for the link
+//	better-media:share-attempts:[ip]      string  passwords an address tried, on any link
+
+var (
+	// ErrLinkNotFound is returned for unknown and expired links alike
+	ErrLinkNotFound     = errors.New("share link not found")
+	ErrWrongPassword    = errors.New("wrong share link password")
+	ErrViewLimitReached = errors.New("share link has no views left")
+	// ErrTooManyAttempts is returned without checking the password once the link or the
+	// address has had its share of attempts for the window
+	ErrTooManyAttempts = errors.New("too many share link password attempts")
+)
+
+const (
+	// passwordIterations is the PBKDF2-SHA256 work factor of link passwords
+	passwordIterations = 100_000
+
+	// A link takes maxLinkFailures wrong passwords per AttemptWindow, from all viewers,
+	// and an address can try maxAddressAttempts passwords per window, on any link. The
+	// first keeps passwords from being guessed, the second keeps a single client from
+	// spending the API's CPU on PBKDF2.
+	AttemptWindow      = 15 * time.Minute
+	maxLinkFailures    = 10
+	maxAddressAttempts = 30
+)
+
+type Link struct {
+	ID        string    `json:"id"`
+	VideoID   string    `json:"video_id"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// MaxViews is how many times the link can be redeemed, 0 means no limit
+	MaxViews int `json:"max_views,omitempty"`
+	Views    int `json:"views"`
+	// Protected is true when redeeming the link needs a password
+	Protected bool `json:"password_protected"`
+
+	password string
+}
+
+type Store struct {
+	rdb *redis.Client
+}
+
+func NewStore(rdb *redis.Client) *Store {
+	return &Store{rdb: rdb}
+}
+
+func linkKey(linkID string) string {
+	return "better-media:share:" + linkID
+}
+
+func failuresKey(linkID string) string {
+	return linkKey(linkID) + ":failures"
+}
+
+func attemptsKey(clientIP string) string {
+	return "better-media:share-attempts:" + clientIP
+}
+
+// Create stores a new link to a video valid for ttl. An empty password leaves it open to
+// anyone who has it.
+func (s *Store) Create(ctx context.Context, videoID, tenantID string, ttl time.Duration, maxViews int, password string) (*Link, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	link := &Link{
+		ID:        base64.RawURLEncoding.EncodeToString(id),
+		VideoID:   videoID,
+		TenantID:  tenantID,
+		ExpiresAt: time.Now().Add(ttl).Truncate(time.Millisecond),
+		MaxViews:  maxViews,
+		Protected: password != "",
+	}
+	if password != "" {
+		var err error
+		if link.password, err = hashPassword(password); err != nil {
+			return nil, err
+		}
+	}
+
+	key := linkKey(link.ID)
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, key,
+		"video_id", link.VideoID,
+		"tenant_id", link.TenantID,
+		"expires_at", link.ExpiresAt.UnixMilli(),
+		"max_views", link.MaxViews,
+		"views", 0,
+		"password", link.password,
+	)
+	pipe.PExpireAt(ctx, key, link.ExpiresAt)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func (s *Store) Get(ctx context.Context, linkID string) (*Link, error) {
+	fields, err := s.rdb.HGetAll(ctx, linkKey(linkID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrLinkNotFound
+	}
+
+	link := &Link{
+		ID:       linkID,
+		VideoID:  fields["video_id"],
+		TenantID: fields["tenant_id"],
+		password: fields["password"],
+	}
+	expiresAt, _ := strconv.ParseInt(fields["expires_at"], 10, 64)
+	link.ExpiresAt = time.UnixMilli(expiresAt)
+	link.MaxViews, _ = strconv.Atoi(fields["max_views"])
+	link.Views, _ = strconv.Atoi(fields["views"])
+	link.Protected = link.password != ""
+
+	// Redis expires keys lazily on access, but a replica can still return them
+	if !time.Now().Before(link.ExpiresAt) {
+		return nil, ErrLinkNotFound
+	}
+	return link, nil
+}
+
+// Delete revokes a link, it reports whether there was one
+func (s *Store) Delete(ctx context.Context, linkID string) (bool, error) {
+	n, err := s.rdb.Del(ctx, linkKey(linkID), failuresKey(linkID)).Result()
+	return n > 0, err
+}
+
+// countViewScript counts a view while the link has some left. It returns -1 for a missing
+// link, 0 when the limit is reached and the new view count otherwise.
+var countViewScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+local max = tonumber(redis.call('HGET', KEYS[1], 'max_views'))
+local views = tonumber(redis.call('HGET', KEYS[1], 'views'))
+if max > 0 and views >= max then
+	return 0
+end
+return redis.call('HINCRBY', KEYS[1], 'views', 1)
+`)
+
+// allowAttemptScript counts a password attempt of an address and tells whether the
+// password may be checked: 1 if so, 0 once the link or the address is out of attempts.
+// Counters start their window on the first attempt.
+var allowAttemptScript = redis.NewScript(`
+local failures = tonumber(redis.call('GET', KEYS[1]) or '0')
+if failures >= tonumber(ARGV[1]) then
+	return 0
+end
+local attempts = redis.call('INCR', KEYS[2])
+if attempts == 1 then
+	redis.call('PEXPIRE', KEYS[2], ARGV[3])
+end
+if attempts > tonumber(ARGV[2]) then
+	return 0
+end
+return 1
+`)
+
+// countFailureScript counts a wrong password for a link
+var countFailureScript = redis.NewScript(`
+local failures = redis.call('INCR', KEYS[1])
+if failures == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return failures
+`)
+
+// checkLinkPassword checks the password of a protected link, counting the attempt
+// against the link and the address it comes from
+func (s *Store) checkLinkPassword(ctx context.Context, link *Link, password, clientIP string) error {
+	window := AttemptWindow.Milliseconds()
+	allowed, err := allowAttemptScript.Run(ctx, s.rdb, []string{failuresKey(link.ID), attemptsKey(clientIP)},
+		maxLinkFailures, maxAddressAttempts, window).Bool()
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrTooManyAttempts
+	}
+
+	if checkPassword(link.password, password) {
+		return nil
+	}
+	if err := countFailureScript.Run(ctx, s.rdb, []string{failuresKey(link.ID)}, window).Err(); err != nil {
+		return err
+	}
+	return ErrWrongPassword
+}
+
+// Redeem checks the password of a link and counts a view. The view limit holds even when
+// the link is redeemed concurrently. clientIP is the address of the viewer, which
+// password attempts are limited for.
+func (s *Store) Redeem(ctx context.Context, linkID, password, clientIP string) (*Link, error) {
+	link, err := s.Get(ctx, linkID)
+	if err != nil {
+		return nil, err
+	}
+	if link.Protected {
+		if err := s.checkLinkPassword(ctx, link, password, clientIP); err != nil {
+			return nil, err
+		}
+	}
+
+	views, err := countViewScript.Run(ctx, s.rdb, []string{linkKey(linkID)}).Int()
+	if err != nil {
+		return nil, err
+	}
+	switch views {
+	case -1:
+		return nil, ErrLinkNotFound
+	case 0:
+		return nil, ErrViewLimitReached
+	}
+	link.Views = views
+	return link, nil
+}
+
+// hashPassword returns hex salt and PBKDF2 hash separated by a $
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt) + "$" + hex.EncodeToString(hash), nil
+}
+
+func checkPassword(stored, password string) bool {
+	saltHex, hashHex, ok := strings.Cut(stored, "$")
+	if !ok {
+		return false
+	}
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return false
+	}
+	want, err := hex.DecodeString(hashHex)
+	if err != nil {
+		return false
+	}
+	hash, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, sha256.Size)
+	return err == nil && hmac.Equal(hash, want)
+}
@@ -0,0 +1,237 @@
+package sharing
+
+import (
+	"better-media/internal/config"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testStore connects to the Redis at REDIS_ADDR, the test is skipped without one
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: config.String("REDIS_ADDR", "127.0.0.1:6379")})
+	t.Cleanup(func() { rdb.Close() })
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("Redis is not available: %v", err)
+	}
+	return NewStore(rdb)
+}
+
+func createLink(t *testing.T, s *Store, ttl time.Duration, maxViews int, password string) *Link {
+	t.Helper()
+	link, err := s.Create(context.Background(), "vid1", "tenant1", ttl, maxViews, password)
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	t.Cleanup(func() {
+		s.rdb.Del(context.Background(), linkKey(link.ID), failuresKey(link.ID))
+	})
+	return link
+}
+
+// testAddress is a client address of its own for each test, whose attempts are removed
+func testAddress(t *testing.T, s *Store) string {
+	t.Helper()
+	addr := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	t.Cleanup(func() { s.rdb.Del(context.Background(), attemptsKey(addr)) })
+	return addr
+}
+
+func TestPassword(t *testing.T) {
+	stored, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := hashPassword("correct horse")
+	if stored == again {
+		t.Error("hashPassword() is not salted")
+	}
+
+	tests := []struct {
+		stored   string
+		password string
+		want     bool
+	}{
+		{stored, "correct horse", true},
+		{stored, "correct horse ", false},
+		{stored, "", false},
+		{"", "", false},
+		{"not-a-hash", "correct horse", false},
+		{"zz$00", "correct horse", false},
+	}
+	for _, tt := range tests {
+		if got := checkPassword(tt.stored, tt.password); got != tt.want {
+			t.Errorf("checkPassword(%q, %q) = %t, want %t", tt.stored, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestRedeem(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		maxViews int
+		password string
+		// attempts are the passwords given and the error each redemption should get
+		attempts []string
+		want     []error
+	}{
+		{
+			name:     "unlimited",
+			attempts: []string{"", "", "ignored"},
+			want:     []error{nil, nil, nil},
+		},
+		{
+			name:     "view limit",
+			maxViews: 2,
+			attempts: []string{"", "", ""},
+			want:     []error{nil, nil, ErrViewLimitReached},
+		},
+		{
+			name:     "password",
+			maxViews: 1,
+			password: "correct horse",
+			attempts: []string{"", "battery staple", "correct horse", "correct horse"},
+			want:     []error{ErrWrongPassword, ErrWrongPassword, nil, ErrViewLimitReached},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link := createLink(t, s, time.Minute, tt.maxViews, tt.password)
+			addr := testAddress(t, s)
+
+			views := 0
+			for i, password := range tt.attempts {
+				redeemed, err := s.Redeem(ctx, link.ID, password, addr)
+				if !errors.Is(err, tt.want[i]) {
+					t.Fatalf("Redeem() #%d = %v, want %v", i+1, err, tt.want[i])
+				}
+				if err == nil {
+					views++
+					if redeemed.Views != views || redeemed.VideoID != "vid1" {
+						t.Errorf("Redeem() #%d = %+v, want view %d of vid1", i+1, redeemed, views)
+					}
+				}
+			}
+
+			got, err := s.Get(ctx, link.ID)
+			if err != nil {
+				t.Fatalf("Get() = %v", err)
+			}
+			if got.Views != views {
+				t.Errorf("Views = %d, want %d", got.Views, views)
+			}
+		})
+	}
+}
+
+func TestRedeemConcurrentViewLimit(t *testing.T) {
+	s := testStore(t)
+	link := createLink(t, s, time.Minute, 3, "")
+	addr := testAddress(t, s)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	redeemed := 0
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Redeem(context.Background(), link.ID, "", addr); err == nil {
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if redeemed != 3 {
+		t.Errorf("redeemed %d times, want 3", redeemed)
+	}
+}
+
+func TestRedeemExpired(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	link := createLink(t, s, 50*time.Millisecond, 0, "")
+	addr := testAddress(t, s)
+
+	if _, err := s.Redeem(ctx, link.ID, "", addr); err != nil {
+		t.Fatalf("Redeem() = %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := s.Redeem(ctx, link.ID, "", addr); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("Redeem() of an expired link = %v, want ErrLinkNotFound", err)
+	}
+	if _, err := s.Get(ctx, link.ID); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("Get() of an expired link = %v, want ErrLinkNotFound", err)
+	}
+
+	if _, err := s.Redeem(ctx, "unknown", "", addr); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("Redeem() of an unknown link = %v, want ErrLinkNotFound", err)
+	}
+
+	deleted := createLink(t, s, time.Minute, 0, "")
+	if ok, err := s.Delete(ctx, deleted.ID); err != nil || !ok {
+		t.Fatalf("Delete() = %t, %v", ok, err)
+	}
+	if _, err := s.Redeem(ctx, deleted.ID, "", addr); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("Redeem() of a deleted link = %v, want ErrLinkNotFound", err)
+	}
+}
+
+func TestRedeemAttemptLimits(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+
+	t.Run("per link", func(t *testing.T) {
+		link := createLink(t, s, time.Minute, 0, "correct horse")
+		for i := range maxLinkFailures {
+			// Every guess comes from another address
+			if _, err := s.Redeem(ctx, link.ID, "guess", testAddress(t, s)); !errors.Is(err, ErrWrongPassword) {
+				t.Fatalf("Redeem() #%d = %v, want ErrWrongPassword", i+1, err)
+			}
+		}
+		if _, err := s.Redeem(ctx, link.ID, "correct horse", testAddress(t, s)); !errors.Is(err, ErrTooManyAttempts) {
+			t.Errorf("Redeem() after %d failures = %v, want ErrTooManyAttempts", maxLinkFailures, err)
+		}
+	})
+
+	t.Run("per address", func(t *testing.T) {
+		addr := testAddress(t, s)
+		for i := range maxAddressAttempts {
+			// Every guess goes to another link
+			link := createLink(t, s, time.Minute, 0, "correct horse")
+			if _, err := s.Redeem(ctx, link.ID, "guess", addr); !errors.Is(err, ErrWrongPassword) {
+				t.Fatalf("Redeem() #%d = %v, want ErrWrongPassword", i+1, err)
+			}
+		}
+		link := createLink(t, s, time.Minute, 0, "correct horse")
+		if _, err := s.Redeem(ctx, link.ID, "correct horse", addr); !errors.Is(err, ErrTooManyAttempts) {
+			t.Errorf("Redeem() after %d attempts = %v, want ErrTooManyAttempts", maxAddressAttempts, err)
+		}
+		if _, err := s.Redeem(ctx, link.ID, "correct horse", testAddress(t, s)); err != nil {
+			t.Errorf("Redeem() from another address = %v", err)
+		}
+	})
+
+	t.Run("open links are not limited", func(t *testing.T) {
+		addr := testAddress(t, s)
+		link := createLink(t, s, time.Minute, 0, "")
+		for i := range maxAddressAttempts + 5 {
+			if _, err := s.Redeem(ctx, link.ID, "", addr); err != nil {
+				t.Fatalf("Redeem() #%d = %v", i+1, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ObjectReader reads an object with ranged GETs, so it can be seeked without downloading
+// what is skipped, e.g. by http.ServeContent to answer Range requests.
+type ObjectReader struct {
+	ctx    context.Context
+	s      *S3Client
+	object Object
+	offset int64
+	body   io.ReadCloser
+}
+
+// NewObjectReader reads the object described by object, as returned by StatObject. Reads
+// fail if the object changes in between, rather than mixing two versions.
+func (s *S3Client) NewObjectReader(ctx context.Context, object Object) *ObjectReader {
+	return &ObjectReader{ctx: ctx, s: s, object: object}
+}
+
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.object.Size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(r.s.BucketName),
+			Key:    aws.String(r.object.Key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", r.offset)),
+		}
+		if r.object.ETag != "" {
+			input.IfMatch = aws.String(r.object.ETag)
+		}
+		output, err := r.s.Client.GetObject(r.ctx, input)
+		if err != nil {
+			return 0, err
+		}
+		r.body = output.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	var next int64
+	switch whence {
+	case io.SeekStart:
+		next = offset
+	case io.SeekCurrent:
+		next = r.offset + offset
+	case io.SeekEnd:
+		next = r.object.Size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if next < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if next != r.offset {
+		r.Close()
+		r.offset = next
+	}
+	return next, nil
+}
+
+func (r *ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -1,19 +1,28 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type S3Client struct {
@@ -77,15 +86,47 @@ func (s *S3Client) UploadFile(ctx context.Context, localPath, objectKey string)
 	}
 	defer file.Close()
 
-	_, err = s.Uploader.Upload(ctx, &s3.PutObjectInput{
+	input := &s3.PutObjectInput{
 		Bucket: aws.String(s.BucketName),
 		Key:    aws.String(objectKey),
 		Body:   file,
-	})
+	}
+	if headers, ok := hlsObjectHeaders[path.Ext(objectKey)]; ok {
+		input.ContentType = aws.String(headers.contentType)
+		input.CacheControl = aws.String(headers.cacheControl)
+	}
+
+	_, err = s.Uploader.Upload(ctx, input)
+
+	return err
+}
 
+// PutObject stores a small object held in memory
+func (s *S3Client) PutObject(ctx context.Context, objectKey string, body []byte, contentType string) error {
+	_, err := s.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.BucketName),
+		Key:         aws.String(objectKey),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
 	return err
 }
 
+// hlsObjectHeaders are stored with uploaded HLS output, for a CDN in front of the bucket.
+// Segments never change once written (a re-encode is told apart by the version the proxy
+// adds to CDN URLs), so they are cached for a year. Playlists are rewritten while a job
+// runs and are served by the API anyway.
+var hlsObjectHeaders = map[string]struct{ contentType, cacheControl string }{
+	".ts":   {"video/mp2t", immutableCacheControl},
+	".m4s":  {"video/iso.segment", immutableCacheControl},
+	".mp4":  {"video/mp4", immutableCacheControl},
+	".aac":  {"audio/aac", immutableCacheControl},
+	".vtt":  {"text/vtt", immutableCacheControl},
+	".m3u8": {"application/vnd.apple.mpegurl", "no-cache"},
+}
+
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
 func (s *S3Client) GeneratePresignedPut(ctx context.Context, objectKey string, validDuration time.Duration) (*v4.PresignedHTTPRequest, error) {
 	presignClient := s3.NewPresignClient(s.Client)
 	presignResult, err := presignClient.PresignPutObject(ctx, &s3.PutObjectInput{
@@ -127,3 +168,194 @@ func (s *S3Client) GetObject(ctx context.Context, key string) (io.ReadCloser, er
 	}
 	return output.Body, nil
 }
+
+// ErrNotModified is returned by GetObjectIfChanged when the object still has the given ETag
+var ErrNotModified = errors.New("object not modified")
+
+// GetObjectIfChanged gets an object and its ETag, unless etag is not empty and still
+// matches, in which case it returns ErrNotModified without transferring the object.
+func (s *S3Client) GetObjectIfChanged(ctx context.Context, key, etag string) (io.ReadCloser, string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+	}
+	if etag != "" {
+		input.IfNoneMatch = aws.String(etag)
+	}
+
+	output, err := s.Client.GetObject(ctx, input)
+	if err != nil {
+		var responseErr *awshttp.ResponseError
+		if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusNotModified {
+			return nil, etag, ErrNotModified
+		}
+		return nil, "", err
+	}
+	return output.Body, aws.ToString(output.ETag), nil
+}
+
+func (s *S3Client) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.BucketName),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+
+	return keys, nil
+}
+
+// SHA256 hashes an object as it streams from the bucket, without storing it locally
+func (s *S3Client) SHA256(ctx context.Context, key string) (string, error) {
+	body, err := s.GetObject(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// CopyPrefix copies every object under srcPrefix to dstPrefix within the bucket, server
+// side, and returns the keys it created.
+func (s *S3Client) CopyPrefix(ctx context.Context, srcPrefix, dstPrefix string) ([]string, error) {
+	keys, err := s.ListObjects(ctx, srcPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var copied []string
+	for _, key := range keys {
+		dstKey := dstPrefix + strings.TrimPrefix(key, srcPrefix)
+		_, err := s.Client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(s.BucketName),
+			CopySource: aws.String(copySource(s.BucketName, key)),
+			Key:        aws.String(dstKey),
+		})
+		if err != nil {
+			return copied, fmt.Errorf("failed to copy %s: %w", key, err)
+		}
+		copied = append(copied, dstKey)
+	}
+	return copied, nil
+}
+
+// copySource URL encodes bucket/key, as CopyObject expects
+func copySource(bucket, key string) string {
+	segments := strings.Split(bucket+"/"+key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+// WalkObjects calls fn for every object under prefix, a page at a time, so a whole bucket
+// can be scanned without holding every key in memory.
+func (s *S3Client) WalkObjects(ctx context.Context, prefix string, fn func(Object) error) error {
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.BucketName),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			err := fn(Object{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+				ETag:         aws.ToString(obj.ETag),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *S3Client) DeletePrefix(ctx context.Context, prefix string) error {
+	keys, err := s.ListObjects(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	// DeleteObjects accepts at most 1000 keys per request
+	for start := 0; start < len(keys); start += 1000 {
+		end := min(start+1000, len(keys))
+
+		objects := make([]types.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		_, err := s.Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.BucketName),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *S3Client) ObjectSize(ctx context.Context, key string) (int64, error) {
+	output, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return aws.ToInt64(output.ContentLength), nil
+}
+
+// StatObject returns the size, modification time and ETag of an object
+func (s *S3Client) StatObject(ctx context.Context, key string) (Object, error) {
+	output, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{
+		Key:          key,
+		Size:         aws.ToInt64(output.ContentLength),
+		LastModified: aws.ToTime(output.LastModified),
+		ETag:         aws.ToString(output.ETag),
+	}, nil
+}
+
+// IsNotFound reports whether err is S3 telling that the object or key does not exist.
+func IsNotFound(err error) bool {
+	var notFound *types.NotFound
+	var noSuchKey *types.NoSuchKey
+	return errors.As(err, &notFound) || errors.As(err, &noSuchKey)
+}
@@ -0,0 +1,131 @@
+package webhooks
+
+import (
+	"better-media/pkg/models"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+type Deliverer struct {
+	store      *Store
+	httpClient *http.Client
+	// jobSecret signs deliveries to per job webhook_urls, which have no endpoint secret.
+	// Without it those deliveries are dropped rather than sent unsigned.
+	jobSecret string
+}
+
+func NewDeliverer(rdb *redis.Client, jobSecret string) *Deliverer {
+	if jobSecret == "" {
+		log.Println("WARN WEBHOOK_SECRET is not set, per job webhooks will not be delivered")
+	}
+	return &Deliverer{
+		store:      NewStore(rdb),
+		httpClient: &http.Client{Timeout: 15 * time.Second},
+		jobSecret:  jobSecret,
+	}
+}
+
+// RetryDelay backs off exponentially from 10s up to an hour between attempts, with jitter
+// so that many deliveries to the same recovering endpoint do not arrive at once.
+func RetryDelay(n int) time.Duration {
+	delay := 10 * time.Second << min(n, 12)
+	delay = min(delay, time.Hour)
+	return delay + rand.N(delay/5+1)
+}
+
+func (d *Deliverer) HandleDeliverWebhookTask(ctx context.Context, t *asynq.Task) error {
+	var payload models.WebhookDeliveryPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+
+	var event Event
+	if err := json.Unmarshal(payload.Event, &event); err != nil {
+		return fmt.Errorf("invalid event: %w: %w", err, asynq.SkipRetry)
+	}
+
+	secret := d.jobSecret
+	if payload.EndpointID != "" {
+		endpoint, err := d.store.GetEndpoint(ctx, payload.TenantID, payload.EndpointID)
+		if errors.Is(err, ErrEndpointNotFound) {
+			log.Printf("Dropping delivery %s, endpoint %s was deleted", payload.DeliveryID, payload.EndpointID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		secret = endpoint.Secret
+	}
+
+	retried, _ := asynq.GetRetryCount(ctx)
+	delivery := Delivery{
+		DeliveryID: payload.DeliveryID,
+		EventID:    event.ID,
+		EventType:  event.Type,
+		JobID:      event.JobID,
+		EndpointID: payload.EndpointID,
+		URL:        payload.URL,
+		Attempt:    retried + 1,
+		At:         time.Now().UTC(),
+	}
+
+	var statusCode int
+	var err error
+	if secret == "" {
+		err = fmt.Errorf("WEBHOOK_SECRET is not set, refusing to deliver an unsigned event: %w", asynq.SkipRetry)
+	} else {
+		statusCode, err = d.post(ctx, payload, event.Type, secret)
+	}
+	delivery.StatusCode = statusCode
+	delivery.Duration = time.Since(delivery.At).Milliseconds()
+	delivery.Succeeded = err == nil
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	if recordErr := d.store.RecordDelivery(ctx, payload.TenantID, delivery); recordErr != nil {
+		log.Printf("WARN failed to record delivery %s: %v", payload.DeliveryID, recordErr)
+	}
+
+	if err != nil {
+		log.Printf("Webhook %s to %s failed (attempt %d): %v", event.Type, payload.URL, delivery.Attempt, err)
+		return err
+	}
+	return nil
+}
+
+func (d *Deliverer) post(ctx context.Context, payload models.WebhookDeliveryPayload, eventType, secret string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, payload.URL, bytes.NewReader(payload.Event))
+	if err != nil {
+		return 0, fmt.Errorf("invalid webhook url: %w: %w", err, asynq.SkipRetry)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "better-media-webhooks/1")
+	req.Header.Set(HeaderEvent, eventType)
+	req.Header.Set(HeaderDelivery, payload.DeliveryID)
+	req.Header.Set(HeaderSignature, Sign(secret, time.Now(), payload.Event))
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,59 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const (
+	EventJobQueued      = "job.queued"
+	EventJobStarted     = "job.started"
+	EventRenditionReady = "rendition.ready"
+	EventJobCompleted   = "job.completed"
+	EventJobFailed      = "job.failed"
+)
+
+var EventTypes = []string{EventJobQueued, EventJobStarted, EventRenditionReady, EventJobCompleted, EventJobFailed}
+
+// Event is the JSON body POSTed to webhook endpoints.
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	TenantID  string    `json:"tenant_id"`
+	JobID     string    `json:"job_id"`
+	VideoID   string    `json:"video_id"`
+	Data      EventData `json:"data"`
+}
+
+type EventData struct {
+	Rendition   *Rendition  `json:"rendition,omitempty"`
+	Renditions  []Rendition `json:"renditions,omitempty"`
+	PlaybackURL string      `json:"playback_url,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+type Rendition struct {
+	Height    int    `json:"height"`
+	Bandwidth int    `json:"bandwidth"`
+	Playlist  string `json:"playlist"`
+}
+
+// Every delivery carries these headers. The signature is an HMAC-SHA256 over
+// "[timestamp].[body]" with the endpoint secret, hex encoded: "t=[timestamp],v1=[hmac]".
+// Receivers should recompute it and reject timestamps older than a few minutes.
+const (
+	HeaderSignature = "X-BetterMedia-Signature"
+	HeaderEvent     = "X-BetterMedia-Event"
+	HeaderDelivery  = "X-BetterMedia-Delivery"
+)
+
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp.Unix())
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp.Unix(), hex.EncodeToString(mac.Sum(nil)))
+}
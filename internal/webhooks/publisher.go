@@ -0,0 +1,109 @@
+package webhooks
+
+import (
+	"better-media/internal/jobs"
+	"better-media/pkg/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// DeliveryMaxRetry gives an endpoint that is down a day to come back: RetryDelay spends
+// about 1.5h on the first 9 retries and an hour on each one after that.
+const DeliveryMaxRetry = 32
+
+// Publisher turns job lifecycle changes into one delivery task per interested endpoint.
+// Deliveries run in their own asynq tasks, so a slow or failing endpoint never holds up
+// encoding.
+type Publisher struct {
+	store         *Store
+	jobs          *jobs.Graph
+	client        *asynq.Client
+	publicBaseURL string
+}
+
+func NewPublisher(rdb *redis.Client, client *asynq.Client, publicBaseURL string) *Publisher {
+	return &Publisher{
+		store:         NewStore(rdb),
+		jobs:          jobs.NewGraph(rdb),
+		client:        client,
+		publicBaseURL: publicBaseURL,
+	}
+}
+
+func (p *Publisher) PlaybackURL(videoID string) string {
+	return fmt.Sprintf("%s/v1/videos/%s/playback/hls/master.m3u8", p.publicBaseURL, videoID)
+}
+
+// Publish sends an event about a job to the job's webhook_url and the tenant's endpoints.
+// Notifications are best effort from the caller's point of view: failures are logged and
+// never fail the job itself.
+func (p *Publisher) Publish(ctx context.Context, jobID, eventType string, data EventData) {
+	if err := p.publish(ctx, jobID, eventType, data); err != nil {
+		log.Printf("[%s] WARN failed to publish %s: %v", jobID, eventType, err)
+	}
+}
+
+func (p *Publisher) publish(ctx context.Context, jobID, eventType string, data EventData) error {
+	job, err := p.jobs.Get(ctx, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to read job: %w", err)
+	}
+
+	event := Event{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		TenantID:  job.TenantID,
+		JobID:     jobID,
+		VideoID:   job.VideoID,
+		Data:      data,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	var deliveries []models.WebhookDeliveryPayload
+	if job.WebhookURL != "" {
+		deliveries = append(deliveries, models.WebhookDeliveryPayload{URL: job.WebhookURL})
+	}
+
+	endpoints, err := p.store.ListEndpoints(ctx, job.TenantID)
+	if err != nil {
+		return fmt.Errorf("failed to list endpoints: %w", err)
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Wants(eventType) {
+			deliveries = append(deliveries, models.WebhookDeliveryPayload{EndpointID: endpoint.ID, URL: endpoint.URL})
+		}
+	}
+
+	for _, delivery := range deliveries {
+		delivery.DeliveryID = uuid.New().String()
+		delivery.TenantID = job.TenantID
+		delivery.Event = body
+
+		task, err := models.NewWebhookDeliveryTask(delivery)
+		if err != nil {
+			return err
+		}
+		// Deliveries are small and time sensitive, keep them out of the encoding backlog
+		_, err = p.client.EnqueueContext(ctx, task,
+			asynq.Queue(models.QueueCritical),
+			asynq.MaxRetry(DeliveryMaxRetry),
+			asynq.TaskID("webhook:"+delivery.DeliveryID),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to enqueue delivery to %s: %w", delivery.URL, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Endpoints registered by a tenant, and the log of every delivery attempt:
+//
+//	better-media:webhooks:[tenant]             hash  endpoint id -> Endpoint JSON
+//	better-media:webhooks:[tenant]:deliveries  list  Delivery JSON, newest first
+
+const maxDeliveryLog = 1000
+
+var ErrEndpointNotFound = errors.New("webhook endpoint not found")
+
+type Endpoint struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Wants reports whether the endpoint subscribed to the event type. No filter means all.
+func (e Endpoint) Wants(eventType string) bool {
+	return len(e.Events) == 0 || slices.Contains(e.Events, eventType)
+}
+
+type Delivery struct {
+	DeliveryID string    `json:"delivery_id"`
+	EventID    string    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	JobID      string    `json:"job_id"`
+	EndpointID string    `json:"endpoint_id,omitempty"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Succeeded  bool      `json:"succeeded"`
+	Duration   int64     `json:"duration_ms"`
+	At         time.Time `json:"at"`
+}
+
+type Store struct {
+	rdb *redis.Client
+}
+
+func NewStore(rdb *redis.Client) *Store {
+	return &Store{rdb: rdb}
+}
+
+func endpointsKey(tenantID string) string {
+	return "better-media:webhooks:" + tenantID
+}
+
+func deliveriesKey(tenantID string) string {
+	return endpointsKey(tenantID) + ":deliveries"
+}
+
+// CreateEndpoint registers an endpoint with a freshly generated signing secret. The
+// returned endpoint is the only place the secret is shown.
+func (s *Store) CreateEndpoint(ctx context.Context, tenantID, url string, events []string) (*Endpoint, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	endpoint := &Endpoint{
+		ID:        uuid.New().String(),
+		URL:       url,
+		Secret:    "whsec_" + hex.EncodeToString(secret),
+		Events:    events,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	data, err := json.Marshal(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rdb.HSet(ctx, endpointsKey(tenantID), endpoint.ID, data).Err(); err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func (s *Store) GetEndpoint(ctx context.Context, tenantID, endpointID string) (*Endpoint, error) {
+	data, err := s.rdb.HGet(ctx, endpointsKey(tenantID), endpointID).Bytes()
+	if err == redis.Nil {
+		return nil, ErrEndpointNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoint Endpoint
+	if err := json.Unmarshal(data, &endpoint); err != nil {
+		return nil, err
+	}
+	return &endpoint, nil
+}
+
+func (s *Store) ListEndpoints(ctx context.Context, tenantID string) ([]Endpoint, error) {
+	entries, err := s.rdb.HGetAll(ctx, endpointsKey(tenantID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]Endpoint, 0, len(entries))
+	for _, data := range entries {
+		var endpoint Endpoint
+		if err := json.Unmarshal([]byte(data), &endpoint); err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	slices.SortFunc(endpoints, func(a, b Endpoint) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return endpoints, nil
+}
+
+func (s *Store) DeleteEndpoint(ctx context.Context, tenantID, endpointID string) error {
+	n, err := s.rdb.HDel(ctx, endpointsKey(tenantID), endpointID).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrEndpointNotFound
+	}
+	return nil
+}
+
+func (s *Store) RecordDelivery(ctx context.Context, tenantID string, delivery Delivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	pipe := s.rdb.TxPipeline()
+	pipe.LPush(ctx, deliveriesKey(tenantID), data)
+	pipe.LTrim(ctx, deliveriesKey(tenantID), 0, maxDeliveryLog-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// ListDeliveries returns the most recent delivery attempts, newest first.
+func (s *Store) ListDeliveries(ctx context.Context, tenantID string, limit int) ([]Delivery, error) {
+	entries, err := s.rdb.LRange(ctx, deliveriesKey(tenantID), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]Delivery, 0, len(entries))
+	for _, data := range entries {
+		var delivery Delivery
+		if err := json.Unmarshal([]byte(data), &delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
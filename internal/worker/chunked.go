@@ -0,0 +1,642 @@
+package worker
+
+import (
+	"better-media/internal/jobs"
+	"better-media/internal/storage"
+	"better-media/internal/webhooks"
+	"better-media/pkg/models"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hibiken/asynq"
+)
+
+// Chunked encoding splits a long source into GOP aligned chunks so that the expensive video
+// encode can be spread across every worker listening on the queue:
+//
+//	split (1 task)  ->  encode_chunk (1 task per chunk)  ->  stitch (1 task)
+//
+// Intermediates live under [videoId]/chunks/ and are removed once the stitch succeeds.
+// Progress is tracked in jobs.Graph with one node per chunk.
+// Audio is encoded once from the full source during the split, so AAC priming does not
+// introduce gaps at chunk boundaries.
+
+func chunkSourceKey(videoID string, index int) string {
+	return filepath.Join(videoID, "chunks", "source", fmt.Sprintf("chunk%04d.mkv", index))
+}
+
+func chunkRenditionKey(videoID string, height, index int) string {
+	return filepath.Join(videoID, "chunks", fmt.Sprintf("%dp", height), fmt.Sprintf("chunk%04d.mp4", index))
+}
+
+func chunkAudioKey(videoID, bitrate string) string {
+	return filepath.Join(videoID, "chunks", "audio", bitrate+".m4a")
+}
+
+// hlsSegmentSeconds is the target duration of stitched HLS segments
+const hlsSegmentSeconds = 4
+
+func chunkNode(index int) string {
+	return fmt.Sprintf("chunk%04d", index)
+}
+
+func runFFmpeg(ctx context.Context, args []string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w\n--- FFmpeg output ---\n%s", err, stderr.String())
+	}
+	return nil
+}
+
+func (processor *TaskProcessor) HandleSplitVideoTask(ctx context.Context, t *asynq.Task) error {
+	var payload models.VideoEncodingPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+	log.Printf("[%s] Splitting source into %ds chunks", payload.VideoID, payload.ChunkDuration)
+
+	if err := processor.beginJob(ctx, payload, "split"); err != nil {
+		return err
+	}
+
+	reused, err := processor.reuseEncode(ctx, t, payload, "split")
+	if err != nil {
+		return processor.failJobNode(ctx, payload.JobID, "split", err)
+	}
+	if reused {
+		return nil
+	}
+
+	err = processor.withVideoLock(ctx, payload.JobID, payload.VideoID, func(ctx context.Context) error {
+		return processor.splitAndFanOut(ctx, t, payload)
+	})
+	if err != nil {
+		return processor.failJobNode(ctx, payload.JobID, "split", err)
+	}
+	return nil
+}
+
+func (processor *TaskProcessor) splitAndFanOut(ctx context.Context, t *asynq.Task, payload models.VideoEncodingPayload) error {
+	pipeline, err := NewEncodingPipeline(payload, processor.Resources)
+	if err != nil {
+		return err
+	}
+	defer pipeline.Cleanup()
+
+	if err := pipeline.Download(ctx, processor.S3Client); err != nil {
+		return fmt.Errorf("failed to download file: %w", err)
+	}
+	if err := pipeline.Probe(); err != nil {
+		return fmt.Errorf("failed to probe file: %w", err)
+	}
+
+	renditions, err := pipeline.RenditionHeights()
+	if err != nil {
+		return err
+	}
+
+	chunkDir := filepath.Join(pipeline.TempDir, "chunks")
+	if err := os.MkdirAll(chunkDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create chunk dir: %w", err)
+	}
+
+	// Stream copy only cuts on keyframes, so every chunk starts with a decodable GOP.
+	// The cuts fall wherever those keyframes are, the list records where each chunk starts.
+	listPath := filepath.Join(chunkDir, "chunks.csv")
+	args := []string{
+		"-hide_banner", "-y",
+		"-i", pipeline.DownloadedFilePath,
+		"-map", "0:v:0",
+		"-c", "copy",
+		"-f", "segment",
+		"-segment_time", fmt.Sprint(payload.ChunkDuration),
+		"-reset_timestamps", "1",
+		"-segment_list", listPath,
+		"-segment_list_type", "csv",
+		filepath.Join(chunkDir, "chunk%04d.mkv"),
+	}
+	done := pipeline.track("split")
+	if err := runFFmpeg(ctx, args); err != nil {
+		return fmt.Errorf("ffmpeg failed to split source: %w", err)
+	}
+	done()
+
+	chunkFiles, err := filepath.Glob(filepath.Join(chunkDir, "chunk*.mkv"))
+	if err != nil {
+		return err
+	}
+	if len(chunkFiles) == 0 {
+		return fmt.Errorf("splitting produced no chunks")
+	}
+	sort.Strings(chunkFiles)
+	starts, err := readChunkStarts(listPath)
+	if err != nil {
+		return err
+	}
+
+	for i, chunkFile := range chunkFiles {
+		if err := processor.S3Client.UploadFile(ctx, chunkFile, chunkSourceKey(payload.VideoID, i)); err != nil {
+			return fmt.Errorf("failed to upload chunk %d: %w", i, err)
+		}
+	}
+
+	if pipeline.SourceInfo.HasAudio {
+		done := pipeline.track("audio")
+		if err := processor.encodeChunkedAudio(ctx, pipeline, renditions); err != nil {
+			return err
+		}
+		done()
+	}
+
+	var nodes []string
+	for i := range chunkFiles {
+		nodes = append(nodes, chunkNode(i))
+	}
+	if err := processor.Jobs.AddNodes(ctx, payload.JobID, nodes...); err != nil {
+		return fmt.Errorf("failed to register chunks: %w", err)
+	}
+
+	for i, chunkFile := range chunkFiles {
+		start, ok := starts[filepath.Base(chunkFile)]
+		if !ok {
+			return fmt.Errorf("chunk list has no entry for %s", filepath.Base(chunkFile))
+		}
+		task, err := models.NewChunkEncodingTask(models.ChunkEncodingPayload{
+			JobID:      payload.JobID,
+			TenantID:   payload.TenantID,
+			VideoID:    payload.VideoID,
+			ChunkIndex: i,
+			ChunkCount: len(chunkFiles),
+			ChunkStart: start,
+			Renditions: renditions,
+			HasAudio:   pipeline.SourceInfo.HasAudio,
+			Encryption: payload.Encryption,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = processor.enqueueFollowUp(ctx, task, asynq.MaxRetry(2), asynq.TaskID(models.ChunkTaskID(payload.JobID, i)))
+		if errors.Is(err, asynq.ErrTaskIDConflict) {
+			log.Printf("[%s] Chunk %d of job %s is already queued", payload.VideoID, i, payload.JobID)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to enqueue chunk %d: %w", i, err)
+		}
+	}
+
+	processor.recordResult(ctx, t, "split", pipeline.Result())
+
+	// Same ordering as the probe in dag.go: if every chunk beat us to it, we stitch
+	last, err := processor.Jobs.Complete(ctx, payload.JobID, "split")
+	if err != nil {
+		return fmt.Errorf("failed to complete split: %w", err)
+	}
+
+	log.Printf("[%s] Fanned out %d chunk(s) for renditions %v", payload.VideoID, len(chunkFiles), renditions)
+
+	if !last {
+		if last, err = processor.followUpMissed(ctx, payload.JobID); err != nil || !last {
+			return err
+		}
+	}
+	return processor.enqueueStitch(ctx, models.StitchPayload{
+		JobID:      payload.JobID,
+		VideoID:    payload.VideoID,
+		ChunkCount: len(chunkFiles),
+		Renditions: renditions,
+		HasAudio:   pipeline.SourceInfo.HasAudio,
+		Encryption: payload.Encryption,
+	})
+}
+
+// readChunkStarts reads the CSV list of the segment muxer, which has one
+// "file,start,end" line per chunk, into the start of each chunk file relative to
+// the first one
+func readChunkStarts(listPath string) (map[string]float64, error) {
+	f, err := os.Open(listPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chunk list: %w", err)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 3
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk list: %w", err)
+	}
+
+	starts := make(map[string]float64, len(records))
+	var first float64
+	for i, record := range records {
+		start, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start of %s in chunk list: %w", record[0], err)
+		}
+		// A source that does not start at zero shifts every entry
+		if i == 0 {
+			first = start
+		}
+		starts[filepath.Base(record[0])] = start - first
+	}
+	return starts, nil
+}
+
+// chunkKeyframeExpr forces keyframes on the segment grid of the whole source rather than
+// of the chunk, whose timestamps restart at zero. The first frame of the chunk is always
+// a keyframe, the next one falls on the next multiple of hlsSegmentSeconds of the source.
+func chunkKeyframeExpr(chunkStart float64) string {
+	phase := math.Mod(chunkStart, hlsSegmentSeconds)
+	if phase < 0.001 {
+		return fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds)
+	}
+	return fmt.Sprintf("expr:gte(t,n_forced*%d-%.6f)", hlsSegmentSeconds, phase)
+}
+
+func (processor *TaskProcessor) encodeChunkedAudio(ctx context.Context, pipeline *EncodingPipeline, renditions []int) error {
+	encoded := map[string]bool{}
+
+	for _, height := range renditions {
+		bitrate := chooseAudioBitrate(height)
+		if encoded[bitrate] {
+			continue
+		}
+		encoded[bitrate] = true
+
+		audioPath := filepath.Join(pipeline.TempDir, "audio_"+bitrate+".m4a")
+		args := []string{
+			"-hide_banner", "-y",
+			"-i", pipeline.DownloadedFilePath,
+			"-map", "0:a:0",
+			"-vn",
+			"-c:a", "aac",
+			"-b:a", bitrate,
+			audioPath,
+		}
+		if err := runFFmpeg(ctx, args); err != nil {
+			return fmt.Errorf("ffmpeg failed to encode %s audio: %w", bitrate, err)
+		}
+
+		if err := processor.S3Client.UploadFile(ctx, audioPath, chunkAudioKey(pipeline.Payload.VideoID, bitrate)); err != nil {
+			return fmt.Errorf("failed to upload %s audio: %w", bitrate, err)
+		}
+	}
+
+	return nil
+}
+
+func (processor *TaskProcessor) HandleChunkEncodeTask(ctx context.Context, t *asynq.Task) error {
+	var payload models.ChunkEncodingPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+	log.Printf("[%s] Encoding chunk %d/%d", payload.VideoID, payload.ChunkIndex+1, payload.ChunkCount)
+	node := chunkNode(payload.ChunkIndex)
+
+	if skip, err := processor.startNode(ctx, payload.JobID, payload.VideoID, node); skip || err != nil {
+		return err
+	}
+
+	var result models.EncodingResult
+	err := processor.withVideoLock(ctx, payload.JobID, payload.VideoID, func(ctx context.Context) (err error) {
+		result, err = processor.encodeChunk(ctx, payload)
+		return err
+	})
+	if err != nil {
+		log.Printf("[%s] ERROR encoding %s: %v", payload.VideoID, node, err)
+		return processor.failJobNode(ctx, payload.JobID, node, err)
+	}
+	// Chunks are intermediates removed by the stitch, so their result stays on the task
+	writeResult(t, result)
+
+	last, err := processor.Jobs.Complete(ctx, payload.JobID, node)
+	if errors.Is(err, jobs.ErrJobFailed) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to complete %s: %w", node, err)
+	}
+	if !last {
+		if last, err = processor.followUpMissed(ctx, payload.JobID); err != nil || !last {
+			return err
+		}
+	}
+
+	return processor.enqueueStitch(ctx, models.StitchPayload{
+		JobID:      payload.JobID,
+		VideoID:    payload.VideoID,
+		ChunkCount: payload.ChunkCount,
+		Renditions: payload.Renditions,
+		HasAudio:   payload.HasAudio,
+		Encryption: payload.Encryption,
+	})
+}
+
+func (processor *TaskProcessor) enqueueStitch(ctx context.Context, payload models.StitchPayload) error {
+	task, err := models.NewStitchTask(payload)
+	if err != nil {
+		return err
+	}
+	_, err = processor.enqueueFollowUp(ctx, task, asynq.MaxRetry(2), asynq.TaskID(models.StitchTaskID(payload.JobID)))
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		log.Printf("[%s] Stitch of job %s is already queued", payload.VideoID, payload.JobID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to enqueue stitch: %w", err)
+	}
+
+	log.Printf("[%s] All %d chunk(s) encoded, stitch queued", payload.VideoID, payload.ChunkCount)
+	return nil
+}
+
+func (processor *TaskProcessor) encodeChunk(ctx context.Context, payload models.ChunkEncodingPayload) (models.EncodingResult, error) {
+	result := models.EncodingResult{
+		JobID:    payload.JobID,
+		VideoID:  payload.VideoID,
+		Encoder:  videoEncoder,
+		StagesMs: map[string]int64{},
+	}
+
+	tempDir, err := os.MkdirTemp(processor.Resources.TempDir(), "media-chunk-*-"+payload.VideoID)
+	if err != nil {
+		return result, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// The chunk and its renditions are budgeted like the whole source of a pipeline
+	sourceKey := chunkSourceKey(payload.VideoID, payload.ChunkIndex)
+	size, err := processor.S3Client.ObjectSize(ctx, sourceKey)
+	if err != nil {
+		return result, fmt.Errorf("failed to stat chunk: %w", err)
+	}
+	releaseDisk, err := processor.Resources.ReserveDisk(size)
+	if err != nil {
+		return result, err
+	}
+	defer releaseDisk()
+
+	sourcePath := filepath.Join(tempDir, "source.mkv")
+	done := stageTimer(result.StagesMs, "download")
+	if err := processor.S3Client.DownloadFile(ctx, sourceKey, sourcePath); err != nil {
+		return result, fmt.Errorf("failed to download chunk: %w", err)
+	}
+	done()
+
+	for _, height := range payload.Renditions {
+		outputPath := filepath.Join(tempDir, fmt.Sprintf("%dp.mp4", height))
+
+		threads, release, err := processor.Resources.AcquireEncode(ctx)
+		if err != nil {
+			return result, fmt.Errorf("failed waiting for an encoder slot: %w", err)
+		}
+
+		// Keyframes are forced on the HLS segment grid so the stitched renditions
+		// can be segmented without re-encoding. Chunks do not start on that grid,
+		// so it is shifted by where the chunk starts.
+		args := []string{
+			"-hide_banner", "-y",
+			"-i", sourcePath,
+			"-c:v", videoEncoder,
+			"-b:v", chooseVideoBitrate(height),
+			"-profile:v", "main",
+			"-pix_fmt", "yuv420p",
+			"-vf", fmt.Sprintf("scale=-2:%d", height),
+			"-force_key_frames", chunkKeyframeExpr(payload.ChunkStart),
+			"-an",
+		}
+		if threads > 0 {
+			args = append(args, "-threads", fmt.Sprint(threads))
+		}
+		args = append(args, outputPath)
+
+		done := stageTimer(result.StagesMs, fmt.Sprintf("encode_%dp", height))
+		err = runFFmpeg(ctx, args)
+		release()
+		if err != nil {
+			return result, fmt.Errorf("ffmpeg failed for chunk %d at %dp: %w", payload.ChunkIndex, height, err)
+		}
+		done()
+
+		key := chunkRenditionKey(payload.VideoID, height, payload.ChunkIndex)
+		if err := processor.S3Client.UploadFile(ctx, outputPath, key); err != nil {
+			return result, fmt.Errorf("failed to upload chunk %d at %dp: %w", payload.ChunkIndex, height, err)
+		}
+		result.OutputKeys = append(result.OutputKeys, key)
+	}
+
+	return result, nil
+}
+
+func (processor *TaskProcessor) HandleStitchTask(ctx context.Context, t *asynq.Task) error {
+	var payload models.StitchPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+	log.Printf("[%s] Stitching %d chunk(s)", payload.VideoID, payload.ChunkCount)
+
+	if err := processor.Jobs.RefreshVideoLock(ctx, payload.VideoID, payload.JobID); err != nil {
+		return processor.failJobNode(ctx, payload.JobID, "stitch", skipRetryIfLocked(err))
+	}
+
+	var result models.EncodingResult
+	err := processor.withVideoLock(ctx, payload.JobID, payload.VideoID, func(ctx context.Context) (err error) {
+		result, err = processor.stitch(ctx, payload)
+		return err
+	})
+	if err != nil {
+		return processor.failJobNode(ctx, payload.JobID, "stitch", err)
+	}
+	processor.recordJobResult(ctx, t, "stitch", result)
+
+	if err := processor.Jobs.Finish(ctx, payload.JobID); err != nil {
+		return fmt.Errorf("failed to finish job: %w", err)
+	}
+	processor.catalogVideo(ctx, payload.JobID, payload.Renditions)
+	processor.publishJobCompleted(ctx, payload.JobID, payload.VideoID, payload.Renditions)
+
+	log.Printf("[%s] Chunked encoding job %s completed successfully.", payload.VideoID, payload.JobID)
+	return nil
+}
+
+func (processor *TaskProcessor) stitch(ctx context.Context, payload models.StitchPayload) (models.EncodingResult, error) {
+	result := models.EncodingResult{
+		JobID:    payload.JobID,
+		VideoID:  payload.VideoID,
+		Encoder:  videoEncoder,
+		StagesMs: map[string]int64{},
+	}
+
+	tempDir, err := os.MkdirTemp(processor.Resources.TempDir(), "media-stitch-*-"+payload.VideoID)
+	if err != nil {
+		return result, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	size, err := processor.stitchInputSize(ctx, payload.VideoID)
+	if err != nil {
+		return result, fmt.Errorf("failed to size chunks: %w", err)
+	}
+	releaseDisk, err := processor.Resources.ReserveDisk(size)
+	if err != nil {
+		return result, err
+	}
+	defer releaseDisk()
+
+	encodedOutputPath := filepath.Join(tempDir, "encoded")
+	hlsBase := filepath.Join(encodedOutputPath, "hls")
+
+	for _, height := range payload.Renditions {
+		done := stageTimer(result.StagesMs, fmt.Sprintf("stitch_%dp", height))
+		if err := processor.stitchRendition(ctx, payload, tempDir, hlsBase, height); err != nil {
+			return result, err
+		}
+		done()
+
+		renditionDir := filepath.Join(hlsBase, fmt.Sprintf("%dp", height))
+		if payload.Encryption != nil {
+			done := stageTimer(result.StagesMs, fmt.Sprintf("encrypt_%dp", height))
+			if err := encryptRendition(ctx, processor.Keys, renditionDir, payload.VideoID, payload.Encryption); err != nil {
+				return result, fmt.Errorf("failed to encrypt %dp: %w", height, err)
+			}
+			done()
+		}
+
+		rendition, err := measureRendition(renditionDir, payload.VideoID, height)
+		if err != nil {
+			return result, fmt.Errorf("failed to measure %dp: %w", height, err)
+		}
+		result.Renditions = append(result.Renditions, rendition)
+	}
+
+	done := stageTimer(result.StagesMs, "upload")
+	err = filepath.Walk(encodedOutputPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relativePath, err := filepath.Rel(encodedOutputPath, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.Join(payload.VideoID, relativePath)
+		result.OutputKeys = append(result.OutputKeys, key)
+		return processor.S3Client.UploadFile(ctx, path, key)
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to upload stitched renditions: %w", err)
+	}
+	done()
+
+	// Master playlist goes last so players never see a variant whose segments are missing
+	// Stitched renditions are uploaded together, so they all become ready at once
+	for _, height := range payload.Renditions {
+		processor.Webhooks.Publish(ctx, payload.JobID, webhooks.EventRenditionReady, webhooks.EventData{
+			Rendition: renditionInfo(height),
+		})
+	}
+
+	if err := processor.writeMasterPlaylist(ctx, payload.VideoID, payload.Renditions); err != nil {
+		return result, err
+	}
+	result.OutputKeys = append(result.OutputKeys, filepath.Join(payload.VideoID, "hls", "master.m3u8"))
+
+	if err := processor.S3Client.DeletePrefix(ctx, filepath.Join(payload.VideoID, "chunks")+"/"); err != nil {
+		log.Printf("[%s] WARN failed to remove chunk intermediates: %v", payload.VideoID, err)
+	}
+	return result, nil
+}
+
+// stitchInputSize is the size of the encoded chunks and audio a stitch downloads, the
+// stitched renditions take about as much again
+func (processor *TaskProcessor) stitchInputSize(ctx context.Context, videoID string) (int64, error) {
+	sourcePrefix := filepath.Dir(chunkSourceKey(videoID, 0)) + "/"
+
+	var size int64
+	err := processor.S3Client.WalkObjects(ctx, filepath.Join(videoID, "chunks")+"/", func(obj storage.Object) error {
+		if !strings.HasPrefix(obj.Key, sourcePrefix) {
+			size += obj.Size
+		}
+		return nil
+	})
+	return size, err
+}
+
+func (processor *TaskProcessor) stitchRendition(ctx context.Context, payload models.StitchPayload, tempDir, hlsBase string, height int) error {
+	chunkDir := filepath.Join(tempDir, fmt.Sprintf("%dp", height))
+	if err := os.MkdirAll(chunkDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create chunk dir: %w", err)
+	}
+
+	var concatList strings.Builder
+	for i := 0; i < payload.ChunkCount; i++ {
+		chunkPath := filepath.Join(chunkDir, fmt.Sprintf("chunk%04d.mp4", i))
+		if err := processor.S3Client.DownloadFile(ctx, chunkRenditionKey(payload.VideoID, height, i), chunkPath); err != nil {
+			return fmt.Errorf("failed to download chunk %d at %dp: %w", i, height, err)
+		}
+		concatList.WriteString(fmt.Sprintf("file '%s'\n", chunkPath))
+	}
+
+	listPath := filepath.Join(chunkDir, "concat.txt")
+	if err := os.WriteFile(listPath, []byte(concatList.String()), 0o644); err != nil {
+		return fmt.Errorf("failed to write concat list: %w", err)
+	}
+
+	renditionDir := filepath.Join(hlsBase, fmt.Sprintf("%dp", height))
+	if err := os.MkdirAll(renditionDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create rendition directory %s: %w", renditionDir, err)
+	}
+
+	// The concat demuxer offsets each chunk by the running duration, so the output
+	// timeline is continuous and needs no EXT-X-DISCONTINUITY
+	args := []string{
+		"-hide_banner", "-y",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", listPath,
+	}
+
+	if payload.HasAudio {
+		audioPath := filepath.Join(chunkDir, "audio.m4a")
+		if err := processor.S3Client.DownloadFile(ctx, chunkAudioKey(payload.VideoID, chooseAudioBitrate(height)), audioPath); err != nil {
+			return fmt.Errorf("failed to download audio for %dp: %w", height, err)
+		}
+		args = append(args,
+			"-i", audioPath,
+			"-map", "0:v:0",
+			"-map", "1:a:0",
+		)
+	}
+
+	args = append(args,
+		"-c", "copy",
+		"-f", "hls",
+		"-hls_time", fmt.Sprint(hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_list_size", "0",
+		"-hls_segment_filename", filepath.Join(renditionDir, "segment%03d.ts"),
+		filepath.Join(renditionDir, "playlist.m3u8"),
+	)
+
+	if err := runFFmpeg(ctx, args); err != nil {
+		return fmt.Errorf("ffmpeg failed to stitch %dp: %w", height, err)
+	}
+
+	log.Printf("[%s] Stitched %dp from %d chunk(s)", payload.VideoID, height, payload.ChunkCount)
+	return nil
+}
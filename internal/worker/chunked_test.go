@@ -0,0 +1,55 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadChunkStarts(t *testing.T) {
+	listPath := filepath.Join(t.TempDir(), "chunks.csv")
+	list := "chunk0000.mkv,1.400000,11.410000\n" +
+		"chunk0001.mkv,11.410000,21.420000\n" +
+		"chunk0002.mkv,21.420000,25.000000\n"
+	if err := os.WriteFile(listPath, []byte(list), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	starts, err := readChunkStarts(listPath)
+	if err != nil {
+		t.Fatalf("readChunkStarts() = %v", err)
+	}
+	want := map[string]float64{"chunk0000.mkv": 0, "chunk0001.mkv": 10.01, "chunk0002.mkv": 20.02}
+	if len(starts) != len(want) {
+		t.Fatalf("readChunkStarts() = %v, want %v", starts, want)
+	}
+	for file, start := range want {
+		if got, ok := starts[file]; !ok || got < start-1e-9 || got > start+1e-9 {
+			t.Errorf("start of %s = %v, want %v", file, got, start)
+		}
+	}
+
+	if err := os.WriteFile(listPath, []byte("chunk0000.mkv,zero,10\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readChunkStarts(listPath); err == nil {
+		t.Error("readChunkStarts() of an invalid start succeeded")
+	}
+}
+
+func TestChunkKeyframeExpr(t *testing.T) {
+	tests := []struct {
+		start float64
+		want  string
+	}{
+		{0, "expr:gte(t,n_forced*4)"},
+		{8, "expr:gte(t,n_forced*4)"},
+		{10.01, "expr:gte(t,n_forced*4-2.010000)"},
+		{3.5, "expr:gte(t,n_forced*4-3.500000)"},
+	}
+	for _, tt := range tests {
+		if got := chunkKeyframeExpr(tt.start); got != tt.want {
+			t.Errorf("chunkKeyframeExpr(%v) = %s, want %s", tt.start, got, tt.want)
+		}
+	}
+}
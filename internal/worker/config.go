@@ -0,0 +1,69 @@
+package worker
+
+import (
+	"better-media/internal/config"
+	"runtime"
+	"time"
+)
+
+type Config struct {
+	RedisAddr string
+
+	// PublicBaseURL is where the API is reachable, used for playback URLs in webhooks
+	PublicBaseURL string
+	// WebhookSecret signs deliveries to per job webhook URLs
+	WebhookSecret string
+
+	// Concurrency is the number of tasks asynq runs at once in this process
+	Concurrency int
+	// Queues maps queue names to their priority weight
+	Queues         map[string]int
+	StrictPriority bool
+
+	// TenantMaxActive caps the encodes a single tenant runs at once across the cluster,
+	// 0 disables the limit. TenantLease is how long a slot is held if a worker dies, running
+	// tasks keep extending it.
+	TenantMaxActive int
+	TenantLease     time.Duration
+
+	// FFmpegThreads is the total thread budget shared by every ffmpeg process started by
+	// this worker. Each encode takes ThreadsPerEncode from it and waits when it is spent.
+	FFmpegThreads    int
+	ThreadsPerEncode int
+
+	// TempDir is where pipelines download and encode. DiskMultiplier is how many times the
+	// source size a job reserves (source + renditions), and MinFreeDisk is kept free on
+	// top of all reservations.
+	TempDir        string
+	DiskMultiplier float64
+	MinFreeDisk    int64
+
+	// KeyEncryptionKey seals the keys of encrypted renditions, 32 bytes in hex or base64.
+	// Empty disables encryption.
+	KeyEncryptionKey string
+
+	// ResultRetention is how long completed tasks and their results are kept
+	ResultRetention time.Duration
+}
+
+func LoadConfig() Config {
+	cpus := runtime.NumCPU()
+
+	return Config{
+		RedisAddr:        config.String("REDIS_ADDR", "127.0.0.1:6379"),
+		PublicBaseURL:    config.String("PUBLIC_BASE_URL", "http://localhost:8080"),
+		WebhookSecret:    config.String("WEBHOOK_SECRET", ""),
+		Concurrency:      config.Int("WORKER_CONCURRENCY", 1),
+		Queues:           config.Weights("WORKER_QUEUES", map[string]int{"critical": 6, "default": 3, "bulk": 1}),
+		StrictPriority:   config.Bool("WORKER_STRICT_PRIORITY", false),
+		TenantMaxActive:  config.Int("WORKER_TENANT_MAX_ACTIVE", 0),
+		TenantLease:      config.Duration("WORKER_TENANT_LEASE", 10*time.Minute),
+		FFmpegThreads:    config.Int("FFMPEG_THREADS", cpus),
+		ThreadsPerEncode: config.Int("FFMPEG_THREADS_PER_ENCODE", max(1, cpus/2)),
+		TempDir:          config.String("WORKER_TEMP_DIR", ""),
+		DiskMultiplier:   config.Float("WORKER_DISK_MULTIPLIER", 3),
+		MinFreeDisk:      config.Int64("WORKER_MIN_FREE_DISK_BYTES", 1<<30),
+		KeyEncryptionKey: config.String("KEY_ENCRYPTION_KEY", ""),
+		ResultRetention:  config.Duration("TASK_RESULT_RETENTION", 24*time.Hour),
+	}
+}
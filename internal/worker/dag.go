@@ -0,0 +1,488 @@
+package worker
+
+import (
+	"better-media/internal/catalog"
+	"better-media/internal/jobs"
+	"better-media/internal/webhooks"
+	"better-media/pkg/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// The default job graph gives every rendition its own task, so a 1080p encode can run on a
+// different machine than the 360p one:
+//
+//	probe (1 task)  ->  encode_rendition (1 task per rendition)  ->  finalize (1 task)
+//
+// Progress and failures are tracked per job in jobs.Graph.
+
+const probeNode = "probe"
+
+func renditionNode(height int) string {
+	return fmt.Sprintf("%dp", height)
+}
+
+// failJobNode propagates a node failure to the parent job once asynq will not retry the
+// task anymore, and returns err unchanged for the handler to report.
+func (processor *TaskProcessor) failJobNode(ctx context.Context, jobID, node string, err error) error {
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+
+	if retried >= maxRetry || errors.Is(err, asynq.SkipRetry) {
+		first, failErr := processor.Jobs.Fail(ctx, jobID, node, err)
+		if failErr != nil {
+			log.Printf("[%s] ERROR failed to mark job as failed: %v", jobID, failErr)
+		}
+		if first {
+			processor.Webhooks.Publish(ctx, jobID, webhooks.EventJobFailed, webhooks.EventData{
+				Error: fmt.Sprintf("%s: %v", node, err),
+			})
+		}
+	}
+	return err
+}
+
+// enqueueFollowUp enqueues the next tasks of a job in the queue of the current task, so the
+// whole job keeps the priority it was submitted with. Follow-ups are retained like the
+// first task, so their results stay visible in the job API.
+func (processor *TaskProcessor) enqueueFollowUp(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+	if queue, ok := asynq.GetQueueName(ctx); ok {
+		opts = append(opts, asynq.Queue(queue))
+	}
+	if processor.ResultRetention > 0 {
+		opts = append(opts, asynq.Retention(processor.ResultRetention))
+	}
+	return processor.AsynqClient.EnqueueContext(ctx, task, opts...)
+}
+
+// beginJob registers a job with its coordinator node and takes the lock on the video's
+// prefix. A job that cannot get the lock fails right away instead of retrying, since the
+// job holding it may run for hours.
+func (processor *TaskProcessor) beginJob(ctx context.Context, payload models.VideoEncodingPayload, node string) error {
+	jobID, videoID := payload.JobID, payload.VideoID
+
+	request, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	err = processor.Jobs.Create(ctx, jobs.Job{
+		ID:         jobID,
+		VideoID:    videoID,
+		TenantID:   payload.TenantID,
+		WebhookURL: payload.WebhookURL,
+		Request:    request,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create job: %w", err)
+	}
+	if err := processor.Jobs.AddNodes(ctx, jobID, node); err != nil {
+		return fmt.Errorf("failed to register %s: %w", node, err)
+	}
+
+	if err := processor.Jobs.LockVideo(ctx, videoID, jobID); err != nil {
+		log.Printf("[%s] Refusing job %s: %v", videoID, jobID, err)
+		return processor.failJobNode(ctx, jobID, node, skipRetryIfLocked(err))
+	}
+
+	processor.Webhooks.Publish(ctx, jobID, webhooks.EventJobStarted, webhooks.EventData{})
+	return nil
+}
+
+// skipRetryIfLocked stops asynq from retrying a task that lost the video lock, retrying
+// cannot get it back.
+func skipRetryIfLocked(err error) error {
+	if errors.Is(err, jobs.ErrVideoLocked) {
+		return fmt.Errorf("%w: %w", err, asynq.SkipRetry)
+	}
+	return err
+}
+
+// startNode marks a fan-out node as running and refreshes the job's video lock. skip is
+// true when the job already failed and the node should not do any work.
+func (processor *TaskProcessor) startNode(ctx context.Context, jobID, videoID, node string) (skip bool, err error) {
+	if err := processor.Jobs.Start(ctx, jobID, node); err != nil {
+		if errors.Is(err, jobs.ErrJobFailed) {
+			log.Printf("[%s] Skipping %s, job %s has already failed", videoID, node, jobID)
+			return true, nil
+		}
+		return false, err
+	}
+
+	if err := processor.Jobs.RefreshVideoLock(ctx, videoID, jobID); err != nil {
+		return false, processor.failJobNode(ctx, jobID, node, skipRetryIfLocked(err))
+	}
+	return false, nil
+}
+
+// withVideoLock runs the work of a task while a heartbeat keeps the job's video lock from
+// expiring, however long the work takes. If another job takes the lock anyway, the work is
+// canceled and the error says so.
+func (processor *TaskProcessor) withVideoLock(ctx context.Context, jobID, videoID string, work func(ctx context.Context) error) error {
+	workCtx, stop := keepAlive(ctx, jobs.VideoLockTTL/3, func(ctx context.Context) error {
+		err := processor.Jobs.RefreshVideoLock(ctx, videoID, jobID)
+		if err != nil && !errors.Is(err, jobs.ErrVideoLocked) {
+			// The lock outlives a short Redis outage, the next beat tries again
+			log.Printf("[%s] WARN failed to refresh the lock of job %s: %v", videoID, jobID, err)
+			return nil
+		}
+		return err
+	})
+
+	err := work(workCtx)
+	if lockErr := stop(); lockErr != nil {
+		return skipRetryIfLocked(lockErr)
+	}
+	return err
+}
+
+func (processor *TaskProcessor) HandleProbeVideoTask(ctx context.Context, t *asynq.Task) error {
+	var payload models.VideoEncodingPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+	log.Printf("[%s] Probing source for job %s", payload.VideoID, payload.JobID)
+
+	if err := processor.beginJob(ctx, payload, probeNode); err != nil {
+		return err
+	}
+
+	reused, err := processor.reuseEncode(ctx, t, payload, probeNode)
+	if err != nil {
+		return processor.failJobNode(ctx, payload.JobID, probeNode, err)
+	}
+	if reused {
+		return nil
+	}
+
+	err = processor.withVideoLock(ctx, payload.JobID, payload.VideoID, func(ctx context.Context) error {
+		return processor.probeAndFanOut(ctx, t, payload)
+	})
+	if err != nil {
+		return processor.failJobNode(ctx, payload.JobID, probeNode, err)
+	}
+	return nil
+}
+
+func (processor *TaskProcessor) probeAndFanOut(ctx context.Context, t *asynq.Task, payload models.VideoEncodingPayload) error {
+	pipeline, err := NewEncodingPipeline(payload, processor.Resources)
+	if err != nil {
+		return err
+	}
+	defer pipeline.Cleanup()
+
+	if err := pipeline.Download(ctx, processor.S3Client); err != nil {
+		return fmt.Errorf("failed to download file: %w", err)
+	}
+	if err := pipeline.Probe(); err != nil {
+		return fmt.Errorf("failed to probe file: %w", err)
+	}
+
+	renditions, err := pipeline.RenditionHeights()
+	if err != nil {
+		return err
+	}
+
+	var nodes []string
+	for _, height := range renditions {
+		nodes = append(nodes, renditionNode(height))
+	}
+	if err := processor.Jobs.AddNodes(ctx, payload.JobID, nodes...); err != nil {
+		return fmt.Errorf("failed to register renditions: %w", err)
+	}
+
+	for _, height := range renditions {
+		task, err := models.NewRenditionEncodingTask(models.RenditionEncodingPayload{
+			JobID:      payload.JobID,
+			TenantID:   payload.TenantID,
+			VideoID:    payload.VideoID,
+			InputFile:  payload.InputFile,
+			Height:     height,
+			HasAudio:   pipeline.SourceInfo.HasAudio,
+			Renditions: renditions,
+			Encryption: payload.Encryption,
+			Overlay:    payload.Overlay,
+
+			ForensicWatermark: payload.ForensicWatermark,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = processor.enqueueFollowUp(ctx, task, asynq.MaxRetry(2), asynq.TaskID(models.RenditionTaskID(payload.JobID, height)))
+		if errors.Is(err, asynq.ErrTaskIDConflict) {
+			log.Printf("[%s] %dp of job %s is already queued", payload.VideoID, height, payload.JobID)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to enqueue %dp: %w", height, err)
+		}
+	}
+
+	// Results are recorded before completing, so finalize always sees them
+	processor.recordResult(ctx, t, probeNode, pipeline.Result())
+
+	// The probe node completes only after its children are registered, so the job can
+	// never look finished while renditions are still being queued. If every rendition
+	// beat us to it, finalizing is our job.
+	last, err := processor.Jobs.Complete(ctx, payload.JobID, probeNode)
+	if err != nil {
+		return fmt.Errorf("failed to complete probe: %w", err)
+	}
+
+	log.Printf("[%s] Fanned out renditions %v", payload.VideoID, renditions)
+
+	if !last {
+		if last, err = processor.followUpMissed(ctx, payload.JobID); err != nil || !last {
+			return err
+		}
+	}
+	return processor.enqueueFinalize(ctx, payload.JobID, payload.VideoID, renditions)
+}
+
+func (processor *TaskProcessor) HandleRenditionEncodeTask(ctx context.Context, t *asynq.Task) error {
+	var payload models.RenditionEncodingPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+	node := renditionNode(payload.Height)
+
+	if skip, err := processor.startNode(ctx, payload.JobID, payload.VideoID, node); skip || err != nil {
+		return err
+	}
+
+	var result models.EncodingResult
+	err := processor.withVideoLock(ctx, payload.JobID, payload.VideoID, func(ctx context.Context) (err error) {
+		result, err = processor.encodeRendition(ctx, payload)
+		return err
+	})
+	if err != nil {
+		log.Printf("[%s] ERROR encoding %s: %v", payload.VideoID, node, err)
+		return processor.failJobNode(ctx, payload.JobID, node, err)
+	}
+	processor.recordResult(ctx, t, node, result)
+
+	last, err := processor.Jobs.Complete(ctx, payload.JobID, node)
+	if errors.Is(err, jobs.ErrJobFailed) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to complete %s: %w", node, err)
+	}
+
+	processor.Webhooks.Publish(ctx, payload.JobID, webhooks.EventRenditionReady, webhooks.EventData{
+		Rendition: renditionInfo(payload.Height),
+	})
+
+	if !last {
+		if last, err = processor.followUpMissed(ctx, payload.JobID); err != nil {
+			return err
+		}
+	}
+	if !last {
+		return processor.publishCompletedRenditions(ctx, payload)
+	}
+
+	return processor.enqueueFinalize(ctx, payload.JobID, payload.VideoID, payload.Renditions)
+}
+
+// followUpMissed reports whether a retried task finds every node of its job completed while
+// the job is still running. Complete tells only the first call that it completed the last
+// node, so if that attempt failed to enqueue the next step, its retry must do it.
+func (processor *TaskProcessor) followUpMissed(ctx context.Context, jobID string) (bool, error) {
+	if retried, _ := asynq.GetRetryCount(ctx); retried == 0 {
+		return false, nil
+	}
+
+	job, err := processor.Jobs.Get(ctx, jobID)
+	if err != nil {
+		return false, fmt.Errorf("failed to read job: %w", err)
+	}
+	return job.Pending == 0 && job.Status == jobs.StatusRunning, nil
+}
+
+func (processor *TaskProcessor) enqueueFinalize(ctx context.Context, jobID, videoID string, renditions []int) error {
+	task, err := models.NewFinalizeTask(models.FinalizePayload{
+		JobID:      jobID,
+		VideoID:    videoID,
+		Renditions: renditions,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = processor.enqueueFollowUp(ctx, task, asynq.MaxRetry(2), asynq.TaskID(models.FinalizeTaskID(jobID)))
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		log.Printf("[%s] Finalize of job %s is already queued", videoID, jobID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to enqueue finalize: %w", err)
+	}
+
+	log.Printf("[%s] All renditions encoded, finalize queued", videoID)
+	return nil
+}
+
+func (processor *TaskProcessor) encodeRendition(ctx context.Context, payload models.RenditionEncodingPayload) (models.EncodingResult, error) {
+	pipeline, err := NewEncodingPipeline(models.VideoEncodingPayload{
+		JobID:      payload.JobID,
+		VideoID:    payload.VideoID,
+		InputFile:  payload.InputFile,
+		Encryption: payload.Encryption,
+		Overlay:    payload.Overlay,
+
+		ForensicWatermark: payload.ForensicWatermark,
+	}, processor.Resources)
+	if err != nil {
+		return models.EncodingResult{}, err
+	}
+	defer pipeline.Cleanup()
+	pipeline.Keys = processor.Keys
+
+	if err := pipeline.Download(ctx, processor.S3Client); err != nil {
+		return models.EncodingResult{}, fmt.Errorf("failed to download file: %w", err)
+	}
+
+	pipeline.SourceInfo.Height = payload.Height
+	pipeline.SourceInfo.HasAudio = payload.HasAudio
+
+	if err := pipeline.EncodeRendition(ctx, payload.Height); err != nil {
+		return models.EncodingResult{}, err
+	}
+
+	if err := pipeline.Upload(ctx, processor.S3Client); err != nil {
+		return models.EncodingResult{}, fmt.Errorf("failed to upload encoded files: %w", err)
+	}
+	return pipeline.Result(), nil
+}
+
+// publishCompletedRenditions rewrites the master playlist with every rendition finished so
+// far, so playback can start before the whole ladder is done. Two workers racing here may
+// publish a slightly stale list; finalize always writes the complete one.
+func (processor *TaskProcessor) publishCompletedRenditions(ctx context.Context, payload models.RenditionEncodingPayload) error {
+	job, err := processor.Jobs.Get(ctx, payload.JobID)
+	if err != nil {
+		return fmt.Errorf("failed to read job: %w", err)
+	}
+
+	var heights []int
+	for _, height := range payload.Renditions {
+		if job.Nodes[renditionNode(height)] == jobs.StatusCompleted {
+			heights = append(heights, height)
+		}
+	}
+
+	return processor.writeMasterPlaylist(ctx, payload.VideoID, heights)
+}
+
+func (processor *TaskProcessor) HandleFinalizeTask(ctx context.Context, t *asynq.Task) error {
+	var payload models.FinalizePayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+	log.Printf("[%s] Finalizing job %s", payload.VideoID, payload.JobID)
+
+	if err := processor.Jobs.RefreshVideoLock(ctx, payload.VideoID, payload.JobID); err != nil {
+		return processor.failJobNode(ctx, payload.JobID, "finalize", skipRetryIfLocked(err))
+	}
+
+	final := models.EncodingResult{
+		JobID:      payload.JobID,
+		VideoID:    payload.VideoID,
+		StagesMs:   map[string]int64{},
+		OutputKeys: []string{filepath.Join(payload.VideoID, "hls", "master.m3u8")},
+	}
+	done := stageTimer(final.StagesMs, "master_playlist")
+	if err := processor.writeMasterPlaylist(ctx, payload.VideoID, payload.Renditions); err != nil {
+		return processor.failJobNode(ctx, payload.JobID, "finalize", err)
+	}
+	done()
+	processor.recordJobResult(ctx, t, "finalize", final)
+
+	if err := processor.Jobs.Finish(ctx, payload.JobID); err != nil {
+		return fmt.Errorf("failed to finish job: %w", err)
+	}
+	processor.catalogVideo(ctx, payload.JobID, payload.Renditions)
+	processor.publishJobCompleted(ctx, payload.JobID, payload.VideoID, payload.Renditions)
+
+	log.Printf("[%s] Encoding job %s completed successfully.", payload.VideoID, payload.JobID)
+	return nil
+}
+
+func (processor *TaskProcessor) writeMasterPlaylist(ctx context.Context, videoID string, heights []int) error {
+	sort.Ints(heights)
+
+	var renditions []completedRendition
+	for _, height := range heights {
+		renditions = append(renditions, completedRendition{
+			Height:       height,
+			Bandwidth:    getBandwidthForHeight(height),
+			PlaylistPath: fmt.Sprintf("%dp/playlist.m3u8", height),
+		})
+	}
+
+	tempDir, err := os.MkdirTemp(processor.Resources.TempDir(), "media-master-*-"+videoID)
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	return writeMasterPlaylist(ctx, processor.S3Client, videoID, tempDir, renditions)
+}
+
+// catalogVideo records the video of a completed job as encoded with the current profile.
+// The output is already published at this point, so a failure is only logged.
+func (processor *TaskProcessor) catalogVideo(ctx context.Context, jobID string, renditions []int) {
+	job, err := processor.Jobs.Get(ctx, jobID)
+	if err != nil {
+		log.Printf("[%s] WARN failed to read job for the catalog: %v", jobID, err)
+		return
+	}
+
+	var request models.VideoEncodingPayload
+	if err := json.Unmarshal(job.Request, &request); err != nil {
+		log.Printf("[%s] WARN job %s has no request to catalog", job.VideoID, jobID)
+		return
+	}
+
+	err = processor.Catalog.RecordEncoded(ctx, catalog.Video{
+		ID:             job.VideoID,
+		TenantID:       job.TenantID,
+		JobID:          jobID,
+		Request:        request,
+		Renditions:     renditions,
+		SourceSHA256:   job.SourceSHA256,
+		ProfileVersion: models.ProfileVersion,
+		EncodedAt:      time.Now(),
+	})
+	if err != nil {
+		log.Printf("[%s] WARN failed to catalog job %s: %v", job.VideoID, jobID, err)
+	}
+}
+
+func renditionInfo(height int) *webhooks.Rendition {
+	return &webhooks.Rendition{
+		Height:    height,
+		Bandwidth: getBandwidthForHeight(height),
+		Playlist:  fmt.Sprintf("hls/%dp/playlist.m3u8", height),
+	}
+}
+
+func (processor *TaskProcessor) publishJobCompleted(ctx context.Context, jobID, videoID string, heights []int) {
+	var renditions []webhooks.Rendition
+	for _, height := range heights {
+		renditions = append(renditions, *renditionInfo(height))
+	}
+
+	processor.Webhooks.Publish(ctx, jobID, webhooks.EventJobCompleted, webhooks.EventData{
+		Renditions:  renditions,
+		PlaybackURL: processor.Webhooks.PlaybackURL(videoID),
+	})
+}
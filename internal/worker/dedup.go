@@ -0,0 +1,95 @@
+package worker
+
+import (
+	"better-media/internal/catalog"
+	"better-media/internal/keys"
+	"better-media/internal/webhooks"
+	"better-media/pkg/models"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/hibiken/asynq"
+)
+
+// Users often upload the same file again. Before a job downloads and encodes its source,
+// the source is hashed as it streams from the bucket; when the tenant already has a video
+// encoded from the same bytes with the same profile, its renditions are copied over
+// instead, which skips both the download and the encode.
+
+// reuseEncode completes the job from an existing encode of the same source if there is
+// one. It reports whether it did; any problem before the copy falls back to encoding.
+func (processor *TaskProcessor) reuseEncode(ctx context.Context, t *asynq.Task, payload models.VideoEncodingPayload, node string) (bool, error) {
+	result := models.EncodingResult{
+		JobID:    payload.JobID,
+		VideoID:  payload.VideoID,
+		StagesMs: map[string]int64{},
+	}
+
+	done := stageTimer(result.StagesMs, "hash")
+	sha256, err := processor.S3Client.SHA256(ctx, filepath.Join(payload.VideoID, "source", payload.InputFile))
+	if err != nil {
+		log.Printf("[%s] WARN failed to hash source, encoding it: %v", payload.VideoID, err)
+		return false, nil
+	}
+	done()
+
+	if err := processor.Jobs.SetSourceHash(ctx, payload.JobID, sha256); err != nil {
+		log.Printf("[%s] WARN failed to store source hash: %v", payload.VideoID, err)
+	}
+
+	existing, err := processor.Catalog.FindBySource(ctx, payload.TenantID, sha256, payload.ProfileKey())
+	if err != nil {
+		if !errors.Is(err, catalog.ErrVideoNotFound) {
+			log.Printf("[%s] WARN failed to look up source %s: %v", payload.VideoID, sha256, err)
+		}
+		return false, nil
+	}
+	// Re-encoding a video itself, or an encode made with older settings, is never skipped
+	if existing.ID == payload.VideoID || existing.ProfileVersion < models.ProfileVersion || len(existing.Renditions) == 0 {
+		return false, nil
+	}
+
+	log.Printf("[%s] Source matches video %s, copying its renditions", payload.VideoID, existing.ID)
+
+	done = stageTimer(result.StagesMs, "copy")
+	copied, err := processor.S3Client.CopyPrefix(ctx, existing.ID+"/hls/", payload.VideoID+"/hls/")
+	if err != nil {
+		// Whatever was copied is overwritten by the encode
+		log.Printf("[%s] WARN failed to copy renditions of %s, encoding instead: %v", payload.VideoID, existing.ID, err)
+		return false, nil
+	}
+	// Encrypted renditions refer to their keys by ID, which stay valid under another video
+	if payload.Encryption != nil {
+		if _, err := processor.S3Client.CopyPrefix(ctx, keys.VideoPrefix(existing.ID), keys.VideoPrefix(payload.VideoID)); err != nil {
+			log.Printf("[%s] WARN failed to copy keys of %s, encoding instead: %v", payload.VideoID, existing.ID, err)
+			return false, nil
+		}
+	}
+	done()
+
+	result.Encoder = videoEncoder
+	result.ReusedFrom = existing.ID
+	result.OutputKeys = copied
+	processor.recordJobResult(ctx, t, node, result)
+
+	if _, err := processor.Jobs.Complete(ctx, payload.JobID, node); err != nil {
+		return true, fmt.Errorf("failed to complete %s: %w", node, err)
+	}
+	if err := processor.Jobs.Finish(ctx, payload.JobID); err != nil {
+		return true, fmt.Errorf("failed to finish job: %w", err)
+	}
+	processor.catalogVideo(ctx, payload.JobID, existing.Renditions)
+
+	for _, height := range existing.Renditions {
+		processor.Webhooks.Publish(ctx, payload.JobID, webhooks.EventRenditionReady, webhooks.EventData{
+			Rendition: renditionInfo(height),
+		})
+	}
+	processor.publishJobCompleted(ctx, payload.JobID, payload.VideoID, existing.Renditions)
+
+	log.Printf("[%s] Job %s completed from the encode of %s", payload.VideoID, payload.JobID, existing.ID)
+	return true, nil
+}
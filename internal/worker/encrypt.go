@@ -0,0 +1,150 @@
+package worker
+
+import (
+	"better-media/internal/keys"
+	"better-media/pkg/m3u8"
+	"better-media/pkg/models"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hibiken/asynq"
+)
+
+// errKeysNotConfigured fails jobs that ask for encryption on a worker without a key store
+var errKeysNotConfigured = fmt.Errorf("segment encryption requires KEY_ENCRYPTION_KEY on the worker: %w", asynq.SkipRetry)
+
+// encryptRendition encrypts the segments of a rendition written by ffmpeg in place and adds
+// the EXT-X-KEY tags to its playlist. Keys are created for the video as the segments need
+// them, one for the whole rendition or a new one every KeyRotationSegments. The key URIs
+// are placeholders that the API replaces with its key endpoint.
+func encryptRendition(ctx context.Context, store *keys.Store, renditionDir, videoID string, encryption *models.Encryption) error {
+	if store == nil {
+		return errKeysNotConfigured
+	}
+	if encryption.Method != models.EncryptionAES128 {
+		return fmt.Errorf("cannot encrypt MPEG-TS segments with %s: %w", encryption.Method, asynq.SkipRetry)
+	}
+
+	playlistPath := filepath.Join(renditionDir, "playlist.m3u8")
+	playlist, err := readMediaPlaylist(playlistPath)
+	if err != nil {
+		return err
+	}
+
+	var key keys.Key
+	for i := range playlist.Segments {
+		segment := &playlist.Segments[i]
+		if segment.Map != nil || segment.ByteRange != nil {
+			return fmt.Errorf("cannot encrypt %s, only whole MPEG-TS segments are supported", segment.URI)
+		}
+
+		if i == 0 || (encryption.KeyRotationSegments > 0 && i%encryption.KeyRotationSegments == 0) {
+			if key, err = store.Create(ctx, videoID); err != nil {
+				return err
+			}
+			segment.Keys = []m3u8.Key{{Method: m3u8.MethodAES128, URI: keys.URI(key.ID)}}
+		}
+
+		// Without an IV attribute, players use the media sequence number of the segment.
+		// The B variant of a watermarked segment takes its place, so it shares its key.
+		paths := []string{filepath.Join(renditionDir, segment.URI)}
+		if variant := filepath.Join(renditionDir, models.ForensicVariantDir, segment.URI); fileExists(variant) {
+			paths = append(paths, variant)
+		}
+		for _, path := range paths {
+			if err := encryptSegment(path, key.Value, playlist.MediaSequence+i); err != nil {
+				return fmt.Errorf("failed to encrypt %s: %w", segment.URI, err)
+			}
+		}
+	}
+
+	return os.WriteFile(playlistPath, playlist.Encode().Bytes(), 0o644)
+}
+
+// encryptSegment encrypts a segment with AES-128-CBC and PKCS #7 padding, as RFC 8216
+// section 5.2 requires for METHOD=AES-128
+func encryptSegment(path string, key []byte, sequence int) error {
+	plaintext, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(plaintext, plaintext)
+
+	return os.WriteFile(path, plaintext, 0o644)
+}
+
+// cencInitSegment is the init segment of a rendition encrypted with common encryption
+const cencInitSegment = "init.mp4"
+
+// clearKeyFormat is the KEYFORMAT of ClearKey keys, as EME players of HLS expect it
+const clearKeyFormat = "org.w3.clearkey"
+
+// cencSegmentArgs are the HLS muxer options that write the fMP4 segments of a rendition to
+// dir, encrypted with key by ffmpeg's mp4 muxer. It writes no pssh box, packageCENC adds
+// one once the encode is done.
+func cencSegmentArgs(dir string, key keys.Key) []string {
+	return []string{
+		"-hls_segment_type", "fmp4",
+		"-hls_fmp4_init_filename", cencInitSegment,
+		"-hls_segment_options", fmt.Sprintf("encryption_scheme=cenc-aes-ctr:encryption_key=%x:encryption_kid=%s", key.Value, key.ID),
+		"-hls_segment_filename", filepath.Join(dir, "segment%03d.m4s"),
+	}
+}
+
+// packageCENC adds the ClearKey pssh box of key to the init segment of a rendition
+// encrypted by the muxer, and the key to its playlist. The key URI is a placeholder like
+// for AES-128, EME players get the key from the ClearKey license server.
+func packageCENC(renditionDir string, key keys.Key) error {
+	pssh, err := keys.PSSH(keys.ClearKeySystemID, []string{key.ID}, nil)
+	if err != nil {
+		return err
+	}
+	initPath := filepath.Join(renditionDir, cencInitSegment)
+	initSegment, err := os.ReadFile(initPath)
+	if err != nil {
+		return err
+	}
+	if initSegment, err = keys.InsertPSSH(initSegment, pssh); err != nil {
+		return fmt.Errorf("failed to add pssh to %s: %w", cencInitSegment, err)
+	}
+	if err := os.WriteFile(initPath, initSegment, 0o644); err != nil {
+		return err
+	}
+
+	playlistPath := filepath.Join(renditionDir, "playlist.m3u8")
+	playlist, err := readMediaPlaylist(playlistPath)
+	if err != nil {
+		return err
+	}
+	if len(playlist.Segments) == 0 || playlist.Segments[0].Map == nil {
+		return fmt.Errorf("playlist of %s has no fMP4 segments", renditionDir)
+	}
+	playlist.Segments[0].Keys = []m3u8.Key{{
+		Method:            m3u8.MethodSampleAESCTR,
+		URI:               keys.URI(key.ID),
+		KeyFormat:         clearKeyFormat,
+		KeyFormatVersions: "1",
+	}}
+	return os.WriteFile(playlistPath, playlist.Encode().Bytes(), 0o644)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
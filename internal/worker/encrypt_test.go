@@ -0,0 +1,73 @@
+package worker
+
+import (
+	"better-media/internal/keys"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackageCENC(t *testing.T) {
+	dir := t.TempDir()
+	key := keys.Key{ID: "0123456789abcdef0123456789abcdef", Value: make([]byte, keys.Size)}
+
+	// An init segment as ffmpeg writes it: ftyp and a moov without pssh
+	ftyp := []byte("\x00\x00\x00\x10ftypiso6\x00\x00\x00\x00")
+	moov := []byte("\x00\x00\x00\x10moov\x00\x00\x00\x08mvex")
+	if err := os.WriteFile(filepath.Join(dir, cencInitSegment), append(ftyp, moov...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	playlist := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.000000,
+segment000.m4s
+#EXTINF:2.500000,
+segment001.m4s
+#EXT-X-ENDLIST
+`
+	if err := os.WriteFile(filepath.Join(dir, "playlist.m3u8"), []byte(playlist), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := packageCENC(dir, key); err != nil {
+		t.Fatalf("packageCENC() = %v", err)
+	}
+
+	initSegment, err := os.ReadFile(filepath.Join(dir, cencInitSegment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pssh, _ := keys.PSSH(keys.ClearKeySystemID, []string{key.ID}, nil)
+	wantMoov := binary.BigEndian.AppendUint32(nil, uint32(len(moov)+len(pssh)))
+	wantMoov = append(append(wantMoov, moov[4:]...), pssh...)
+	if want := append(ftyp, wantMoov...); !bytes.Equal(initSegment, want) {
+		t.Errorf("init segment =\n%x\nwant\n%x", initSegment, want)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "playlist.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-KEY:METHOD=SAMPLE-AES-CTR,URI="better-media-key:0123456789abcdef0123456789abcdef",KEYFORMAT="org.w3.clearkey",KEYFORMATVERSIONS="1"
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4,
+segment000.m4s
+#EXTINF:2.5,
+segment001.m4s
+#EXT-X-ENDLIST
+`
+	if string(got) != want {
+		t.Errorf("playlist =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,124 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Queue weights decide how often each priority is served, but within a queue asynq is
+// FIFO, so one tenant submitting thousands of videos would still occupy every worker.
+// TenantLimiter caps how many tasks that download and encode a source a single tenant may
+// run at once across the whole cluster. Tasks over the cap fail with errTenantThrottled,
+// which asynq retries after a short delay without counting it as a failure, so they keep
+// their task ID and other tenants' tasks behind them run in the meantime.
+
+// errTenantThrottled defers a task of a tenant at its limit, see IsFailure and RetryDelay
+var errTenantThrottled = errors.New("tenant is at its limit of active encodes")
+
+// IsFailure tells asynq which errors use up a task's retries. Throttled tasks did not run.
+func IsFailure(err error) bool {
+	return !errors.Is(err, errTenantThrottled)
+}
+
+type TenantLimiter struct {
+	rdb       *redis.Client
+	maxActive int
+	lease     time.Duration
+	taskTypes map[string]bool
+}
+
+func NewTenantLimiter(rdb *redis.Client, maxActive int, lease time.Duration, taskTypes ...string) *TenantLimiter {
+	types := map[string]bool{}
+	for _, t := range taskTypes {
+		types[t] = true
+	}
+	return &TenantLimiter{rdb: rdb, maxActive: maxActive, lease: lease, taskTypes: types}
+}
+
+func tenantActiveKey(tenantID string) string {
+	return "better-media:tenant:" + tenantID + ":active"
+}
+
+// Active encodes are a sorted set of task IDs scored by lease expiry, so slots held by a
+// worker that crashed free up on their own. Running tasks extend their lease.
+var acquireTenantSlotScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZSCORE', KEYS[1], ARGV[4]) then
+	return 1
+end
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return 1
+`)
+
+func (l *TenantLimiter) Middleware(next asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if l.maxActive <= 0 || !l.taskTypes[t.Type()] {
+			return next.ProcessTask(ctx, t)
+		}
+
+		var tenant struct {
+			TenantID string `json:"tenant_id"`
+		}
+		if err := json.Unmarshal(t.Payload(), &tenant); err != nil || tenant.TenantID == "" {
+			return next.ProcessTask(ctx, t)
+		}
+
+		taskID, _ := asynq.GetTaskID(ctx)
+		key := tenantActiveKey(tenant.TenantID)
+		now := time.Now()
+
+		ok, err := acquireTenantSlotScript.Run(ctx, l.rdb, []string{key},
+			now.UnixMilli(), now.Add(l.lease).UnixMilli(), l.maxActive, taskID, l.lease.Milliseconds(),
+		).Bool()
+		if err != nil {
+			// Fairness is best effort, never block encoding on it
+			log.Printf("WARN tenant limiter unavailable, running %s without a slot: %v", taskID, err)
+			return next.ProcessTask(ctx, t)
+		}
+
+		if !ok {
+			log.Printf("Tenant %s is at its limit of %d active encode(s), deferred %s %s", tenant.TenantID, l.maxActive, t.Type(), taskID)
+			return fmt.Errorf("%w: tenant %s", errTenantThrottled, tenant.TenantID)
+		}
+		defer l.rdb.ZRem(context.WithoutCancel(ctx), key, taskID)
+
+		// A failed refresh only risks letting the tenant over its limit, so it never stops
+		// the encode
+		_, stop := keepAlive(ctx, l.lease/3, func(ctx context.Context) error {
+			if err := l.extend(ctx, key, taskID); err != nil {
+				log.Printf("WARN failed to extend the tenant slot of %s: %v", taskID, err)
+			}
+			return nil
+		})
+		defer stop()
+
+		return next.ProcessTask(ctx, t)
+	})
+}
+
+// extend moves the lease of a slot a full lease from now, if the slot still exists
+func (l *TenantLimiter) extend(ctx context.Context, key, taskID string) error {
+	pipe := l.rdb.TxPipeline()
+	pipe.ZAddXX(ctx, key, redis.Z{Score: float64(time.Now().Add(l.lease).UnixMilli()), Member: taskID})
+	pipe.PExpire(ctx, key, l.lease)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// throttledRetryDelay spreads deferred tasks out, so a large backlog does not wake up in
+// lockstep
+func throttledRetryDelay() time.Duration {
+	return 5*time.Second + rand.N(10*time.Second)
+}
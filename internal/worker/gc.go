@@ -0,0 +1,163 @@
+package worker
+
+import (
+	"better-media/internal/catalog"
+	"better-media/internal/keys"
+	"better-media/internal/storage"
+	"better-media/pkg/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Garbage collection looks at every [videoId]/ prefix of the bucket. A video that was
+// never encoded successfully has no catalog record, and once nothing has been written to
+// its prefix for a while and no job is queued or running for it, it is garbage:
+//
+//	abandoned  a source was uploaded but no job for it ever succeeded
+//	orphaned   output exists without a source or a catalog record
+//
+// Videos encoded before the catalog existed have no record either, run in dry-run mode
+// first and check the report.
+
+const (
+	defaultGarbageAge = 48 * time.Hour
+	// maxGarbageReport bounds the number of prefixes listed in the task result
+	maxGarbageReport = 1000
+)
+
+type GarbagePrefix struct {
+	VideoID      string    `json:"video_id"`
+	Objects      int       `json:"objects"`
+	Bytes        int64     `json:"bytes"`
+	LastModified time.Time `json:"last_modified"`
+
+	hasSource bool
+}
+
+type GarbageReport struct {
+	DryRun         bool            `json:"dry_run"`
+	Scanned        int             `json:"scanned"`
+	Abandoned      []GarbagePrefix `json:"abandoned"`
+	Orphaned       []GarbagePrefix `json:"orphaned"`
+	Deleted        int             `json:"deleted"`
+	ReclaimedBytes int64           `json:"reclaimed_bytes"`
+}
+
+func (processor *TaskProcessor) HandleCollectGarbageTask(ctx context.Context, t *asynq.Task) error {
+	var payload models.GarbageCollectionPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+	maxAge := defaultGarbageAge
+	if payload.OlderThanHours > 0 {
+		maxAge = time.Duration(payload.OlderThanHours) * time.Hour
+	}
+
+	report, err := processor.collectGarbage(ctx, time.Now().Add(-maxAge), payload.DryRun)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Garbage collection (dry_run=%t): scanned %d video(s), %d abandoned, %d orphaned, deleted %d, reclaimed %d bytes",
+		report.DryRun, report.Scanned, len(report.Abandoned), len(report.Orphaned), report.Deleted, report.ReclaimedBytes)
+
+	if len(report.Abandoned) > maxGarbageReport {
+		report.Abandoned = report.Abandoned[:maxGarbageReport]
+	}
+	if len(report.Orphaned) > maxGarbageReport {
+		report.Orphaned = report.Orphaned[:maxGarbageReport]
+	}
+	result, _ := json.Marshal(report)
+	t.ResultWriter().Write(result)
+	return nil
+}
+
+func (processor *TaskProcessor) collectGarbage(ctx context.Context, cutoff time.Time, dryRun bool) (*GarbageReport, error) {
+	prefixes := map[string]*GarbagePrefix{}
+
+	err := processor.S3Client.WalkObjects(ctx, "", func(obj storage.Object) error {
+		videoID, rest, ok := strings.Cut(obj.Key, "/")
+		// Keys are collected along with the video they belong to
+		if !ok || videoID == "" || videoID+"/" == keys.Prefix {
+			return nil
+		}
+
+		prefix := prefixes[videoID]
+		if prefix == nil {
+			prefix = &GarbagePrefix{VideoID: videoID}
+			prefixes[videoID] = prefix
+		}
+		prefix.Objects++
+		prefix.Bytes += obj.Size
+		if obj.LastModified.After(prefix.LastModified) {
+			prefix.LastModified = obj.LastModified
+		}
+		if strings.HasPrefix(rest, "source/") {
+			prefix.hasSource = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bucket: %w", err)
+	}
+
+	report := &GarbageReport{
+		DryRun:    dryRun,
+		Scanned:   len(prefixes),
+		Abandoned: []GarbagePrefix{},
+		Orphaned:  []GarbagePrefix{},
+	}
+
+	for videoID, prefix := range prefixes {
+		if prefix.LastModified.After(cutoff) {
+			continue
+		}
+
+		_, err := processor.Catalog.Get(ctx, videoID)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, catalog.ErrVideoNotFound) {
+			return nil, fmt.Errorf("failed to look up %s: %w", videoID, err)
+		}
+
+		active, err := processor.Jobs.HasActiveJobs(ctx, videoID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up jobs of %s: %w", videoID, err)
+		}
+		if active {
+			continue
+		}
+
+		if prefix.hasSource {
+			report.Abandoned = append(report.Abandoned, *prefix)
+		} else {
+			report.Orphaned = append(report.Orphaned, *prefix)
+		}
+
+		if dryRun {
+			continue
+		}
+		if err := processor.S3Client.DeletePrefix(ctx, videoID+"/"); err != nil {
+			log.Printf("[%s] WARN failed to delete garbage prefix: %v", videoID, err)
+			continue
+		}
+		if err := processor.S3Client.DeletePrefix(ctx, keys.VideoPrefix(videoID)); err != nil {
+			log.Printf("[%s] WARN failed to delete the keys of garbage prefix: %v", videoID, err)
+		}
+		if err := processor.Catalog.ForgetUpload(ctx, videoID); err != nil {
+			log.Printf("[%s] WARN failed to forget the upload of garbage prefix: %v", videoID, err)
+		}
+		report.Deleted++
+		report.ReclaimedBytes += prefix.Bytes
+	}
+
+	return report, nil
+}
@@ -0,0 +1,46 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// keepAlive calls refresh every interval while a task holds something in Redis that expires
+// on its own, such as a tenant slot or a video lock. The returned context is canceled as
+// soon as a refresh fails; stop ends the heartbeat and returns that failure, if any.
+func keepAlive(ctx context.Context, interval time.Duration, refresh func(context.Context) error) (context.Context, func() error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+
+	var failure error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := refresh(ctx); err != nil {
+					failure = err
+					cancel(err)
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, func() error {
+		close(done)
+		wg.Wait()
+		cancel(nil)
+		return failure
+	}
+}
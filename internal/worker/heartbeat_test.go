@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveRefreshes(t *testing.T) {
+	var beats atomic.Int32
+	ctx, stop := keepAlive(context.Background(), 5*time.Millisecond, func(context.Context) error {
+		beats.Add(1)
+		return nil
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	if err := stop(); err != nil {
+		t.Fatalf("stop() = %v", err)
+	}
+	if n := beats.Load(); n < 3 {
+		t.Errorf("refreshed %d times in 50ms, want at least 3", n)
+	}
+	if ctx.Err() == nil {
+		t.Error("context still alive after stop")
+	}
+
+	n := beats.Load()
+	time.Sleep(20 * time.Millisecond)
+	if beats.Load() != n {
+		t.Error("refreshed after stop")
+	}
+}
+
+func TestKeepAliveCancelsOnFailure(t *testing.T) {
+	lost := errors.New("lock lost")
+	var beats atomic.Int32
+	ctx, stop := keepAlive(context.Background(), 5*time.Millisecond, func(context.Context) error {
+		if beats.Add(1) == 2 {
+			return lost
+		}
+		return nil
+	})
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not canceled after a failed refresh")
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, lost) {
+		t.Errorf("context.Cause() = %v, want %v", cause, lost)
+	}
+	if err := stop(); !errors.Is(err, lost) {
+		t.Errorf("stop() = %v, want %v", err, lost)
+	}
+	if n := beats.Load(); n != 2 {
+		t.Errorf("refreshed %d times, want 2", n)
+	}
+}
@@ -0,0 +1,94 @@
+package worker
+
+import (
+	"better-media/internal/jobs"
+	"better-media/pkg/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+)
+
+// Maintenance tasks are enqueued on a schedule by cmd/scheduler and run on the bulk queue,
+// so they only use capacity that customer jobs leave free.
+
+const defaultReencodeLimit = 100
+
+// HandleReencodeOutdatedTask queues a new job for every cataloged video encoded with an
+// older ProfileVersion, using the request of its last successful job.
+func (processor *TaskProcessor) HandleReencodeOutdatedTask(ctx context.Context, t *asynq.Task) error {
+	var payload models.ReencodeOutdatedPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+	if payload.Limit <= 0 {
+		payload.Limit = defaultReencodeLimit
+	}
+
+	videos, err := processor.Catalog.Outdated(ctx, models.ProfileVersion, payload.Limit)
+	if err != nil {
+		return fmt.Errorf("failed to list outdated videos: %w", err)
+	}
+
+	var queued, skipped int
+	for _, video := range videos {
+		req := video.Request
+		req.JobID = uuid.New().String()
+		req.Priority = models.QueueBulk
+		req.WebhookURL = ""
+
+		err := processor.enqueueJob(ctx, req)
+		if errors.Is(err, asynq.ErrTaskIDConflict) {
+			// Already being encoded, by a customer or a previous run
+			skipped++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to queue re-encode of %s: %w", video.ID, err)
+		}
+		queued++
+	}
+
+	log.Printf("Queued %d re-encode(s) of videos older than profile version %d, %d already queued", queued, models.ProfileVersion, skipped)
+
+	result, _ := json.Marshal(map[string]int{"queued": queued, "skipped": skipped, "profile_version": models.ProfileVersion})
+	t.ResultWriter().Write(result)
+	return nil
+}
+
+// enqueueJob queues the first task of a new job the way the API does
+func (processor *TaskProcessor) enqueueJob(ctx context.Context, req models.VideoEncodingPayload) error {
+	queue, err := models.QueueForPriority(req.Priority)
+	if err != nil {
+		return err
+	}
+
+	task, err := models.NewEncodingJobTask(req)
+	if err != nil {
+		return err
+	}
+	_, err = processor.AsynqClient.EnqueueContext(ctx, task,
+		asynq.MaxRetry(models.JobMaxRetry),
+		asynq.Queue(queue),
+		asynq.TaskID(req.EncodingTaskID()),
+		asynq.Retention(processor.ResultRetention),
+	)
+	if err != nil {
+		return err
+	}
+
+	request, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return processor.Jobs.Create(ctx, jobs.Job{
+		ID:       req.JobID,
+		VideoID:  req.VideoID,
+		TenantID: req.TenantID,
+		Request:  request,
+	})
+}
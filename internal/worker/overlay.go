@@ -0,0 +1,68 @@
+package worker
+
+import (
+	"better-media/pkg/models"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	defaultOverlayMargin = 0.03
+	defaultOverlayScale  = 0.1
+)
+
+// overlayPosition places the image (w x h) on the video (W x H), margin pixels from the edges
+func overlayPosition(position string, margin int) string {
+	switch position {
+	case models.OverlayTopLeft:
+		return fmt.Sprintf("x=%[1]d:y=%[1]d", margin)
+	case models.OverlayTopRight:
+		return fmt.Sprintf("x=W-w-%[1]d:y=%[1]d", margin)
+	case models.OverlayBottomLeft:
+		return fmt.Sprintf("x=%[1]d:y=H-h-%[1]d", margin)
+	case models.OverlayCenter:
+		return "x=(W-w)/2:y=(H-h)/2"
+	default:
+		return fmt.Sprintf("x=W-w-%[1]d:y=H-h-%[1]d", margin)
+	}
+}
+
+// overlayFilter is the filter graph of a rendition with an overlay: the source (input 0)
+// scaled to height, the image (input 1) burned into it, then the filters in after, if
+// any. Its output is labelled [v]. The image size and margin are worked out from the
+// height of the rendition rather than left to ffmpeg expressions, so rounding is the same
+// on every rung.
+func overlayFilter(overlay *models.Overlay, height int, after string) string {
+	margin := overlay.Margin
+	if margin == 0 {
+		margin = defaultOverlayMargin
+	}
+	scale := overlay.Scale
+	if scale == 0 {
+		scale = defaultOverlayScale
+	}
+	var graph strings.Builder
+	fmt.Fprintf(&graph, "[0:v]scale=-2:%d[base];", height)
+
+	fmt.Fprintf(&graph, "[1:v]scale=-2:%d,format=rgba", max(2, int(math.Round(float64(height)*scale))))
+	if overlay.Opacity > 0 && overlay.Opacity < 1 {
+		fmt.Fprintf(&graph, ",colorchannelmixer=aa=%g", overlay.Opacity)
+	}
+	graph.WriteString("[logo];")
+
+	// A single image is repeated for the whole video, see eof_action of the overlay filter
+	graph.WriteString("[base][logo]overlay=" + overlayPosition(overlay.Position, int(math.Round(float64(height)*margin))))
+	switch {
+	case overlay.End > 0:
+		fmt.Fprintf(&graph, ":enable='between(t,%g,%g)'", overlay.Start, overlay.End)
+	case overlay.Start > 0:
+		fmt.Fprintf(&graph, ":enable='gte(t,%g)'", overlay.Start)
+	}
+
+	if after != "" {
+		graph.WriteString("," + after)
+	}
+	graph.WriteString("[v]")
+	return graph.String()
+}
@@ -1,18 +1,23 @@
 package worker
 
 import (
+	"better-media/internal/keys"
 	"better-media/internal/storage"
+	"better-media/pkg/m3u8"
 	"better-media/pkg/models"
 	"bytes"
 	"context"
 	"fmt"
 	"log"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	fluentffmpeg "github.com/modfy/fluent-ffmpeg"
 )
@@ -35,19 +40,38 @@ type EncodingPipeline struct {
 	TempDir            string
 	DownloadedFilePath string
 	EncodedOutputPath  string
+	// OverlayPath is the downloaded image of Payload.Overlay
+	OverlayPath string
+
+	// Resources is shared with every other pipeline in the process, nil means unlimited
+	Resources *Resources
+	// Keys stores the keys of encrypted renditions, nil when encryption is not configured
+	Keys        *keys.Store
+	releaseDisk func()
+
+	// result describes what the pipeline produced so far, renditions encode concurrently
+	resultMu sync.Mutex
+	result   models.EncodingResult
 }
 
-func NewEncodingPipeline(p models.VideoEncodingPayload) (*EncodingPipeline, error) {
-	tempDir, err := os.MkdirTemp("", "media-*-"+p.VideoID)
+func NewEncodingPipeline(p models.VideoEncodingPayload, resources *Resources) (*EncodingPipeline, error) {
+	tempDir, err := os.MkdirTemp(resources.TempDir(), "media-*-"+p.VideoID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temp dir: %w", err)
 	}
 
 	return &EncodingPipeline{
 		Payload:            p,
+		Resources:          resources,
 		TempDir:            tempDir,
 		DownloadedFilePath: filepath.Join(tempDir, p.InputFile),
 		EncodedOutputPath:  filepath.Join(tempDir, "encoded"),
+		result: models.EncodingResult{
+			JobID:    p.JobID,
+			VideoID:  p.VideoID,
+			Encoder:  videoEncoder,
+			StagesMs: map[string]int64{},
+		},
 	}, nil
 }
 
@@ -70,6 +94,7 @@ func (p *EncodingPipeline) Run(ctx context.Context, s3c *storage.S3Client) error
 	if err := p.Upload(ctx, s3c); err != nil {
 		return fmt.Errorf("failed to upload encoded files: %w", err)
 	}
+	p.result.OutputKeys = append(p.result.OutputKeys, filepath.Join(p.Payload.VideoID, "hls", "master.m3u8"))
 
 	log.Printf("[%s] Encoding pipeline completed successfully.\n", p.Payload.VideoID)
 
@@ -78,13 +103,38 @@ func (p *EncodingPipeline) Run(ctx context.Context, s3c *storage.S3Client) error
 
 func (p *EncodingPipeline) Download(ctx context.Context, s3c *storage.S3Client) error {
 	log.Printf("[%s] Stage [1/5]: Downloading from S3...\n", p.Payload.VideoID)
+	defer p.track("download")()
+
 	objectKey := filepath.Join(p.Payload.VideoID, "source", p.Payload.InputFile)
-	log.Printf("Attempting to download object: %s", objectKey)
-	return s3c.DownloadFile(ctx, objectKey, p.DownloadedFilePath)
+
+	size, err := s3c.ObjectSize(ctx, objectKey)
+	if err != nil {
+		return fmt.Errorf("failed to stat source: %w", err)
+	}
+
+	release, err := p.Resources.ReserveDisk(size)
+	if err != nil {
+		return err
+	}
+	p.releaseDisk = release
+
+	log.Printf("Attempting to download object: %s (%d bytes)", objectKey, size)
+	if err := s3c.DownloadFile(ctx, objectKey, p.DownloadedFilePath); err != nil {
+		return err
+	}
+
+	if p.Payload.Overlay != nil {
+		p.OverlayPath = filepath.Join(p.TempDir, "overlay"+filepath.Ext(p.Payload.Overlay.Image))
+		if err := s3c.DownloadFile(ctx, p.Payload.Overlay.Image, p.OverlayPath); err != nil {
+			return fmt.Errorf("failed to download overlay %s: %w", p.Payload.Overlay.Image, err)
+		}
+	}
+	return nil
 }
 
 func (p *EncodingPipeline) Probe() error {
 	log.Printf("[%s] Stage [2/5]: Probing input file...\n", p.Payload.VideoID)
+	defer p.track("probe")()
 
 	data, err := fluentffmpeg.Probe(p.DownloadedFilePath)
 
@@ -130,15 +180,9 @@ func (p *EncodingPipeline) Probe() error {
 
 }
 
-type completedRendition struct {
-	Height       int
-	Bandwidth    int
-	PlaylistPath string
-}
-
-func (p *EncodingPipeline) Encode(ctx context.Context, s3c *storage.S3Client) error {
-	log.Printf("[%s] Stage [3/5]: Encoding...\n", p.Payload.VideoID)
-
+// RenditionHeights returns the ladder to produce for the probed source: every requested
+// resolution that does not upscale, plus the source height itself.
+func (p *EncodingPipeline) RenditionHeights() ([]int, error) {
 	var renditionsToEncode []int
 	for _, res := range p.Payload.Resolutions {
 		if res <= p.SourceInfo.Height {
@@ -161,7 +205,24 @@ func (p *EncodingPipeline) Encode(ctx context.Context, s3c *storage.S3Client) er
 	sort.Ints(renditionsToEncode)
 
 	if len(renditionsToEncode) == 0 {
-		return fmt.Errorf("no renditions to produce for source height %d", p.SourceInfo.Height)
+		return nil, fmt.Errorf("no renditions to produce for source height %d", p.SourceInfo.Height)
+	}
+
+	return renditionsToEncode, nil
+}
+
+type completedRendition struct {
+	Height       int
+	Bandwidth    int
+	PlaylistPath string
+}
+
+func (p *EncodingPipeline) Encode(ctx context.Context, s3c *storage.S3Client) error {
+	log.Printf("[%s] Stage [3/5]: Encoding...\n", p.Payload.VideoID)
+
+	renditionsToEncode, err := p.RenditionHeights()
+	if err != nil {
+		return err
 	}
 
 	var wg sync.WaitGroup // this is for encoding goroutines
@@ -223,6 +284,7 @@ func (p *EncodingPipeline) Encode(ctx context.Context, s3c *storage.S3Client) er
 
 func (p *EncodingPipeline) Upload(ctx context.Context, s3c *storage.S3Client) error {
 	log.Printf("[%s] Stage [4/5]: Uploading to S3...\n", p.Payload.VideoID)
+	defer p.track("upload")()
 
 	return filepath.Walk(p.EncodedOutputPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -243,6 +305,10 @@ func (p *EncodingPipeline) Upload(ctx context.Context, s3c *storage.S3Client) er
 			if err := s3c.UploadFile(ctx, path, objectKey); err != nil {
 				return fmt.Errorf("failed to upload %s: %w", info.Name(), err)
 			}
+
+			p.resultMu.Lock()
+			p.result.OutputKeys = append(p.result.OutputKeys, objectKey)
+			p.resultMu.Unlock()
 		}
 		return nil
 	})
@@ -260,84 +326,208 @@ func (p *EncodingPipeline) EncodeRendition(ctx context.Context, height int) erro
 	audioBitrate := chooseAudioBitrate(height)
 	videoBitrate := chooseVideoBitrate(height)
 
-	args := []string{
-		"-hide_banner", "-y",
-		"-i", p.DownloadedFilePath,
-		"-c:v", "h264_videotoolbox",
-		"-b:v", videoBitrate,
-		"-profile:v", "main",
-		"-pix_fmt", "yuv420p",
-		"-vf", fmt.Sprintf("scale=-2:%d", height),
+	threads, release, err := p.Resources.AcquireEncode(ctx)
+	if err != nil {
+		return fmt.Errorf("failed waiting for an encoder slot: %w", err)
 	}
+	defer release()
+
+	// Common encryption happens in the muxer, so the key has to exist before the encode
+	var cencKey *keys.Key
+	if p.Payload.Encryption != nil && p.Payload.Encryption.Method == models.EncryptionCENC {
+		if p.Keys == nil {
+			return errKeysNotConfigured
+		}
+		key, err := p.Keys.Create(ctx, p.Payload.VideoID)
+		if err != nil {
+			return fmt.Errorf("failed to create the key of %dp: %w", height, err)
+		}
+		cencKey = &key
+	}
+
+	// A forensically watermarked rendition is encoded once per mark, with keyframes forced
+	// on the segment grid so that the A and B segments line up
+	variants := []struct{ dir, filter string }{{renditionDir, ""}}
+	if p.Payload.ForensicWatermark {
+		variants = []struct{ dir, filter string }{
+			{renditionDir, forensicMarks[0]},
+			{filepath.Join(renditionDir, models.ForensicVariantDir), forensicMarks[1]},
+		}
+	}
+
+	done := p.track(fmt.Sprintf("encode_%dp", height))
+	for _, variant := range variants {
+		if err := os.MkdirAll(variant.dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create rendition directory %s: %w", variant.dir, err)
+		}
+
+		args := []string{
+			"-hide_banner", "-y",
+			"-i", p.DownloadedFilePath,
+		}
+		if p.OverlayPath != "" {
+			args = append(args, "-i", p.OverlayPath)
+		}
+		args = append(args,
+			"-c:v", videoEncoder,
+			"-b:v", videoBitrate,
+			"-profile:v", "main",
+			"-pix_fmt", "yuv420p",
+		)
+
+		// An overlay takes a filter graph with the image as a second input, whose output
+		// replaces the video of the source
+		videoMap := "0:v:0"
+		if p.OverlayPath != "" {
+			args = append(args, "-filter_complex", overlayFilter(p.Payload.Overlay, height, variant.filter))
+			videoMap = "[v]"
+			if !p.SourceInfo.HasAudio {
+				args = append(args, "-map", videoMap)
+			}
+		} else {
+			filter := fmt.Sprintf("scale=-2:%d", height)
+			if variant.filter != "" {
+				filter += "," + variant.filter
+			}
+			args = append(args, "-vf", filter)
+		}
+		if p.Payload.ForensicWatermark {
+			args = append(args, "-force_key_frames", "expr:gte(t,n_forced*4)")
+		}
+
+		if threads > 0 {
+			args = append(args, "-threads", fmt.Sprint(threads))
+		}
+
+		if p.SourceInfo.HasAudio {
+			args = append(args,
+				"-c:a", "aac",
+				"-b:a", audioBitrate,
+				"-map", videoMap, // Video
+				"-map", "0:a:0", // Audio
+			)
+		}
 
-	if p.SourceInfo.HasAudio {
 		args = append(args,
-			"-c:a", "aac",
-			"-b:a", audioBitrate,
-			"-map", "0:v:0", // Video
-			"-map", "0:a:0", // Audio
+			"-f", "hls",
+			"-hls_time", "4", // HLS TIME CHUNK DURATION
+			"-hls_playlist_type", "vod",
+			"-hls_list_size", "0",
 		)
+		if cencKey != nil {
+			args = append(args, cencSegmentArgs(variant.dir, *cencKey)...)
+		} else {
+			args = append(args, "-hls_segment_filename", filepath.Join(variant.dir, "segment%03d.ts"))
+		}
+		args = append(args, filepath.Join(variant.dir, "playlist.m3u8"))
+
+		cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		log.Printf("[%s] Encoding %dp: ffmpeg %s\n", p.Payload.VideoID, height, strings.Join(args, " "))
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("ffmpeg failed for %dp: %w\n--- FFmpeg output ---\n%s", height, err, stderr.String())
+		}
 	}
+	done()
 
-	args = append(args,
-		"-f", "hls",
-		"-hls_time", "4", // HLS TIME CHUNK DURATION
-		"-hls_playlist_type", "vod",
-		"-hls_list_size", "0",
-		"-hls_segment_filename", filepath.Join(renditionDir, "segment%03d.ts"),
-		filepath.Join(renditionDir, "playlist.m3u8"),
-	)
+	if p.Payload.ForensicWatermark {
+		if err := checkForensicVariants(renditionDir); err != nil {
+			return fmt.Errorf("failed to watermark %dp: %w", height, err)
+		}
+	}
 
-	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	log.Printf("[%s] Encoding %dp: ffmpeg %s\n", p.Payload.VideoID, height, strings.Join(args, " "))
+	switch {
+	case cencKey != nil:
+		if err := packageCENC(renditionDir, *cencKey); err != nil {
+			return fmt.Errorf("failed to package %dp: %w", height, err)
+		}
+	case p.Payload.Encryption != nil:
+		if err := encryptRendition(ctx, p.Keys, renditionDir, p.Payload.VideoID, p.Payload.Encryption); err != nil {
+			return fmt.Errorf("failed to encrypt %dp: %w", height, err)
+		}
+	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("ffmpeg failed for %dp: %w\n--- FFmpeg output ---\n%s", height, err, stderr.String())
+	rendition, err := measureRendition(renditionDir, p.Payload.VideoID, height)
+	if err != nil {
+		return fmt.Errorf("failed to measure %dp: %w", height, err)
 	}
+	p.resultMu.Lock()
+	p.result.Renditions = append(p.result.Renditions, rendition)
+	p.resultMu.Unlock()
 
-	log.Printf("[%s] Finished encoding %dp\n", p.Payload.VideoID, height)
+	log.Printf("[%s] Finished encoding %dp (%d bps measured)\n", p.Payload.VideoID, height, rendition.MeasuredBitrate)
 	return nil
 
 }
 
 func (p *EncodingPipeline) updateMasterPlaylist(ctx context.Context, s3c *storage.S3Client, hlsBaseDir string, renditions []completedRendition) error {
+	return writeMasterPlaylist(ctx, s3c, p.Payload.VideoID, hlsBaseDir, renditions)
+}
+
+func writeMasterPlaylist(ctx context.Context, s3c *storage.S3Client, videoID, hlsBaseDir string, renditions []completedRendition) error {
 	masterPlaylistPath := filepath.Join(hlsBaseDir, "master.m3u8")
 
-	log.Printf("[%s] Updating master playlist at %s\n", p.Payload.VideoID, masterPlaylistPath)
+	log.Printf("[%s] Updating master playlist at %s\n", videoID, masterPlaylistPath)
 
 	sort.Slice(renditions, func(i, j int) bool {
 		return renditions[i].Height < renditions[j].Height
 	})
 
-	var content strings.Builder
-	content.WriteString("#EXTM3U\n")
-	content.WriteString("#EXT-X-VERSION:3\n")
-
+	master := &m3u8.MasterPlaylist{Version: 3}
 	for _, r := range renditions {
 		// TODO: HERE IS STILL USING HARDCODED 16:9 RATIO
 		width := (r.Height * 16) / 9
-		content.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n", r.Bandwidth, width, r.Height))
-		content.WriteString(r.PlaylistPath + "\n")
+		master.Variants = append(master.Variants, m3u8.Variant{
+			URI:        r.PlaylistPath,
+			Bandwidth:  r.Bandwidth,
+			Resolution: &m3u8.Resolution{Width: width, Height: r.Height},
+		})
 	}
 
-	if err := os.WriteFile(masterPlaylistPath, []byte(content.String()), 0644); err != nil {
+	if err := os.WriteFile(masterPlaylistPath, master.Encode().Bytes(), 0644); err != nil {
 		return fmt.Errorf("failed to write master playlist: %w", err)
 	}
 
-	objectKey := filepath.Join(p.Payload.VideoID, "hls", "master.m3u8")
+	objectKey := filepath.Join(videoID, "hls", "master.m3u8")
 	if err := s3c.UploadFile(ctx, masterPlaylistPath, objectKey); err != nil {
 		return fmt.Errorf("failed to upload master playlist: %w", err)
 	}
 
-	log.Printf("[%s] Successfully updated and uploaded master playlist with %d rendition(s).\n", p.Payload.VideoID, len(renditions))
+	log.Printf("[%s] Successfully updated and uploaded master playlist with %d rendition(s).\n", videoID, len(renditions))
 	return nil
 
 }
 
+// track measures a stage of the pipeline, call the returned func when the stage is done
+func (p *EncodingPipeline) track(stage string) func() {
+	start := time.Now()
+	return func() {
+		p.resultMu.Lock()
+		defer p.resultMu.Unlock()
+		p.result.StagesMs[stage] = time.Since(start).Milliseconds()
+	}
+}
+
+// Result reports what the pipeline produced so far
+func (p *EncodingPipeline) Result() models.EncodingResult {
+	p.resultMu.Lock()
+	defer p.resultMu.Unlock()
+
+	result := p.result
+	result.Renditions = slices.Clone(p.result.Renditions)
+	result.OutputKeys = slices.Clone(p.result.OutputKeys)
+	result.StagesMs = maps.Clone(p.result.StagesMs)
+	slices.SortFunc(result.Renditions, func(a, b models.RenditionResult) int { return a.Height - b.Height })
+	return result
+}
+
 func (p *EncodingPipeline) Cleanup() error {
 	log.Println("Stage: Cleanup...")
+	if p.releaseDisk != nil {
+		p.releaseDisk()
+	}
 	if err := os.RemoveAll(p.TempDir); err != nil {
 		return fmt.Errorf("failed to remove temp dir %s: %w", p.TempDir, err)
 	}
@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Resources is shared by every task running in the worker process. asynq's concurrency only
+// bounds the number of tasks, while a single task can start several ffmpeg processes and
+// download sources of any size, so CPU and temp disk are budgeted here instead.
+type Resources struct {
+	ffmpegThreads    *semaphore.Weighted
+	totalThreads     int64
+	threadsPerEncode int64
+
+	tempDir        string
+	diskMultiplier float64
+	minFreeDisk    int64
+
+	mu           sync.Mutex
+	diskReserved int64
+}
+
+func NewResources(cfg Config) *Resources {
+	total := int64(max(1, cfg.FFmpegThreads))
+	perEncode := min(int64(max(1, cfg.ThreadsPerEncode)), total)
+
+	tempDir := cfg.TempDir
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+
+	return &Resources{
+		ffmpegThreads:    semaphore.NewWeighted(total),
+		totalThreads:     total,
+		threadsPerEncode: perEncode,
+		tempDir:          tempDir,
+		diskMultiplier:   max(1, cfg.DiskMultiplier),
+		minFreeDisk:      cfg.MinFreeDisk,
+	}
+}
+
+// AcquireEncode blocks until an ffmpeg encode may start and returns the number of threads
+// it may use. release must be called once ffmpeg has exited.
+// A nil *Resources does not limit anything.
+func (r *Resources) AcquireEncode(ctx context.Context) (threads int, release func(), err error) {
+	if r == nil {
+		return 0, func() {}, nil
+	}
+
+	if err := r.ffmpegThreads.Acquire(ctx, r.threadsPerEncode); err != nil {
+		return 0, nil, err
+	}
+	return int(r.threadsPerEncode), func() { r.ffmpegThreads.Release(r.threadsPerEncode) }, nil
+}
+
+// ReserveDisk reserves room in the temp dir for a job whose source is sourceSize bytes.
+// It fails without blocking when the disk cannot fit the job next to the reservations of
+// jobs already running, so asynq can retry it later (possibly on another worker).
+func (r *Resources) ReserveDisk(sourceSize int64) (release func(), err error) {
+	if r == nil {
+		return func() {}, nil
+	}
+
+	need := int64(float64(sourceSize) * r.diskMultiplier)
+
+	free, err := freeDiskBytes(r.tempDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check free disk in %s: %w", r.tempDir, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Running jobs have not necessarily written everything they reserved yet, so the
+	// outstanding reservations are taken off what the filesystem reports as free
+	available := free - r.diskReserved - r.minFreeDisk
+	if need > available {
+		return nil, fmt.Errorf("not enough temp disk: need %d bytes, %d available (%d free, %d reserved)", need, max(0, available), free, r.diskReserved)
+	}
+
+	r.diskReserved += need
+	log.Printf("Reserved %d bytes of temp disk (%d reserved in total)", need, r.diskReserved)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			r.diskReserved -= need
+			r.mu.Unlock()
+		})
+	}, nil
+}
+
+func (r *Resources) TempDir() string {
+	if r == nil {
+		return ""
+	}
+	return r.tempDir
+}
@@ -0,0 +1,139 @@
+package worker
+
+import (
+	"better-media/pkg/m3u8"
+	"better-media/pkg/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+const videoEncoder = "h264_videotoolbox"
+
+// measureRendition reads an encoded HLS rendition back from disk and reports what was
+// actually produced, rather than what the encoder was asked for.
+func measureRendition(renditionDir, videoID string, height int) (models.RenditionResult, error) {
+	result := models.RenditionResult{
+		Height:        height,
+		Playlist:      filepath.Join(videoID, "hls", fmt.Sprintf("%dp", height), "playlist.m3u8"),
+		TargetBitrate: getBandwidthForHeight(height),
+	}
+
+	playlist, err := os.Open(filepath.Join(renditionDir, "playlist.m3u8"))
+	if err != nil {
+		return result, err
+	}
+	defer playlist.Close()
+
+	media, err := m3u8.DecodeMedia(playlist)
+	if err != nil {
+		return result, err
+	}
+
+	result.DurationSeconds = media.Duration()
+	for _, segment := range media.Segments {
+		info, err := os.Stat(filepath.Join(renditionDir, segment.URI))
+		if err != nil {
+			return result, err
+		}
+		result.Segments++
+		result.Bytes += info.Size()
+	}
+
+	if result.DurationSeconds > 0 {
+		result.MeasuredBitrate = int(float64(result.Bytes*8) / result.DurationSeconds)
+	}
+	return result, nil
+}
+
+// writeResult stores the result of a task for the job API. Results are informational, so
+// failing to store one does not fail the task.
+func writeResult(t *asynq.Task, result models.EncodingResult) []byte {
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("[%s] WARN failed to encode task result: %v", result.VideoID, err)
+		return nil
+	}
+	if _, err := t.ResultWriter().Write(data); err != nil {
+		log.Printf("[%s] WARN failed to write task result: %v", result.VideoID, err)
+	}
+	return data
+}
+
+// recordResult writes the result of a task and attaches it to the node of its job, so the
+// final task can report on the whole job.
+func (processor *TaskProcessor) recordResult(ctx context.Context, t *asynq.Task, node string, result models.EncodingResult) {
+	data := writeResult(t, result)
+	if data == nil {
+		return
+	}
+	if err := processor.Jobs.SetResult(ctx, result.JobID, node, data); err != nil {
+		log.Printf("[%s] WARN failed to attach %s result to job %s: %v", result.VideoID, node, result.JobID, err)
+	}
+}
+
+// jobResult merges the results recorded by every node of a job with the result of the
+// current, final task. Stages are prefixed with the node that ran them.
+func (processor *TaskProcessor) jobResult(ctx context.Context, final models.EncodingResult, finalNode string) models.EncodingResult {
+	merged := models.EncodingResult{
+		JobID:    final.JobID,
+		VideoID:  final.VideoID,
+		Encoder:  videoEncoder,
+		StagesMs: map[string]int64{},
+	}
+
+	results := map[string]models.EncodingResult{}
+	job, err := processor.Jobs.Get(ctx, final.JobID)
+	if err != nil {
+		log.Printf("[%s] WARN failed to read results of job %s: %v", final.VideoID, final.JobID, err)
+	} else {
+		for node, data := range job.Results {
+			var result models.EncodingResult
+			if err := json.Unmarshal(data, &result); err == nil {
+				results[node] = result
+			}
+		}
+	}
+	results[finalNode] = final
+
+	for _, node := range slices.Sorted(maps.Keys(results)) {
+		result := results[node]
+		merged.Renditions = append(merged.Renditions, result.Renditions...)
+		merged.OutputKeys = append(merged.OutputKeys, result.OutputKeys...)
+		for stage, ms := range result.StagesMs {
+			merged.StagesMs[node+"."+stage] = ms
+		}
+	}
+
+	slices.SortFunc(merged.Renditions, func(a, b models.RenditionResult) int { return a.Height - b.Height })
+	slices.Sort(merged.OutputKeys)
+	merged.OutputKeys = slices.Compact(merged.OutputKeys)
+	return merged
+}
+
+// recordJobResult writes the result of the whole job with the final task of the job, and
+// attaches the final task's own result to its node.
+func (processor *TaskProcessor) recordJobResult(ctx context.Context, t *asynq.Task, node string, final models.EncodingResult) {
+	if data, err := json.Marshal(final); err == nil {
+		if err := processor.Jobs.SetResult(ctx, final.JobID, node, data); err != nil {
+			log.Printf("[%s] WARN failed to attach %s result to job %s: %v", final.VideoID, node, final.JobID, err)
+		}
+	}
+	writeResult(t, processor.jobResult(ctx, final, node))
+}
+
+// stageTimer measures stages for a result, call the returned func when the stage is done
+func stageTimer(stages map[string]int64, stage string) func() {
+	start := time.Now()
+	return func() {
+		stages[stage] = time.Since(start).Milliseconds()
+	}
+}
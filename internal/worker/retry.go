@@ -0,0 +1,22 @@
+package worker
+
+import (
+	"better-media/internal/webhooks"
+	"better-media/pkg/models"
+	"errors"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// RetryDelay picks the backoff per task type. Throttled tasks come back shortly, webhook
+// deliveries wait for endpoints to recover, everything else uses asynq's default.
+func RetryDelay(n int, err error, t *asynq.Task) time.Duration {
+	if errors.Is(err, errTenantThrottled) {
+		return throttledRetryDelay()
+	}
+	if t.Type() == models.TaskDeliverWebhook {
+		return webhooks.RetryDelay(n)
+	}
+	return asynq.DefaultRetryDelayFunc(n, err, t)
+}
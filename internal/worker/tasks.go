@@ -1,24 +1,49 @@
 package worker
 
 import (
+	"better-media/internal/catalog"
+	"better-media/internal/jobs"
+	"better-media/internal/keys"
 	"better-media/internal/storage"
+	"better-media/internal/webhooks"
 	"better-media/pkg/models"
 	"context"
 	"encoding/json"
 	"log"
+	"time"
 
 	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
 )
 
 // The primary motivation for this is to simplify the dependency injection during task processing
 // This allows us to pass the S3 client from the parent function, and we dont need to destructure the handler
 // Refer to how we pass s3 on the main function in cmd/worker/main.go
 type TaskProcessor struct {
-	S3Client *storage.S3Client
+	S3Client    *storage.S3Client
+	AsynqClient *asynq.Client
+	Redis       *redis.Client
+	Jobs        *jobs.Graph
+	Catalog     *catalog.Catalog
+	Resources   *Resources
+	Webhooks    *webhooks.Publisher
+	// Keys stores the keys of encrypted renditions, nil when encryption is not configured
+	Keys *keys.Store
+
+	// ResultRetention keeps completed tasks and their results around for the job API
+	ResultRetention time.Duration
 }
 
-func NewTaskProcessor(s3c *storage.S3Client) *TaskProcessor {
-	return &TaskProcessor{S3Client: s3c}
+func NewTaskProcessor(s3c *storage.S3Client, asynqClient *asynq.Client, rdb *redis.Client, resources *Resources, publisher *webhooks.Publisher) *TaskProcessor {
+	return &TaskProcessor{
+		S3Client:    s3c,
+		AsynqClient: asynqClient,
+		Redis:       rdb,
+		Jobs:        jobs.NewGraph(rdb),
+		Catalog:     catalog.New(rdb),
+		Resources:   resources,
+		Webhooks:    publisher,
+	}
 }
 
 func (processor *TaskProcessor) HandleVideoEncodeTask(ctx context.Context, t *asynq.Task) error {
@@ -28,16 +53,18 @@ func (processor *TaskProcessor) HandleVideoEncodeTask(ctx context.Context, t *as
 	}
 	log.Printf("Starting pipeline for VideoID: %s", payload.VideoID)
 
-	pipeline, err := NewEncodingPipeline(payload)
+	pipeline, err := NewEncodingPipeline(payload, processor.Resources)
 	if err != nil {
 		log.Printf("!!! PIPELINE FAILED for VideoID %s: could not create pipeline: %v", payload.VideoID, err)
 		return err
 	}
+	pipeline.Keys = processor.Keys
 
 	if err := pipeline.Run(ctx, processor.S3Client); err != nil {
 		log.Printf("!!! PIPELINE FAILED for VideoID %s: %v", payload.VideoID, err)
 		return err
 	}
+	writeResult(t, pipeline.Result())
 
 	return nil
 }
@@ -0,0 +1,52 @@
+package worker
+
+import (
+	"better-media/pkg/m3u8"
+	"better-media/pkg/models"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// forensicMarks are the filters that tell the A and B variant of a segment apart: a faint
+// square in opposite corners, hardly noticeable while watching but easy to find in a
+// leaked copy. They are sized relative to the height, so every rendition carries them.
+var forensicMarks = [2]string{
+	"drawbox=x=ih*0.03:y=ih*0.03:w=ih*0.02:h=ih*0.02:color=white@0.15:t=fill",
+	"drawbox=x=iw-ih*0.05:y=ih*0.95:w=ih*0.02:h=ih*0.02:color=white@0.15:t=fill",
+}
+
+// checkForensicVariants makes sure the B segments of a rendition line up with its A
+// segments, so that the proxy can swap any of them, and removes the B playlist, which is
+// only needed for that check
+func checkForensicVariants(renditionDir string) error {
+	a, err := readMediaPlaylist(filepath.Join(renditionDir, "playlist.m3u8"))
+	if err != nil {
+		return err
+	}
+	bPath := filepath.Join(renditionDir, models.ForensicVariantDir, "playlist.m3u8")
+	b, err := readMediaPlaylist(bPath)
+	if err != nil {
+		return err
+	}
+
+	if len(a.Segments) != len(b.Segments) {
+		return fmt.Errorf("the A variant has %d segments, the B variant %d", len(a.Segments), len(b.Segments))
+	}
+	for i := range a.Segments {
+		if a.Segments[i].URI != b.Segments[i].URI || math.Abs(a.Segments[i].Duration-b.Segments[i].Duration) > 0.001 {
+			return fmt.Errorf("segment %d of the A and B variants differ", i)
+		}
+	}
+	return os.Remove(bPath)
+}
+
+func readMediaPlaylist(path string) (*m3u8.MediaPlaylist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return m3u8.DecodeMedia(file)
+}
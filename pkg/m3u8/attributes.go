@@ -0,0 +1,312 @@
+package m3u8
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// attributes is a parsed attribute list (RFC 8216 section 4.2). Every attribute the tag
+// reads is removed, so the ones left over can be checked or kept.
+type attributes struct {
+	names  []string
+	values map[string]string
+	quoted map[string]bool
+}
+
+func parseAttributes(list string) (*attributes, error) {
+	attrs := &attributes{values: map[string]string{}, quoted: map[string]bool{}}
+
+	for len(list) > 0 {
+		name, rest, ok := strings.Cut(list, "=")
+		if !ok {
+			return nil, fmt.Errorf("attribute %q has no value", list)
+		}
+		if !validAttributeName(name) {
+			return nil, fmt.Errorf("invalid attribute name %q", name)
+		}
+		if _, seen := attrs.values[name]; seen {
+			return nil, fmt.Errorf("duplicate attribute %s", name)
+		}
+
+		var value string
+		quoted := strings.HasPrefix(rest, `"`)
+		if quoted {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string in %s", name)
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+			if value == "" || strings.ContainsAny(value, "\" \t") {
+				return nil, fmt.Errorf("invalid value %q for %s", value, name)
+			}
+		}
+
+		if rest != "" {
+			if rest[0] != ',' || len(rest) == 1 {
+				return nil, fmt.Errorf("unexpected %q after %s", rest, name)
+			}
+			rest = rest[1:]
+		}
+
+		attrs.names = append(attrs.names, name)
+		attrs.values[name] = value
+		attrs.quoted[name] = quoted
+		list = rest
+	}
+
+	return attrs, nil
+}
+
+func validAttributeName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *attributes) take(name string) (value string, quoted, ok bool) {
+	value, ok = a.values[name]
+	if !ok {
+		return "", false, false
+	}
+	quoted = a.quoted[name]
+	delete(a.values, name)
+	return value, quoted, true
+}
+
+func (a *attributes) has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+func (a *attributes) quotedString(name string, required bool) (string, error) {
+	value, quoted, ok := a.take(name)
+	if !ok {
+		if required {
+			return "", fmt.Errorf("missing %s", name)
+		}
+		return "", nil
+	}
+	if !quoted {
+		return "", fmt.Errorf("%s must be a quoted string", name)
+	}
+	return value, nil
+}
+
+func (a *attributes) enumerated(name string, required bool, allowed ...string) (string, error) {
+	value, quoted, ok := a.take(name)
+	if !ok {
+		if required {
+			return "", fmt.Errorf("missing %s", name)
+		}
+		return "", nil
+	}
+	if quoted {
+		return "", fmt.Errorf("%s must not be quoted", name)
+	}
+	if len(allowed) > 0 {
+		for _, candidate := range allowed {
+			if value == candidate {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("invalid %s %q", name, value)
+	}
+	return value, nil
+}
+
+func (a *attributes) boolean(name string) (bool, error) {
+	value, err := a.enumerated(name, false, "YES", "NO")
+	return value == "YES", err
+}
+
+func (a *attributes) integer(name string, required bool) (int, error) {
+	value, err := a.enumerated(name, required)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	n, err := parseDecimalInteger(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return n, nil
+}
+
+func (a *attributes) float(name string, required, signed bool) (*float64, error) {
+	value, err := a.enumerated(name, required)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	f, err := parseDecimalFloat(value, signed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return &f, nil
+}
+
+func (a *attributes) resolution(name string) (*Resolution, error) {
+	value, err := a.enumerated(name, false)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	width, height, ok := strings.Cut(value, "x")
+	w, werr := parseDecimalInteger(width)
+	h, herr := parseDecimalInteger(height)
+	if !ok || werr != nil || herr != nil {
+		return nil, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return &Resolution{Width: w, Height: h}, nil
+}
+
+func (a *attributes) hexadecimal(name string) (string, error) {
+	value, err := a.enumerated(name, false)
+	if err != nil || value == "" {
+		return "", err
+	}
+	digits, ok := strings.CutPrefix(value, "0x")
+	if !ok {
+		digits, ok = strings.CutPrefix(value, "0X")
+	}
+	if !ok || digits == "" || strings.Trim(digits, "0123456789abcdefABCDEF") != "" {
+		return "", fmt.Errorf("invalid %s %q", name, value)
+	}
+	return value, nil
+}
+
+func (a *attributes) date(name string, required bool) (*time.Time, error) {
+	value, err := a.quotedString(name, required)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	t, err := parseDate(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return &t, nil
+}
+
+// rest returns the attributes nobody took, in the order they were written
+func (a *attributes) rest() []Attribute {
+	var rest []Attribute
+	for _, name := range a.names {
+		if value, ok := a.values[name]; ok {
+			rest = append(rest, Attribute{Name: name, Value: value, Quoted: a.quoted[name]})
+		}
+	}
+	return rest
+}
+
+func parseDecimalInteger(s string) (int, error) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, fmt.Errorf("%q is not a decimal integer", s)
+	}
+	return strconv.Atoi(s)
+}
+
+func parseDecimalFloat(s string, signed bool) (float64, error) {
+	digits := s
+	if signed {
+		digits = strings.TrimPrefix(digits, "-")
+	}
+	whole, fraction, _ := strings.Cut(digits, ".")
+	if whole == "" || strings.Trim(whole, "0123456789") != "" || strings.Trim(fraction, "0123456789") != "" {
+		return 0, fmt.Errorf("%q is not a decimal floating point number", s)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// parseDate accepts RFC 3339 dates, and the +hhmm zone offsets that ffmpeg writes
+func parseDate(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		if t, err := time.Parse("2006-01-02T15:04:05.999999999Z0700", s); err == nil {
+			return t, nil
+		}
+	}
+	return t, err
+}
+
+// attributeWriter builds an attribute list in the order attributes are added
+type attributeWriter struct {
+	b strings.Builder
+}
+
+func (w *attributeWriter) raw(name, value string) {
+	if w.b.Len() > 0 {
+		w.b.WriteByte(',')
+	}
+	w.b.WriteString(name)
+	w.b.WriteByte('=')
+	w.b.WriteString(value)
+}
+
+func (w *attributeWriter) quoted(name, value string) {
+	w.raw(name, `"`+value+`"`)
+}
+
+func (w *attributeWriter) quotedIf(name, value string) {
+	if value != "" {
+		w.quoted(name, value)
+	}
+}
+
+func (w *attributeWriter) enumIf(name, value string) {
+	if value != "" {
+		w.raw(name, value)
+	}
+}
+
+func (w *attributeWriter) integer(name string, value int) {
+	w.raw(name, strconv.Itoa(value))
+}
+
+func (w *attributeWriter) integerIf(name string, value int) {
+	if value > 0 {
+		w.integer(name, value)
+	}
+}
+
+func (w *attributeWriter) float(name string, value float64) {
+	w.raw(name, formatFloat(value))
+}
+
+func (w *attributeWriter) boolean(name string, value bool) {
+	if value {
+		w.raw(name, "YES")
+	}
+}
+
+func (w *attributeWriter) resolution(name string, value *Resolution) {
+	if value != nil {
+		w.raw(name, fmt.Sprintf("%dx%d", value.Width, value.Height))
+	}
+}
+
+func (w *attributeWriter) date(name string, value time.Time) {
+	w.quoted(name, formatDate(value))
+}
+
+func (w *attributeWriter) String() string {
+	return w.b.String()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatDate(t time.Time) string {
+	return t.Format("2006-01-02T15:04:05.000Z07:00")
+}
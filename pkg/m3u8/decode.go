@@ -0,0 +1,882 @@
+package m3u8
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// ErrWrongType is returned by DecodeMaster and DecodeMedia for the other kind of playlist
+var ErrWrongType = errors.New("m3u8: wrong playlist type")
+
+// SyntaxError describes a playlist that is not valid, at the line where it was noticed
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Line == 0 {
+		return "m3u8: " + e.Msg
+	}
+	return fmt.Sprintf("m3u8: line %d: %s", e.Line, e.Msg)
+}
+
+// maxLineLength bounds a single line, long session data or date ranges easily exceed the
+// 64KB default of bufio.Scanner
+const maxLineLength = 1024 * 1024
+
+// Decode reads a master or a media playlist, depending on the tags it contains
+func Decode(r io.Reader) (Playlist, error) {
+	d := &decoder{
+		master: &MasterPlaylist{},
+		media:  &MediaPlaylist{},
+		seen:   map[string]bool{},
+	}
+	if err := d.decode(r); err != nil {
+		return nil, err
+	}
+	if d.listType == Master {
+		return d.master, nil
+	}
+	return d.media, nil
+}
+
+func DecodeMaster(r io.Reader) (*MasterPlaylist, error) {
+	playlist, err := Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	master, ok := playlist.(*MasterPlaylist)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected a master playlist, got a media playlist", ErrWrongType)
+	}
+	return master, nil
+}
+
+func DecodeMedia(r io.Reader) (*MediaPlaylist, error) {
+	playlist, err := Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	media, ok := playlist.(*MediaPlaylist)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected a media playlist, got a master playlist", ErrWrongType)
+	}
+	return media, nil
+}
+
+// decoder fills in both kinds of playlist until the first tag that only belongs to one of
+// them decides which it is
+type decoder struct {
+	line     int
+	listType ListType
+
+	master *MasterPlaylist
+	media  *MediaPlaylist
+
+	// seen holds the tags that may appear only once
+	seen map[string]bool
+
+	// variant is an EXT-X-STREAM-INF waiting for its URI line
+	variant *Variant
+
+	// segment collects the tags of the next media segment, inf is set once its EXTINF is read
+	segment      Segment
+	inf          bool
+	segmentLines []int
+}
+
+func (d *decoder) errorf(format string, args ...any) error {
+	return &SyntaxError{Line: d.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *decoder) decode(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+
+	for scanner.Scan() {
+		d.line++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+
+		if d.line == 1 {
+			if strings.TrimPrefix(line, "\ufeff") != "#EXTM3U" {
+				return d.errorf("playlist must start with #EXTM3U")
+			}
+			continue
+		}
+
+		var err error
+		switch {
+		case strings.TrimSpace(line) == "":
+			continue
+		case strings.HasPrefix(line, "#EXT"):
+			err = d.tag(line)
+		case strings.HasPrefix(line, "#"):
+			// Comment
+			continue
+		default:
+			err = d.uri(strings.TrimSpace(line))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if d.line == 0 {
+		return d.errorf("empty playlist")
+	}
+
+	return d.finish()
+}
+
+var masterTags = map[string]bool{
+	"#EXT-X-MEDIA":              true,
+	"#EXT-X-STREAM-INF":         true,
+	"#EXT-X-I-FRAME-STREAM-INF": true,
+	"#EXT-X-SESSION-DATA":       true,
+	"#EXT-X-SESSION-KEY":        true,
+}
+
+var mediaTags = map[string]bool{
+	"#EXTINF":                       true,
+	"#EXT-X-BYTERANGE":              true,
+	"#EXT-X-DISCONTINUITY":          true,
+	"#EXT-X-KEY":                    true,
+	"#EXT-X-MAP":                    true,
+	"#EXT-X-PROGRAM-DATE-TIME":      true,
+	"#EXT-X-DATERANGE":              true,
+	"#EXT-X-TARGETDURATION":         true,
+	"#EXT-X-MEDIA-SEQUENCE":         true,
+	"#EXT-X-DISCONTINUITY-SEQUENCE": true,
+	"#EXT-X-ENDLIST":                true,
+	"#EXT-X-PLAYLIST-TYPE":          true,
+	"#EXT-X-I-FRAMES-ONLY":          true,
+}
+
+var singleTags = map[string]bool{
+	"#EXT-X-VERSION":                true,
+	"#EXT-X-INDEPENDENT-SEGMENTS":   true,
+	"#EXT-X-START":                  true,
+	"#EXT-X-TARGETDURATION":         true,
+	"#EXT-X-MEDIA-SEQUENCE":         true,
+	"#EXT-X-DISCONTINUITY-SEQUENCE": true,
+	"#EXT-X-ENDLIST":                true,
+	"#EXT-X-PLAYLIST-TYPE":          true,
+	"#EXT-X-I-FRAMES-ONLY":          true,
+}
+
+func (d *decoder) setType(t ListType, name string) error {
+	if d.listType != 0 && d.listType != t {
+		return d.errorf("%s is not allowed in a %s playlist", name, d.listType)
+	}
+	d.listType = t
+	return nil
+}
+
+func (d *decoder) tag(line string) error {
+	name, value, hasValue := strings.Cut(line, ":")
+
+	switch {
+	case masterTags[name]:
+		if err := d.setType(Master, name); err != nil {
+			return err
+		}
+	case mediaTags[name]:
+		if err := d.setType(Media, name); err != nil {
+			return err
+		}
+	}
+	if singleTags[name] {
+		if d.seen[name] {
+			return d.errorf("%s must appear only once", name)
+		}
+		d.seen[name] = true
+	}
+	if d.variant != nil && name != "#EXT-X-STREAM-INF" {
+		// Unknown tags may sit between EXT-X-STREAM-INF and its URI, known ones may not
+		if masterTags[name] || singleTags[name] {
+			return d.errorf("%s between EXT-X-STREAM-INF and its URI", name)
+		}
+	}
+
+	needsValue := func() error {
+		if !hasValue || value == "" {
+			return d.errorf("%s needs a value", name)
+		}
+		return nil
+	}
+	noValue := func() error {
+		if hasValue {
+			return d.errorf("%s takes no value", name)
+		}
+		return nil
+	}
+	var err error
+
+	switch name {
+	case "#EXTM3U":
+		return d.errorf("#EXTM3U must be the first line only")
+
+	case "#EXT-X-VERSION":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		version, err := parseDecimalInteger(value)
+		if err != nil || version < 1 {
+			return d.errorf("invalid EXT-X-VERSION %q", value)
+		}
+		d.master.Version, d.media.Version = version, version
+
+	case "#EXT-X-INDEPENDENT-SEGMENTS":
+		if err = noValue(); err != nil {
+			return err
+		}
+		d.master.IndependentSegments, d.media.IndependentSegments = true, true
+
+	case "#EXT-X-START":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		start, err := d.parseStart(value)
+		if err != nil {
+			return err
+		}
+		d.master.Start, d.media.Start = start, start
+
+	// Master playlist tags
+
+	case "#EXT-X-MEDIA":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		rendition, err := d.parseRendition(value)
+		if err != nil {
+			return err
+		}
+		d.master.Renditions = append(d.master.Renditions, rendition)
+
+	case "#EXT-X-STREAM-INF":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		if d.variant != nil {
+			return d.errorf("EXT-X-STREAM-INF without a URI")
+		}
+		d.variant, err = d.parseVariant(value)
+		return err
+
+	case "#EXT-X-I-FRAME-STREAM-INF":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		variant, err := d.parseIFrameVariant(value)
+		if err != nil {
+			return err
+		}
+		d.master.IFrameVariants = append(d.master.IFrameVariants, variant)
+
+	case "#EXT-X-SESSION-DATA":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		data, err := d.parseSessionData(value)
+		if err != nil {
+			return err
+		}
+		d.master.SessionData = append(d.master.SessionData, data)
+
+	case "#EXT-X-SESSION-KEY":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		key, err := d.parseKey(value)
+		if err != nil {
+			return err
+		}
+		if key.Method == MethodNone {
+			return d.errorf("EXT-X-SESSION-KEY must not have METHOD=NONE")
+		}
+		d.master.SessionKeys = append(d.master.SessionKeys, key)
+
+	// Media playlist tags
+
+	case "#EXT-X-TARGETDURATION":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		if d.media.TargetDuration, err = parseDecimalInteger(value); err != nil {
+			return d.errorf("invalid EXT-X-TARGETDURATION: %v", err)
+		}
+
+	case "#EXT-X-MEDIA-SEQUENCE":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		if len(d.media.Segments) > 0 || d.inf {
+			return d.errorf("EXT-X-MEDIA-SEQUENCE must appear before the first segment")
+		}
+		if d.media.MediaSequence, err = parseDecimalInteger(value); err != nil {
+			return d.errorf("invalid EXT-X-MEDIA-SEQUENCE: %v", err)
+		}
+
+	case "#EXT-X-DISCONTINUITY-SEQUENCE":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		if len(d.media.Segments) > 0 || d.inf {
+			return d.errorf("EXT-X-DISCONTINUITY-SEQUENCE must appear before the first segment")
+		}
+		if d.media.DiscontinuitySequence, err = parseDecimalInteger(value); err != nil {
+			return d.errorf("invalid EXT-X-DISCONTINUITY-SEQUENCE: %v", err)
+		}
+
+	case "#EXT-X-PLAYLIST-TYPE":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		if value != PlaylistTypeEvent && value != PlaylistTypeVOD {
+			return d.errorf("invalid EXT-X-PLAYLIST-TYPE %q", value)
+		}
+		d.media.PlaylistType = value
+
+	case "#EXT-X-I-FRAMES-ONLY":
+		if err = noValue(); err != nil {
+			return err
+		}
+		d.media.IFramesOnly = true
+
+	case "#EXT-X-ENDLIST":
+		if err = noValue(); err != nil {
+			return err
+		}
+		d.media.EndList = true
+
+	case "#EXTINF":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		if d.inf {
+			return d.errorf("EXTINF without a URI")
+		}
+		duration, title, ok := strings.Cut(value, ",")
+		if !ok {
+			return d.errorf("EXTINF needs a comma after the duration")
+		}
+		if d.segment.Duration, err = parseDecimalFloat(duration, false); err != nil {
+			return d.errorf("invalid EXTINF: %v", err)
+		}
+		d.segment.Title = title
+		d.inf = true
+
+	case "#EXT-X-BYTERANGE":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		if d.segment.ByteRange != nil {
+			return d.errorf("EXT-X-BYTERANGE must appear once per segment")
+		}
+		if d.segment.ByteRange, err = parseByteRange(value); err != nil {
+			return d.errorf("invalid EXT-X-BYTERANGE: %v", err)
+		}
+
+	case "#EXT-X-DISCONTINUITY":
+		if err = noValue(); err != nil {
+			return err
+		}
+		d.segment.Discontinuity = true
+
+	case "#EXT-X-KEY":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		key, err := d.parseKey(value)
+		if err != nil {
+			return err
+		}
+		d.segment.Keys = append(d.segment.Keys, key)
+
+	case "#EXT-X-MAP":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		if d.segment.Map != nil {
+			return d.errorf("EXT-X-MAP must appear once per segment")
+		}
+		if d.segment.Map, err = d.parseMap(value); err != nil {
+			return err
+		}
+
+	case "#EXT-X-PROGRAM-DATE-TIME":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		if d.segment.ProgramDateTime, err = parseDate(value); err != nil {
+			return d.errorf("invalid EXT-X-PROGRAM-DATE-TIME: %v", err)
+		}
+
+	case "#EXT-X-DATERANGE":
+		if err = needsValue(); err != nil {
+			return err
+		}
+		dateRange, err := d.parseDateRange(value)
+		if err != nil {
+			return err
+		}
+		d.segment.DateRanges = append(d.segment.DateRanges, dateRange)
+	}
+
+	// Any other tag is unknown and ignored (RFC 8216 section 6.3.1)
+	return nil
+}
+
+func (d *decoder) uri(uri string) error {
+	switch d.listType {
+	case Master:
+		if d.variant == nil {
+			return d.errorf("URI %q is not preceded by EXT-X-STREAM-INF", uri)
+		}
+		d.variant.URI = uri
+		d.master.Variants = append(d.master.Variants, *d.variant)
+		d.variant = nil
+
+	case Media:
+		if !d.inf {
+			return d.errorf("URI %q is not preceded by EXTINF", uri)
+		}
+		d.segment.URI = uri
+		d.media.Segments = append(d.media.Segments, d.segment)
+		d.segmentLines = append(d.segmentLines, d.line)
+		d.segment = Segment{}
+		d.inf = false
+
+	default:
+		return d.errorf("URI %q before any EXT-X-STREAM-INF or EXTINF", uri)
+	}
+	return nil
+}
+
+func (d *decoder) finish() error {
+	d.line++
+
+	switch d.listType {
+	case Master:
+		if d.variant != nil {
+			return d.errorf("EXT-X-STREAM-INF without a URI")
+		}
+		return d.checkGroups()
+
+	case Media:
+		if d.inf {
+			return d.errorf("EXTINF without a URI")
+		}
+		if d.segment.Discontinuity || len(d.segment.Keys) > 0 || d.segment.Map != nil || d.segment.ByteRange != nil || !d.segment.ProgramDateTime.IsZero() {
+			return d.errorf("segment tags after the last segment")
+		}
+		if len(d.segment.DateRanges) > 0 {
+			// Date ranges may follow the last segment, e.g. to announce one in a live playlist,
+			// keep them on it
+			if len(d.media.Segments) == 0 {
+				return d.errorf("EXT-X-DATERANGE without a segment")
+			}
+			last := &d.media.Segments[len(d.media.Segments)-1]
+			last.DateRanges = append(last.DateRanges, d.segment.DateRanges...)
+		}
+		if !d.seen["#EXT-X-TARGETDURATION"] {
+			return &SyntaxError{Msg: "media playlist without EXT-X-TARGETDURATION"}
+		}
+		for i, segment := range d.media.Segments {
+			if int(math.Round(segment.Duration)) > d.media.TargetDuration {
+				return &SyntaxError{Line: d.segmentLines[i], Msg: fmt.Sprintf("segment duration %s exceeds EXT-X-TARGETDURATION %d", formatFloat(segment.Duration), d.media.TargetDuration)}
+			}
+		}
+		return nil
+
+	default:
+		return &SyntaxError{Msg: "playlist has no variants or segments"}
+	}
+}
+
+// checkGroups makes sure every group a variant refers to has renditions of that type
+func (d *decoder) checkGroups() error {
+	groups := map[string]bool{}
+	for _, rendition := range d.master.Renditions {
+		groups[rendition.Type+"/"+rendition.GroupID] = true
+	}
+	check := func(mediaType, group string) error {
+		if group != "" && !groups[mediaType+"/"+group] {
+			return &SyntaxError{Msg: fmt.Sprintf("no %s renditions in group %q", mediaType, group)}
+		}
+		return nil
+	}
+
+	for _, variant := range d.master.Variants {
+		closedCaptions := variant.ClosedCaptions
+		if closedCaptions == ClosedCaptionsNone {
+			closedCaptions = ""
+		}
+		for _, err := range []error{
+			check(MediaTypeAudio, variant.Audio),
+			check(MediaTypeVideo, variant.Video),
+			check(MediaTypeSubtitles, variant.Subtitles),
+			check(MediaTypeClosedCaptions, closedCaptions),
+		} {
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, variant := range d.master.IFrameVariants {
+		if err := check(MediaTypeVideo, variant.Video); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *decoder) attributes(value string) (*attributes, error) {
+	attrs, err := parseAttributes(value)
+	if err != nil {
+		return nil, d.errorf("%v", err)
+	}
+	return attrs, nil
+}
+
+func (d *decoder) parseStart(value string) (*Start, error) {
+	attrs, err := d.attributes(value)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := attrs.float("TIME-OFFSET", true, true)
+	if err != nil {
+		return nil, d.errorf("EXT-X-START: %v", err)
+	}
+	precise, err := attrs.boolean("PRECISE")
+	if err != nil {
+		return nil, d.errorf("EXT-X-START: %v", err)
+	}
+	return &Start{TimeOffset: *offset, Precise: precise}, nil
+}
+
+func (d *decoder) parseKey(value string) (Key, error) {
+	attrs, err := d.attributes(value)
+	if err != nil {
+		return Key{}, err
+	}
+
+	var key Key
+	if key.Method, err = attrs.enumerated("METHOD", true, MethodNone, MethodAES128, MethodSampleAES, MethodSampleAESCTR); err != nil {
+		return key, d.errorf("key: %v", err)
+	}
+	if key.Method == MethodNone {
+		if len(attrs.values) > 0 {
+			return key, d.errorf("key with METHOD=NONE must have no other attributes")
+		}
+		return key, nil
+	}
+	if key.URI, err = attrs.quotedString("URI", true); err != nil {
+		return key, d.errorf("key: %v", err)
+	}
+	if key.IV, err = attrs.hexadecimal("IV"); err != nil {
+		return key, d.errorf("key: %v", err)
+	}
+	if key.KeyFormat, err = attrs.quotedString("KEYFORMAT", false); err != nil {
+		return key, d.errorf("key: %v", err)
+	}
+	if key.KeyFormatVersions, err = attrs.quotedString("KEYFORMATVERSIONS", false); err != nil {
+		return key, d.errorf("key: %v", err)
+	}
+	return key, nil
+}
+
+func (d *decoder) parseMap(value string) (*Map, error) {
+	attrs, err := d.attributes(value)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Map{}
+	if m.URI, err = attrs.quotedString("URI", true); err != nil {
+		return nil, d.errorf("EXT-X-MAP: %v", err)
+	}
+	byteRange, err := attrs.quotedString("BYTERANGE", false)
+	if err != nil {
+		return nil, d.errorf("EXT-X-MAP: %v", err)
+	}
+	if byteRange != "" {
+		if m.ByteRange, err = parseByteRange(byteRange); err != nil {
+			return nil, d.errorf("EXT-X-MAP: invalid BYTERANGE: %v", err)
+		}
+	}
+	return m, nil
+}
+
+func (d *decoder) parseDateRange(value string) (DateRange, error) {
+	attrs, err := d.attributes(value)
+	if err != nil {
+		return DateRange{}, err
+	}
+	fail := func(err error) (DateRange, error) {
+		return DateRange{}, d.errorf("EXT-X-DATERANGE: %v", err)
+	}
+
+	var dateRange DateRange
+	if dateRange.ID, err = attrs.quotedString("ID", true); err != nil {
+		return fail(err)
+	}
+	if dateRange.Class, err = attrs.quotedString("CLASS", false); err != nil {
+		return fail(err)
+	}
+	start, err := attrs.date("START-DATE", true)
+	if err != nil {
+		return fail(err)
+	}
+	dateRange.StartDate = *start
+	if dateRange.EndDate, err = attrs.date("END-DATE", false); err != nil {
+		return fail(err)
+	}
+	if dateRange.Duration, err = attrs.float("DURATION", false, false); err != nil {
+		return fail(err)
+	}
+	if dateRange.PlannedDuration, err = attrs.float("PLANNED-DURATION", false, false); err != nil {
+		return fail(err)
+	}
+	if dateRange.SCTE35Cmd, err = attrs.hexadecimal("SCTE35-CMD"); err != nil {
+		return fail(err)
+	}
+	if dateRange.SCTE35Out, err = attrs.hexadecimal("SCTE35-OUT"); err != nil {
+		return fail(err)
+	}
+	if dateRange.SCTE35In, err = attrs.hexadecimal("SCTE35-IN"); err != nil {
+		return fail(err)
+	}
+	if attrs.has("END-ON-NEXT") {
+		if dateRange.EndOnNext, err = attrs.boolean("END-ON-NEXT"); err != nil {
+			return fail(err)
+		}
+		if !dateRange.EndOnNext {
+			return fail(errors.New("END-ON-NEXT must be YES"))
+		}
+		if dateRange.Class == "" || dateRange.Duration != nil || dateRange.EndDate != nil {
+			return fail(errors.New("END-ON-NEXT needs a CLASS and no DURATION or END-DATE"))
+		}
+	}
+	if dateRange.EndDate != nil && dateRange.EndDate.Before(dateRange.StartDate) {
+		return fail(errors.New("END-DATE is before START-DATE"))
+	}
+
+	for _, attr := range attrs.rest() {
+		if strings.HasPrefix(attr.Name, "X-") {
+			dateRange.ClientAttributes = append(dateRange.ClientAttributes, attr)
+		}
+	}
+	return dateRange, nil
+}
+
+func (d *decoder) parseRendition(value string) (Rendition, error) {
+	attrs, err := d.attributes(value)
+	if err != nil {
+		return Rendition{}, err
+	}
+	fail := func(err error) (Rendition, error) {
+		return Rendition{}, d.errorf("EXT-X-MEDIA: %v", err)
+	}
+
+	var r Rendition
+	if r.Type, err = attrs.enumerated("TYPE", true, MediaTypeAudio, MediaTypeVideo, MediaTypeSubtitles, MediaTypeClosedCaptions); err != nil {
+		return fail(err)
+	}
+	if r.URI, err = attrs.quotedString("URI", false); err != nil {
+		return fail(err)
+	}
+	if r.GroupID, err = attrs.quotedString("GROUP-ID", true); err != nil {
+		return fail(err)
+	}
+	if r.Language, err = attrs.quotedString("LANGUAGE", false); err != nil {
+		return fail(err)
+	}
+	if r.AssocLanguage, err = attrs.quotedString("ASSOC-LANGUAGE", false); err != nil {
+		return fail(err)
+	}
+	if r.Name, err = attrs.quotedString("NAME", true); err != nil {
+		return fail(err)
+	}
+	if r.Default, err = attrs.boolean("DEFAULT"); err != nil {
+		return fail(err)
+	}
+	autoselectSet := attrs.has("AUTOSELECT")
+	if r.Autoselect, err = attrs.boolean("AUTOSELECT"); err != nil {
+		return fail(err)
+	}
+	if r.Forced, err = attrs.boolean("FORCED"); err != nil {
+		return fail(err)
+	}
+	if r.InstreamID, err = attrs.quotedString("INSTREAM-ID", false); err != nil {
+		return fail(err)
+	}
+	if r.Characteristics, err = attrs.quotedString("CHARACTERISTICS", false); err != nil {
+		return fail(err)
+	}
+	if r.Channels, err = attrs.quotedString("CHANNELS", false); err != nil {
+		return fail(err)
+	}
+
+	switch {
+	case r.Type == MediaTypeClosedCaptions && r.URI != "":
+		return fail(errors.New("CLOSED-CAPTIONS renditions must not have a URI"))
+	case r.Type == MediaTypeClosedCaptions && r.InstreamID == "":
+		return fail(errors.New("CLOSED-CAPTIONS renditions need an INSTREAM-ID"))
+	case r.Type != MediaTypeClosedCaptions && r.InstreamID != "":
+		return fail(errors.New("INSTREAM-ID is only allowed for CLOSED-CAPTIONS"))
+	case r.Type == MediaTypeSubtitles && r.URI == "":
+		return fail(errors.New("SUBTITLES renditions need a URI"))
+	case r.Type != MediaTypeSubtitles && r.Forced:
+		return fail(errors.New("FORCED is only allowed for SUBTITLES"))
+	case r.Default && autoselectSet && !r.Autoselect:
+		return fail(errors.New("AUTOSELECT must be YES when DEFAULT is YES"))
+	}
+	return r, nil
+}
+
+var hdcpLevels = []string{"TYPE-0", "TYPE-1", "NONE"}
+
+func (d *decoder) parseVariant(value string) (*Variant, error) {
+	attrs, err := d.attributes(value)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*Variant, error) {
+		return nil, d.errorf("EXT-X-STREAM-INF: %v", err)
+	}
+
+	if attrs.has("URI") {
+		return fail(errors.New("URI is not allowed, the URI follows on the next line"))
+	}
+
+	v := &Variant{}
+	if v.Bandwidth, err = attrs.integer("BANDWIDTH", true); err != nil {
+		return fail(err)
+	}
+	if v.AverageBandwidth, err = attrs.integer("AVERAGE-BANDWIDTH", false); err != nil {
+		return fail(err)
+	}
+	if v.Codecs, err = attrs.quotedString("CODECS", false); err != nil {
+		return fail(err)
+	}
+	if v.Resolution, err = attrs.resolution("RESOLUTION"); err != nil {
+		return fail(err)
+	}
+	frameRate, err := attrs.float("FRAME-RATE", false, false)
+	if err != nil {
+		return fail(err)
+	}
+	if frameRate != nil {
+		v.FrameRate = *frameRate
+	}
+	if v.HDCPLevel, err = attrs.enumerated("HDCP-LEVEL", false, hdcpLevels...); err != nil {
+		return fail(err)
+	}
+	if v.Audio, err = attrs.quotedString("AUDIO", false); err != nil {
+		return fail(err)
+	}
+	if v.Video, err = attrs.quotedString("VIDEO", false); err != nil {
+		return fail(err)
+	}
+	if v.Subtitles, err = attrs.quotedString("SUBTITLES", false); err != nil {
+		return fail(err)
+	}
+	if closedCaptions, quoted, ok := attrs.take("CLOSED-CAPTIONS"); ok {
+		if !quoted && closedCaptions != ClosedCaptionsNone {
+			return fail(fmt.Errorf("invalid CLOSED-CAPTIONS %q", closedCaptions))
+		}
+		v.ClosedCaptions = closedCaptions
+	}
+	return v, nil
+}
+
+func (d *decoder) parseIFrameVariant(value string) (IFrameVariant, error) {
+	attrs, err := d.attributes(value)
+	if err != nil {
+		return IFrameVariant{}, err
+	}
+	fail := func(err error) (IFrameVariant, error) {
+		return IFrameVariant{}, d.errorf("EXT-X-I-FRAME-STREAM-INF: %v", err)
+	}
+
+	var v IFrameVariant
+	if v.URI, err = attrs.quotedString("URI", true); err != nil {
+		return fail(err)
+	}
+	if v.Bandwidth, err = attrs.integer("BANDWIDTH", true); err != nil {
+		return fail(err)
+	}
+	if v.AverageBandwidth, err = attrs.integer("AVERAGE-BANDWIDTH", false); err != nil {
+		return fail(err)
+	}
+	if v.Codecs, err = attrs.quotedString("CODECS", false); err != nil {
+		return fail(err)
+	}
+	if v.Resolution, err = attrs.resolution("RESOLUTION"); err != nil {
+		return fail(err)
+	}
+	if v.HDCPLevel, err = attrs.enumerated("HDCP-LEVEL", false, hdcpLevels...); err != nil {
+		return fail(err)
+	}
+	if v.Video, err = attrs.quotedString("VIDEO", false); err != nil {
+		return fail(err)
+	}
+	return v, nil
+}
+
+func (d *decoder) parseSessionData(value string) (SessionData, error) {
+	attrs, err := d.attributes(value)
+	if err != nil {
+		return SessionData{}, err
+	}
+	fail := func(err error) (SessionData, error) {
+		return SessionData{}, d.errorf("EXT-X-SESSION-DATA: %v", err)
+	}
+
+	var data SessionData
+	if data.DataID, err = attrs.quotedString("DATA-ID", true); err != nil {
+		return fail(err)
+	}
+	hasValue, hasURI := attrs.has("VALUE"), attrs.has("URI")
+	if hasValue == hasURI {
+		return fail(errors.New("needs either a VALUE or a URI"))
+	}
+	if data.Value, err = attrs.quotedString("VALUE", false); err != nil {
+		return fail(err)
+	}
+	if data.URI, err = attrs.quotedString("URI", false); err != nil {
+		return fail(err)
+	}
+	if data.Language, err = attrs.quotedString("LANGUAGE", false); err != nil {
+		return fail(err)
+	}
+	return data, nil
+}
+
+// parseByteRange parses <length>[@<offset>]
+func parseByteRange(value string) (*ByteRange, error) {
+	length, offset, hasOffset := strings.Cut(value, "@")
+	n, err := parseDecimalInteger(length)
+	if err != nil {
+		return nil, err
+	}
+	byteRange := &ByteRange{Length: int64(n)}
+	if hasOffset {
+		o, err := parseDecimalInteger(offset)
+		if err != nil {
+			return nil, err
+		}
+		o64 := int64(o)
+		byteRange.Offset = &o64
+	}
+	return byteRange, nil
+}
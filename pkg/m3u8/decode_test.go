@@ -0,0 +1,430 @@
+package m3u8
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeMaster(t *testing.T) {
+	input := `#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-START:TIME-OFFSET=-12.5,PRECISE=YES
+#EXT-X-SESSION-DATA:DATA-ID="com.example.title",VALUE="Big, Buck, Bunny",LANGUAGE="en"
+#EXT-X-SESSION-KEY:METHOD=AES-128,URI="https://keys.example.com/k1",IV=0x0123456789ABCDEF0123456789ABCDEF
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="Deutsch",LANGUAGE="de",FORCED=YES,URI="subs/de.m3u8"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="English",INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,AVERAGE-BANDWIDTH=1000000,CODECS="avc1.4d401f,mp4a.40.2",RESOLUTION=1280x720,FRAME-RATE=23.976,HDCP-LEVEL=TYPE-0,AUDIO="aac",SUBTITLES="subs",CLOSED-CAPTIONS="cc"
+720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS="mp4a.40.2",AUDIO="aac",CLOSED-CAPTIONS=NONE
+# audio only
+audio/en.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,CODECS="avc1.4d401f",RESOLUTION=1280x720,URI="720p-iframes.m3u8"
+`
+	want := &MasterPlaylist{
+		Version:             4,
+		IndependentSegments: true,
+		Start:               &Start{TimeOffset: -12.5, Precise: true},
+		SessionData: []SessionData{
+			{DataID: "com.example.title", Value: "Big, Buck, Bunny", Language: "en"},
+		},
+		SessionKeys: []Key{
+			{Method: MethodAES128, URI: "https://keys.example.com/k1", IV: "0x0123456789ABCDEF0123456789ABCDEF"},
+		},
+		Renditions: []Rendition{
+			{Type: MediaTypeAudio, GroupID: "aac", Name: "English", Language: "en", Default: true, Autoselect: true, Channels: "2", URI: "audio/en.m3u8"},
+			{Type: MediaTypeSubtitles, GroupID: "subs", Name: "Deutsch", Language: "de", Forced: true, URI: "subs/de.m3u8"},
+			{Type: MediaTypeClosedCaptions, GroupID: "cc", Name: "English", InstreamID: "CC1"},
+		},
+		Variants: []Variant{
+			{
+				URI:              "720p.m3u8",
+				Bandwidth:        1280000,
+				AverageBandwidth: 1000000,
+				Codecs:           "avc1.4d401f,mp4a.40.2",
+				Resolution:       &Resolution{Width: 1280, Height: 720},
+				FrameRate:        23.976,
+				HDCPLevel:        "TYPE-0",
+				Audio:            "aac",
+				Subtitles:        "subs",
+				ClosedCaptions:   "cc",
+			},
+			{URI: "audio/en.m3u8", Bandwidth: 64000, Codecs: "mp4a.40.2", Audio: "aac", ClosedCaptions: ClosedCaptionsNone},
+		},
+		IFrameVariants: []IFrameVariant{
+			{URI: "720p-iframes.m3u8", Bandwidth: 86000, Codecs: "avc1.4d401f", Resolution: &Resolution{Width: 1280, Height: 720}},
+		},
+	}
+
+	got, err := DecodeMaster(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("DecodeMaster() = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeMaster() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestDecodeMedia(t *testing.T) {
+	input := `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:100
+#EXT-X-DISCONTINUITY-SEQUENCE:2
+#EXT-X-PLAYLIST-TYPE:EVENT
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://key1",KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="800@0"
+#EXT-X-PROGRAM-DATE-TIME:2024-03-01T12:00:00.000+0100
+#EXTINF:5.96,Opening, part 1
+#EXT-X-BYTERANGE:50000@800
+main.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-KEY:METHOD=NONE
+#EXT-X-DATERANGE:ID="ad-1",CLASS="com.example.ad",START-DATE="2024-03-01T12:00:06Z",DURATION=30,X-AD-ID="42",X-PRIORITY=1
+#EXTINF:6,
+#EXT-X-BYTERANGE:60000
+main.m4s
+`
+	offset := int64(0)
+	mapOffset := int64(800)
+	duration := 30.0
+	want := &MediaPlaylist{
+		Version:               6,
+		TargetDuration:        6,
+		MediaSequence:         100,
+		DiscontinuitySequence: 2,
+		PlaylistType:          PlaylistTypeEvent,
+		Segments: []Segment{
+			{
+				URI:             "main.m4s",
+				Duration:        5.96,
+				Title:           "Opening, part 1",
+				ByteRange:       &ByteRange{Length: 50000, Offset: &mapOffset},
+				Keys:            []Key{{Method: MethodSampleAES, URI: "skd://key1", KeyFormat: "com.apple.streamingkeydelivery", KeyFormatVersions: "1"}},
+				Map:             &Map{URI: "init.mp4", ByteRange: &ByteRange{Length: 800, Offset: &offset}},
+				ProgramDateTime: time.Date(2024, 3, 1, 11, 0, 0, 0, time.UTC),
+			},
+			{
+				URI:           "main.m4s",
+				Duration:      6,
+				ByteRange:     &ByteRange{Length: 60000},
+				Discontinuity: true,
+				Keys:          []Key{{Method: MethodNone}},
+				DateRanges: []DateRange{{
+					ID:        "ad-1",
+					Class:     "com.example.ad",
+					StartDate: time.Date(2024, 3, 1, 12, 0, 6, 0, time.UTC),
+					Duration:  &duration,
+					ClientAttributes: []Attribute{
+						{Name: "X-AD-ID", Value: "42", Quoted: true},
+						{Name: "X-PRIORITY", Value: "1"},
+					},
+				}},
+			},
+		},
+	}
+
+	got, err := DecodeMedia(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("DecodeMedia() = %v", err)
+	}
+	// Compare instants, not locations
+	for i := range got.Segments {
+		if !got.Segments[i].ProgramDateTime.Equal(want.Segments[i].ProgramDateTime) {
+			t.Errorf("segment %d ProgramDateTime = %v, want %v", i, got.Segments[i].ProgramDateTime, want.Segments[i].ProgramDateTime)
+		}
+		got.Segments[i].ProgramDateTime = want.Segments[i].ProgramDateTime
+		for j := range got.Segments[i].DateRanges {
+			got.Segments[i].DateRanges[j].StartDate = got.Segments[i].DateRanges[j].StartDate.UTC()
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeMedia() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestDecodeWrongType(t *testing.T) {
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\na.m3u8\n"
+	media := "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\na.ts\n"
+
+	if _, err := DecodeMedia(strings.NewReader(master)); !errors.Is(err, ErrWrongType) {
+		t.Errorf("DecodeMedia(master) = %v, want ErrWrongType", err)
+	}
+	if _, err := DecodeMaster(strings.NewReader(media)); !errors.Is(err, ErrWrongType) {
+		t.Errorf("DecodeMaster(media) = %v, want ErrWrongType", err)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		line  int
+		msg   string
+	}{
+		{
+			name:  "empty",
+			input: "",
+			msg:   "empty playlist",
+		},
+		{
+			name:  "no EXTM3U",
+			input: "#EXT-X-TARGETDURATION:1\n#EXTINF:1,\na.ts\n",
+			line:  1,
+			msg:   "playlist must start with #EXTM3U",
+		},
+		{
+			name:  "EXTM3U twice",
+			input: "#EXTM3U\n#EXTM3U\n",
+			line:  2,
+			msg:   "#EXTM3U must be the first line only",
+		},
+		{
+			name:  "no variants or segments",
+			input: "#EXTM3U\n#EXT-X-VERSION:3\n",
+			msg:   "playlist has no variants or segments",
+		},
+		{
+			name:  "master tag in a media playlist",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-STREAM-INF:BANDWIDTH=1\na.m3u8\n",
+			line:  3,
+			msg:   "#EXT-X-STREAM-INF is not allowed in a media playlist",
+		},
+		{
+			name:  "media tag in a master playlist",
+			input: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\na.m3u8\n#EXTINF:1,\n",
+			line:  4,
+			msg:   "#EXTINF is not allowed in a master playlist",
+		},
+		{
+			name:  "duplicate single tag",
+			input: "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-VERSION:3\n",
+			line:  3,
+			msg:   "#EXT-X-VERSION must appear only once",
+		},
+		{
+			name:  "invalid version",
+			input: "#EXTM3U\n#EXT-X-VERSION:0\n",
+			line:  2,
+			msg:   `invalid EXT-X-VERSION "0"`,
+		},
+		{
+			name:  "value on a tag without one",
+			input: "#EXTM3U\n#EXT-X-ENDLIST:YES\n",
+			line:  2,
+			msg:   "#EXT-X-ENDLIST takes no value",
+		},
+		{
+			name:  "missing value",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:\n",
+			line:  2,
+			msg:   "#EXT-X-TARGETDURATION needs a value",
+		},
+		{
+			name:  "EXTINF without a URI",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\n#EXTINF:1,\na.ts\n",
+			line:  4,
+			msg:   "EXTINF without a URI",
+		},
+		{
+			name:  "EXTINF without a URI at the end",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\n",
+			line:  4,
+			msg:   "EXTINF without a URI",
+		},
+		{
+			name:  "EXTINF without a comma",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1\na.ts\n",
+			line:  3,
+			msg:   "EXTINF needs a comma after the duration",
+		},
+		{
+			name:  "URI without EXTINF",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:1\na.ts\n",
+			line:  3,
+			msg:   `URI "a.ts" is not preceded by EXTINF`,
+		},
+		{
+			name:  "URI before any tag",
+			input: "#EXTM3U\na.ts\n",
+			line:  2,
+			msg:   `URI "a.ts" before any EXT-X-STREAM-INF or EXTINF`,
+		},
+		{
+			name:  "segment longer than the target duration",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.4,\na.ts\n#EXTINF:4.6,\nb.ts\n",
+			line:  6,
+			msg:   "segment duration 4.6 exceeds EXT-X-TARGETDURATION 4",
+		},
+		{
+			name:  "no target duration",
+			input: "#EXTM3U\n#EXTINF:1,\na.ts\n",
+			msg:   "media playlist without EXT-X-TARGETDURATION",
+		},
+		{
+			name:  "media sequence after a segment",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\na.ts\n#EXT-X-MEDIA-SEQUENCE:1\n",
+			line:  5,
+			msg:   "EXT-X-MEDIA-SEQUENCE must appear before the first segment",
+		},
+		{
+			name:  "segment tags after the last segment",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\na.ts\n#EXT-X-DISCONTINUITY\n",
+			line:  6,
+			msg:   "segment tags after the last segment",
+		},
+		{
+			name:  "unknown playlist type",
+			input: "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:LIVE\n",
+			line:  2,
+			msg:   `invalid EXT-X-PLAYLIST-TYPE "LIVE"`,
+		},
+		{
+			name:  "unknown group",
+			input: "#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",NAME=\"en\"\n#EXT-X-STREAM-INF:BANDWIDTH=1,AUDIO=\"ac3\"\na.m3u8\n",
+			msg:   `no AUDIO renditions in group "ac3"`,
+		},
+		{
+			name:  "group of another type",
+			input: "#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"g\",NAME=\"en\"\n#EXT-X-STREAM-INF:BANDWIDTH=1,SUBTITLES=\"g\"\na.m3u8\n",
+			msg:   `no SUBTITLES renditions in group "g"`,
+		},
+		{
+			name:  "closed captions with a URI",
+			input: "#EXTM3U\n#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID=\"cc\",NAME=\"en\",INSTREAM-ID=\"CC1\",URI=\"cc.m3u8\"\n",
+			line:  2,
+			msg:   "EXT-X-MEDIA: CLOSED-CAPTIONS renditions must not have a URI",
+		},
+		{
+			name:  "subtitles without a URI",
+			input: "#EXTM3U\n#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"en\"\n",
+			line:  2,
+			msg:   "EXT-X-MEDIA: SUBTITLES renditions need a URI",
+		},
+		{
+			name:  "default rendition not autoselected",
+			input: "#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",NAME=\"en\",DEFAULT=YES,AUTOSELECT=NO\n",
+			line:  2,
+			msg:   "EXT-X-MEDIA: AUTOSELECT must be YES when DEFAULT is YES",
+		},
+		{
+			name:  "METHOD=NONE with other attributes",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-KEY:METHOD=NONE,URI=\"k\"\n",
+			line:  3,
+			msg:   "key with METHOD=NONE must have no other attributes",
+		},
+		{
+			name:  "session key with METHOD=NONE",
+			input: "#EXTM3U\n#EXT-X-SESSION-KEY:METHOD=NONE\n",
+			line:  2,
+			msg:   "EXT-X-SESSION-KEY must not have METHOD=NONE",
+		},
+		{
+			name:  "key without a URI",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-KEY:METHOD=AES-128\n",
+			line:  3,
+			msg:   "key: missing URI",
+		},
+		{
+			name:  "invalid IV",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\",IV=0xZZ\n",
+			line:  3,
+			msg:   `key: invalid IV "0xZZ"`,
+		},
+		{
+			name:  "URI attribute on a variant",
+			input: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1,URI=\"a.m3u8\"\na.m3u8\n",
+			line:  2,
+			msg:   "EXT-X-STREAM-INF: URI is not allowed, the URI follows on the next line",
+		},
+		{
+			name:  "variant without a URI",
+			input: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n#EXT-X-STREAM-INF:BANDWIDTH=2\nb.m3u8\n",
+			line:  3,
+			msg:   "EXT-X-STREAM-INF without a URI",
+		},
+		{
+			name:  "known tag between a variant and its URI",
+			input: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n#EXT-X-INDEPENDENT-SEGMENTS\na.m3u8\n",
+			line:  3,
+			msg:   "#EXT-X-INDEPENDENT-SEGMENTS between EXT-X-STREAM-INF and its URI",
+		},
+		{
+			name:  "variant without a bandwidth",
+			input: "#EXTM3U\n#EXT-X-STREAM-INF:CODECS=\"avc1.4d401f\"\na.m3u8\n",
+			line:  2,
+			msg:   "EXT-X-STREAM-INF: missing BANDWIDTH",
+		},
+		{
+			name:  "quoted enumerated value",
+			input: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=\"1\"\na.m3u8\n",
+			line:  2,
+			msg:   "EXT-X-STREAM-INF: BANDWIDTH must not be quoted",
+		},
+		{
+			name:  "unquoted string",
+			input: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1,CODECS=avc1\na.m3u8\n",
+			line:  2,
+			msg:   "EXT-X-STREAM-INF: CODECS must be a quoted string",
+		},
+		{
+			name:  "duplicate attribute",
+			input: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1,BANDWIDTH=2\na.m3u8\n",
+			line:  2,
+			msg:   "duplicate attribute BANDWIDTH",
+		},
+		{
+			name:  "unterminated quoted string",
+			input: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1,CODECS=\"avc1\na.m3u8\n",
+			line:  2,
+			msg:   "unterminated quoted string in CODECS",
+		},
+		{
+			name:  "trailing comma",
+			input: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1,\na.m3u8\n",
+			line:  2,
+			msg:   `unexpected "," after BANDWIDTH`,
+		},
+		{
+			name:  "lowercase attribute name",
+			input: "#EXTM3U\n#EXT-X-STREAM-INF:bandwidth=1\na.m3u8\n",
+			line:  2,
+			msg:   `invalid attribute name "bandwidth"`,
+		},
+		{
+			name:  "session data with both value and URI",
+			input: "#EXTM3U\n#EXT-X-SESSION-DATA:DATA-ID=\"d\",VALUE=\"v\",URI=\"u.json\"\n",
+			line:  2,
+			msg:   "EXT-X-SESSION-DATA: needs either a VALUE or a URI",
+		},
+		{
+			name:  "date range ending before it starts",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-DATERANGE:ID=\"d\",START-DATE=\"2024-01-01T00:00:10Z\",END-DATE=\"2024-01-01T00:00:00Z\"\n#EXTINF:1,\na.ts\n",
+			line:  3,
+			msg:   "EXT-X-DATERANGE: END-DATE is before START-DATE",
+		},
+		{
+			name:  "invalid byte range",
+			input: "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\n#EXT-X-BYTERANGE:10@x\na.ts\n",
+			line:  4,
+			msg:   `invalid EXT-X-BYTERANGE: "x" is not a decimal integer`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(strings.NewReader(tt.input))
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Decode() = %v, want a *SyntaxError", err)
+			}
+			if syntaxErr.Line != tt.line || syntaxErr.Msg != tt.msg {
+				t.Errorf("Decode() = line %d %q, want line %d %q", syntaxErr.Line, syntaxErr.Msg, tt.line, tt.msg)
+			}
+		})
+	}
+}
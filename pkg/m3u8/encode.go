@@ -0,0 +1,277 @@
+package m3u8
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+func (p *MasterPlaylist) Encode() *bytes.Buffer {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", max(p.Version, p.minVersion()))
+	if p.IndependentSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	writeStart(&b, p.Start)
+
+	for _, data := range p.SessionData {
+		var attrs attributeWriter
+		attrs.quoted("DATA-ID", data.DataID)
+		if data.URI != "" {
+			attrs.quoted("URI", data.URI)
+		} else {
+			attrs.quoted("VALUE", data.Value)
+		}
+		attrs.quotedIf("LANGUAGE", data.Language)
+		writeTag(&b, "#EXT-X-SESSION-DATA", attrs.String())
+	}
+	for _, key := range p.SessionKeys {
+		writeTag(&b, "#EXT-X-SESSION-KEY", keyAttributes(key))
+	}
+
+	for _, r := range p.Renditions {
+		var attrs attributeWriter
+		attrs.raw("TYPE", r.Type)
+		attrs.quotedIf("URI", r.URI)
+		attrs.quoted("GROUP-ID", r.GroupID)
+		attrs.quotedIf("LANGUAGE", r.Language)
+		attrs.quotedIf("ASSOC-LANGUAGE", r.AssocLanguage)
+		attrs.quoted("NAME", r.Name)
+		attrs.boolean("DEFAULT", r.Default)
+		attrs.boolean("AUTOSELECT", r.Autoselect)
+		attrs.boolean("FORCED", r.Forced)
+		attrs.quotedIf("INSTREAM-ID", r.InstreamID)
+		attrs.quotedIf("CHARACTERISTICS", r.Characteristics)
+		attrs.quotedIf("CHANNELS", r.Channels)
+		writeTag(&b, "#EXT-X-MEDIA", attrs.String())
+	}
+
+	for _, v := range p.Variants {
+		var attrs attributeWriter
+		attrs.integer("BANDWIDTH", v.Bandwidth)
+		attrs.integerIf("AVERAGE-BANDWIDTH", v.AverageBandwidth)
+		attrs.quotedIf("CODECS", v.Codecs)
+		attrs.resolution("RESOLUTION", v.Resolution)
+		if v.FrameRate > 0 {
+			attrs.raw("FRAME-RATE", strconv.FormatFloat(v.FrameRate, 'f', 3, 64))
+		}
+		attrs.enumIf("HDCP-LEVEL", v.HDCPLevel)
+		attrs.quotedIf("AUDIO", v.Audio)
+		attrs.quotedIf("VIDEO", v.Video)
+		attrs.quotedIf("SUBTITLES", v.Subtitles)
+		switch v.ClosedCaptions {
+		case "":
+		case ClosedCaptionsNone:
+			attrs.raw("CLOSED-CAPTIONS", ClosedCaptionsNone)
+		default:
+			attrs.quoted("CLOSED-CAPTIONS", v.ClosedCaptions)
+		}
+		writeTag(&b, "#EXT-X-STREAM-INF", attrs.String())
+		b.WriteString(v.URI + "\n")
+	}
+
+	for _, v := range p.IFrameVariants {
+		var attrs attributeWriter
+		attrs.integer("BANDWIDTH", v.Bandwidth)
+		attrs.integerIf("AVERAGE-BANDWIDTH", v.AverageBandwidth)
+		attrs.quotedIf("CODECS", v.Codecs)
+		attrs.resolution("RESOLUTION", v.Resolution)
+		attrs.enumIf("HDCP-LEVEL", v.HDCPLevel)
+		attrs.quotedIf("VIDEO", v.Video)
+		attrs.quoted("URI", v.URI)
+		writeTag(&b, "#EXT-X-I-FRAME-STREAM-INF", attrs.String())
+	}
+
+	return &b
+}
+
+func (p *MediaPlaylist) Encode() *bytes.Buffer {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", max(p.Version, p.minVersion()))
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", p.TargetDuration)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.MediaSequence)
+	if p.DiscontinuitySequence > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.DiscontinuitySequence)
+	}
+	if p.PlaylistType != "" {
+		fmt.Fprintf(&b, "#EXT-X-PLAYLIST-TYPE:%s\n", p.PlaylistType)
+	}
+	if p.IFramesOnly {
+		b.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+	}
+	if p.IndependentSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	writeStart(&b, p.Start)
+
+	for _, segment := range p.Segments {
+		if segment.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		for _, key := range segment.Keys {
+			writeTag(&b, "#EXT-X-KEY", keyAttributes(key))
+		}
+		if segment.Map != nil {
+			var attrs attributeWriter
+			attrs.quoted("URI", segment.Map.URI)
+			if segment.Map.ByteRange != nil {
+				attrs.quoted("BYTERANGE", formatByteRange(segment.Map.ByteRange))
+			}
+			writeTag(&b, "#EXT-X-MAP", attrs.String())
+		}
+		if !segment.ProgramDateTime.IsZero() {
+			writeTag(&b, "#EXT-X-PROGRAM-DATE-TIME", formatDate(segment.ProgramDateTime))
+		}
+		for _, dateRange := range segment.DateRanges {
+			writeTag(&b, "#EXT-X-DATERANGE", dateRangeAttributes(dateRange))
+		}
+		fmt.Fprintf(&b, "#EXTINF:%s,%s\n", formatFloat(segment.Duration), segment.Title)
+		if segment.ByteRange != nil {
+			writeTag(&b, "#EXT-X-BYTERANGE", formatByteRange(segment.ByteRange))
+		}
+		b.WriteString(segment.URI + "\n")
+	}
+
+	if p.EndList {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return &b
+}
+
+func (p *MasterPlaylist) WriteTo(w io.Writer) (int64, error) {
+	return p.Encode().WriteTo(w)
+}
+
+func (p *MediaPlaylist) WriteTo(w io.Writer) (int64, error) {
+	return p.Encode().WriteTo(w)
+}
+
+func (p *MasterPlaylist) String() string {
+	return p.Encode().String()
+}
+
+func (p *MediaPlaylist) String() string {
+	return p.Encode().String()
+}
+
+// minVersion is the lowest EXT-X-VERSION that allows every tag and attribute of the
+// playlist (RFC 8216 section 7)
+func (p *MasterPlaylist) minVersion() int {
+	version := 1
+	for _, key := range p.SessionKeys {
+		version = max(version, keyVersion(key))
+	}
+	for _, r := range p.Renditions {
+		if strings.HasPrefix(r.InstreamID, "SERVICE") {
+			version = max(version, 7)
+		}
+	}
+	return version
+}
+
+func (p *MediaPlaylist) minVersion() int {
+	version := 1
+	if p.IFramesOnly {
+		version = max(version, 4)
+	}
+	for _, segment := range p.Segments {
+		if segment.Duration != math.Trunc(segment.Duration) {
+			version = max(version, 3)
+		}
+		if segment.ByteRange != nil {
+			version = max(version, 4)
+		}
+		for _, key := range segment.Keys {
+			version = max(version, keyVersion(key))
+		}
+		if segment.Map != nil {
+			if p.IFramesOnly {
+				version = max(version, 5)
+			} else {
+				version = max(version, 6)
+			}
+		}
+	}
+	return version
+}
+
+func keyVersion(key Key) int {
+	switch {
+	case key.KeyFormat != "" || key.KeyFormatVersions != "":
+		return 5
+	case key.IV != "":
+		return 2
+	default:
+		return 1
+	}
+}
+
+func writeTag(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+func writeStart(b *bytes.Buffer, start *Start) {
+	if start == nil {
+		return
+	}
+	var attrs attributeWriter
+	attrs.float("TIME-OFFSET", start.TimeOffset)
+	attrs.boolean("PRECISE", start.Precise)
+	writeTag(b, "#EXT-X-START", attrs.String())
+}
+
+func keyAttributes(key Key) string {
+	var attrs attributeWriter
+	attrs.raw("METHOD", key.Method)
+	if key.Method == MethodNone {
+		return attrs.String()
+	}
+	attrs.quoted("URI", key.URI)
+	attrs.enumIf("IV", key.IV)
+	attrs.quotedIf("KEYFORMAT", key.KeyFormat)
+	attrs.quotedIf("KEYFORMATVERSIONS", key.KeyFormatVersions)
+	return attrs.String()
+}
+
+func dateRangeAttributes(dateRange DateRange) string {
+	var attrs attributeWriter
+	attrs.quoted("ID", dateRange.ID)
+	attrs.quotedIf("CLASS", dateRange.Class)
+	attrs.date("START-DATE", dateRange.StartDate)
+	if dateRange.EndDate != nil {
+		attrs.date("END-DATE", *dateRange.EndDate)
+	}
+	if dateRange.Duration != nil {
+		attrs.float("DURATION", *dateRange.Duration)
+	}
+	if dateRange.PlannedDuration != nil {
+		attrs.float("PLANNED-DURATION", *dateRange.PlannedDuration)
+	}
+	for _, attr := range dateRange.ClientAttributes {
+		if attr.Quoted {
+			attrs.quoted(attr.Name, attr.Value)
+		} else {
+			attrs.raw(attr.Name, attr.Value)
+		}
+	}
+	attrs.enumIf("SCTE35-CMD", dateRange.SCTE35Cmd)
+	attrs.enumIf("SCTE35-OUT", dateRange.SCTE35Out)
+	attrs.enumIf("SCTE35-IN", dateRange.SCTE35In)
+	attrs.boolean("END-ON-NEXT", dateRange.EndOnNext)
+	return attrs.String()
+}
+
+func formatByteRange(byteRange *ByteRange) string {
+	if byteRange.Offset == nil {
+		return strconv.FormatInt(byteRange.Length, 10)
+	}
+	return fmt.Sprintf("%d@%d", byteRange.Length, *byteRange.Offset)
+}
@@ -0,0 +1,222 @@
+package m3u8
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncode(t *testing.T) {
+	offset := int64(0)
+	tests := []struct {
+		name     string
+		playlist Playlist
+		want     string
+	}{
+		{
+			name: "master",
+			playlist: &MasterPlaylist{
+				IndependentSegments: true,
+				SessionData:         []SessionData{{DataID: "com.example.chapters", URI: "chapters.json"}},
+				SessionKeys:         []Key{{Method: MethodSampleAES, URI: "skd://k", KeyFormat: "com.apple.streamingkeydelivery"}},
+				Renditions: []Rendition{
+					{Type: MediaTypeAudio, GroupID: "aac", Name: "English", Language: "en", Default: true, Autoselect: true, URI: "audio.m3u8"},
+					{Type: MediaTypeClosedCaptions, GroupID: "cc", Name: "Spanish", InstreamID: "SERVICE2"},
+				},
+				Variants: []Variant{
+					{URI: "720p.m3u8", Bandwidth: 2000000, Codecs: "avc1.64001f,mp4a.40.2", Resolution: &Resolution{Width: 1280, Height: 720}, FrameRate: 30, Audio: "aac", ClosedCaptions: "cc"},
+					{URI: "360p.m3u8", Bandwidth: 600000, ClosedCaptions: ClosedCaptionsNone},
+				},
+				IFrameVariants: []IFrameVariant{{URI: "iframes.m3u8", Bandwidth: 90000}},
+			},
+			// SERVICE closed captions and KEYFORMAT raise the version to 7
+			want: `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-SESSION-DATA:DATA-ID="com.example.chapters",URI="chapters.json"
+#EXT-X-SESSION-KEY:METHOD=SAMPLE-AES,URI="skd://k",KEYFORMAT="com.apple.streamingkeydelivery"
+#EXT-X-MEDIA:TYPE=AUDIO,URI="audio.m3u8",GROUP-ID="aac",LANGUAGE="en",NAME="English",DEFAULT=YES,AUTOSELECT=YES
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="Spanish",INSTREAM-ID="SERVICE2"
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=1280x720,FRAME-RATE=30.000,AUDIO="aac",CLOSED-CAPTIONS="cc"
+720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=600000,CLOSED-CAPTIONS=NONE
+360p.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,URI="iframes.m3u8"
+`,
+		},
+		{
+			name: "media",
+			playlist: &MediaPlaylist{
+				Version:        2,
+				TargetDuration: 10,
+				PlaylistType:   PlaylistTypeVOD,
+				Start:          &Start{TimeOffset: 5},
+				Segments: []Segment{
+					{
+						URI:      "a.ts",
+						Duration: 10,
+						Keys:     []Key{{Method: MethodAES128, URI: "key.bin"}},
+					},
+					{
+						URI:             "b.ts",
+						Duration:        9.5,
+						Title:           "second",
+						Discontinuity:   true,
+						ProgramDateTime: time.Date(2024, 5, 1, 8, 30, 0, 250e6, time.UTC),
+					},
+				},
+				EndList: true,
+			},
+			// The fractional duration raises the version to 3
+			want: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-START:TIME-OFFSET=5
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXTINF:10,
+a.ts
+#EXT-X-DISCONTINUITY
+#EXT-X-PROGRAM-DATE-TIME:2024-05-01T08:30:00.250Z
+#EXTINF:9.5,second
+b.ts
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name: "fMP4 with byte ranges",
+			playlist: &MediaPlaylist{
+				TargetDuration: 4,
+				MediaSequence:  7,
+				Segments: []Segment{
+					{
+						URI:       "main.mp4",
+						Duration:  4,
+						Map:       &Map{URI: "main.mp4", ByteRange: &ByteRange{Length: 720, Offset: &offset}},
+						ByteRange: &ByteRange{Length: 1000},
+					},
+				},
+			},
+			want: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-MAP:URI="main.mp4",BYTERANGE="720@0"
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000
+main.mp4
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.playlist.Encode().String(); got != tt.want {
+				t.Errorf("Encode() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// want is the encoded playlist, the input itself when empty
+		want string
+	}{
+		{
+			name: "master",
+			input: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-SESSION-DATA:DATA-ID="com.example.title",VALUE="Tears of Steel",LANGUAGE="en"
+#EXT-X-MEDIA:TYPE=AUDIO,URI="audio/en.m3u8",GROUP-ID="aac",LANGUAGE="en",NAME="English",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2"
+#EXT-X-MEDIA:TYPE=SUBTITLES,URI="subs/en.m3u8",GROUP-ID="subs",LANGUAGE="en",NAME="English",AUTOSELECT=YES,CHARACTERISTICS="public.accessibility.transcribes-spoken-dialog,public.accessibility.describes-music-and-sound"
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,AVERAGE-BANDWIDTH=4200000,CODECS="avc1.640028,mp4a.40.2",RESOLUTION=1920x1080,FRAME-RATE=23.976,AUDIO="aac",SUBTITLES="subs"
+1080p/index.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=150000,CODECS="avc1.640028",RESOLUTION=1920x1080,URI="1080p/iframes.m3u8"
+`,
+		},
+		{
+			name: "media",
+			input: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:42
+#EXT-X-DISCONTINUITY-SEQUENCE:1
+#EXT-X-PLAYLIST-TYPE:EVENT
+#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example.com/?id=1,2",IV=0x00000000000000000000000000000001
+#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00.000Z
+#EXT-X-DATERANGE:ID="break,1",CLASS="com.example.ad",START-DATE="2024-01-01T00:00:00.000Z",PLANNED-DURATION=15,X-COM-EXAMPLE-AD="a,b",SCTE35-OUT=0xFC30
+#EXTINF:5.005,
+segment0.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:6,
+segment1.ts
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name: "BOM, CRLF, comments and unknown tags",
+			input: "\ufeff#EXTM3U\r\n" +
+				"#EXT-X-TARGETDURATION:4\r\n" +
+				"#EXT-X-ALLOW-CACHE:YES\r\n" +
+				"# generated by an encoder\r\n" +
+				"#EXTINF:4,\r\n" +
+				"#EXT-X-CUE-OUT:DURATION=4\r\n" +
+				"a.ts\r\n" +
+				"\r\n" +
+				"#EXT-X-ENDLIST\r\n",
+			want: `#EXTM3U
+#EXT-X-VERSION:1
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:0
+#EXTINF:4,
+a.ts
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name: "unknown tag between a variant and its URI",
+			input: `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1.4d401e,mp4a.40.2"
+#EXT-X-VENDOR-HINT:preferred
+360p.m3u8
+`,
+			want: `#EXTM3U
+#EXT-X-VERSION:1
+#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1.4d401e,mp4a.40.2"
+360p.m3u8
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.want
+			if want == "" {
+				want = tt.input
+			}
+
+			playlist, err := Decode(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("Decode() = %v", err)
+			}
+			encoded := playlist.Encode().String()
+			if encoded != want {
+				t.Errorf("Encode() =\n%s\nwant\n%s", encoded, want)
+			}
+
+			// Once encoded, decoding and encoding again changes nothing
+			again, err := Decode(strings.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("Decode(Encode()) = %v", err)
+			}
+			if got := again.Encode().String(); got != encoded {
+				t.Errorf("Encode(Decode(Encode())) =\n%s\nwant\n%s", got, encoded)
+			}
+		})
+	}
+}
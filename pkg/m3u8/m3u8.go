@@ -0,0 +1,331 @@
+// Package m3u8 reads and writes HLS playlists (RFC 8216).
+//
+// Decode is strict: every tag it knows must be well formed and allowed in the kind of
+// playlist it appears in, or decoding fails with the line at fault. Tags it does not know
+// are ignored, as clients are required to do. Encoding is deterministic: tags and
+// attributes are always written in the same order, so the same playlist always produces
+// the same bytes.
+package m3u8
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"time"
+)
+
+type ListType int
+
+const (
+	Master ListType = iota + 1
+	Media
+)
+
+func (t ListType) String() string {
+	switch t {
+	case Master:
+		return "master"
+	case Media:
+		return "media"
+	default:
+		return "unknown"
+	}
+}
+
+// Playlist is a *MasterPlaylist or a *MediaPlaylist
+type Playlist interface {
+	Type() ListType
+
+	// Encode writes the playlist, raising EXT-X-VERSION if the tags used need a later one
+	Encode() *bytes.Buffer
+	WriteTo(w io.Writer) (int64, error)
+
+	// RewriteURIs replaces every URI of the playlist, in URI lines and URI attributes
+	// alike, with the result of fn
+	RewriteURIs(fn func(uri string) string)
+
+	// Clone returns a deep copy, which can be changed without affecting the original
+	Clone() Playlist
+}
+
+// Values of enumerated attributes
+const (
+	MethodNone      = "NONE"
+	MethodAES128    = "AES-128"
+	MethodSampleAES = "SAMPLE-AES"
+	// MethodSampleAESCTR is common encryption (cenc) of fMP4 segments, from the second
+	// edition of HLS (draft-pantos-hls-rfc8216bis)
+	MethodSampleAESCTR = "SAMPLE-AES-CTR"
+
+	PlaylistTypeEvent = "EVENT"
+	PlaylistTypeVOD   = "VOD"
+
+	MediaTypeAudio          = "AUDIO"
+	MediaTypeVideo          = "VIDEO"
+	MediaTypeSubtitles      = "SUBTITLES"
+	MediaTypeClosedCaptions = "CLOSED-CAPTIONS"
+
+	// ClosedCaptionsNone is the unquoted CLOSED-CAPTIONS=NONE of a variant
+	ClosedCaptionsNone = "NONE"
+)
+
+type MasterPlaylist struct {
+	// Version is the EXT-X-VERSION to write at least, 0 for the lowest the tags allow
+	Version int
+
+	IndependentSegments bool
+	Start               *Start
+
+	SessionData []SessionData
+	SessionKeys []Key
+
+	// Renditions are the EXT-X-MEDIA tags, the alternative audio, video, subtitle and
+	// closed caption renditions that variants refer to by group
+	Renditions     []Rendition
+	Variants       []Variant
+	IFrameVariants []IFrameVariant
+}
+
+type MediaPlaylist struct {
+	Version int
+
+	TargetDuration        int
+	MediaSequence         int
+	DiscontinuitySequence int
+	PlaylistType          string
+	IFramesOnly           bool
+	IndependentSegments   bool
+	Start                 *Start
+
+	Segments []Segment
+	EndList  bool
+}
+
+type Resolution struct {
+	Width  int
+	Height int
+}
+
+// ByteRange is a sub-range of a resource. Offset is nil when the range starts where the
+// previous one of the same resource ended.
+type ByteRange struct {
+	Length int64
+	Offset *int64
+}
+
+type Start struct {
+	TimeOffset float64
+	Precise    bool
+}
+
+// Key is an EXT-X-KEY or EXT-X-SESSION-KEY. IV is kept as written, e.g. "0x0000..."
+type Key struct {
+	Method            string
+	URI               string
+	IV                string
+	KeyFormat         string
+	KeyFormatVersions string
+}
+
+type Map struct {
+	URI       string
+	ByteRange *ByteRange
+}
+
+// Attribute is an attribute this package has no field for, such as the X- attributes of
+// EXT-X-DATERANGE. Value is kept as written, without the quotes of a quoted string.
+type Attribute struct {
+	Name   string
+	Value  string
+	Quoted bool
+}
+
+type DateRange struct {
+	ID              string
+	Class           string
+	StartDate       time.Time
+	EndDate         *time.Time
+	Duration        *float64
+	PlannedDuration *float64
+	SCTE35Cmd       string
+	SCTE35Out       string
+	SCTE35In        string
+	EndOnNext       bool
+
+	ClientAttributes []Attribute
+}
+
+// Segment is a media segment with the tags that precede its URI. Keys and Map are only
+// set on the segment where they appear in the playlist and apply to every segment after
+// it until they are replaced.
+type Segment struct {
+	URI      string
+	Duration float64
+	Title    string
+
+	ByteRange       *ByteRange
+	Discontinuity   bool
+	Keys            []Key
+	Map             *Map
+	ProgramDateTime time.Time
+	DateRanges      []DateRange
+}
+
+type Rendition struct {
+	Type            string
+	URI             string
+	GroupID         string
+	Language        string
+	AssocLanguage   string
+	Name            string
+	Default         bool
+	Autoselect      bool
+	Forced          bool
+	InstreamID      string
+	Characteristics string
+	Channels        string
+}
+
+// Variant is an EXT-X-STREAM-INF tag and the URI of the media playlist that follows it
+type Variant struct {
+	URI              string
+	Bandwidth        int
+	AverageBandwidth int
+	Codecs           string
+	Resolution       *Resolution
+	FrameRate        float64
+	HDCPLevel        string
+
+	// Audio, Video and Subtitles are GROUP-IDs of renditions. ClosedCaptions is a group
+	// or ClosedCaptionsNone.
+	Audio          string
+	Video          string
+	Subtitles      string
+	ClosedCaptions string
+}
+
+type IFrameVariant struct {
+	URI              string
+	Bandwidth        int
+	AverageBandwidth int
+	Codecs           string
+	Resolution       *Resolution
+	HDCPLevel        string
+	Video            string
+}
+
+// SessionData carries either Value or URI
+type SessionData struct {
+	DataID   string
+	Value    string
+	URI      string
+	Language string
+}
+
+func (p *MasterPlaylist) Type() ListType { return Master }
+func (p *MediaPlaylist) Type() ListType  { return Media }
+
+func (p *MasterPlaylist) RewriteURIs(fn func(uri string) string) {
+	for i := range p.SessionData {
+		if p.SessionData[i].URI != "" {
+			p.SessionData[i].URI = fn(p.SessionData[i].URI)
+		}
+	}
+	for i := range p.SessionKeys {
+		if p.SessionKeys[i].URI != "" {
+			p.SessionKeys[i].URI = fn(p.SessionKeys[i].URI)
+		}
+	}
+	for i := range p.Renditions {
+		if p.Renditions[i].URI != "" {
+			p.Renditions[i].URI = fn(p.Renditions[i].URI)
+		}
+	}
+	for i := range p.Variants {
+		p.Variants[i].URI = fn(p.Variants[i].URI)
+	}
+	for i := range p.IFrameVariants {
+		p.IFrameVariants[i].URI = fn(p.IFrameVariants[i].URI)
+	}
+}
+
+func (p *MediaPlaylist) RewriteURIs(fn func(uri string) string) {
+	for i := range p.Segments {
+		segment := &p.Segments[i]
+		segment.URI = fn(segment.URI)
+		for k := range segment.Keys {
+			if segment.Keys[k].URI != "" {
+				segment.Keys[k].URI = fn(segment.Keys[k].URI)
+			}
+		}
+		if segment.Map != nil {
+			segment.Map.URI = fn(segment.Map.URI)
+		}
+	}
+}
+
+// Duration is the sum of the segment durations
+func (p *MediaPlaylist) Duration() float64 {
+	var total float64
+	for _, segment := range p.Segments {
+		total += segment.Duration
+	}
+	return total
+}
+
+func (p *MasterPlaylist) Clone() Playlist {
+	clone := *p
+	clone.Start = clonePointer(p.Start)
+	clone.SessionData = slices.Clone(p.SessionData)
+	clone.SessionKeys = slices.Clone(p.SessionKeys)
+	clone.Renditions = slices.Clone(p.Renditions)
+	clone.Variants = slices.Clone(p.Variants)
+	for i := range clone.Variants {
+		clone.Variants[i].Resolution = clonePointer(clone.Variants[i].Resolution)
+	}
+	clone.IFrameVariants = slices.Clone(p.IFrameVariants)
+	for i := range clone.IFrameVariants {
+		clone.IFrameVariants[i].Resolution = clonePointer(clone.IFrameVariants[i].Resolution)
+	}
+	return &clone
+}
+
+func (p *MediaPlaylist) Clone() Playlist {
+	clone := *p
+	clone.Start = clonePointer(p.Start)
+	clone.Segments = slices.Clone(p.Segments)
+	for i := range clone.Segments {
+		segment := &clone.Segments[i]
+		segment.ByteRange = cloneByteRange(segment.ByteRange)
+		segment.Keys = slices.Clone(segment.Keys)
+		if segment.Map != nil {
+			m := *segment.Map
+			m.ByteRange = cloneByteRange(m.ByteRange)
+			segment.Map = &m
+		}
+		segment.DateRanges = slices.Clone(segment.DateRanges)
+		for j := range segment.DateRanges {
+			dateRange := &segment.DateRanges[j]
+			dateRange.EndDate = clonePointer(dateRange.EndDate)
+			dateRange.Duration = clonePointer(dateRange.Duration)
+			dateRange.PlannedDuration = clonePointer(dateRange.PlannedDuration)
+			dateRange.ClientAttributes = slices.Clone(dateRange.ClientAttributes)
+		}
+	}
+	return &clone
+}
+
+func clonePointer[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func cloneByteRange(b *ByteRange) *ByteRange {
+	if b == nil {
+		return nil
+	}
+	return &ByteRange{Length: b.Length, Offset: clonePointer(b.Offset)}
+}
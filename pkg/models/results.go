@@ -0,0 +1,34 @@
+package models
+
+// EncodingResult is stored with the asynq ResultWriter of every encoding task. Finalize
+// and stitch store the result of the whole job.
+type EncodingResult struct {
+	JobID   string `json:"job_id"`
+	VideoID string `json:"video_id"`
+	Encoder string `json:"encoder,omitempty"`
+
+	Renditions []RenditionResult `json:"renditions,omitempty"`
+
+	// StagesMs is the wall time of each stage in milliseconds, e.g. "download" or "encode_720p"
+	StagesMs map[string]int64 `json:"stages_ms,omitempty"`
+
+	OutputKeys []string `json:"output_keys,omitempty"`
+
+	// ReusedFrom is the video whose renditions were copied instead of encoding the same
+	// source again
+	ReusedFrom string `json:"reused_from,omitempty"`
+}
+
+type RenditionResult struct {
+	Height   int    `json:"height"`
+	Playlist string `json:"playlist"`
+
+	// TargetBitrate is what the encoder was asked for, MeasuredBitrate is the size of the
+	// segments over their duration, both in bits per second
+	TargetBitrate   int `json:"target_bitrate"`
+	MeasuredBitrate int `json:"measured_bitrate"`
+
+	DurationSeconds float64 `json:"duration_seconds"`
+	Segments        int     `json:"segments"`
+	Bytes           int64   `json:"bytes"`
+}
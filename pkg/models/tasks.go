@@ -1,20 +1,291 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
 
 	"github.com/hibiken/asynq"
 )
 
 const (
+	// Deprecated: runs the whole pipeline in a single task. Still handled by the worker so
+	// that tasks queued before the job graph existed can drain.
 	TaskEncodeVideo = "task:encode_video"
+
+	// Job graph: probe -> encode_rendition (1 task per rendition) -> finalize
+	TaskProbeVideo      = "task:probe_video"
+	TaskEncodeRendition = "task:encode_rendition"
+	TaskFinalizeVideo   = "task:finalize_video"
+
+	// Chunked encoding job graph: split -> encode_chunk (fan out) -> stitch
+	TaskSplitVideo  = "task:split_video"
+	TaskEncodeChunk = "task:encode_chunk"
+	TaskStitchVideo = "task:stitch_video"
+
+	TaskDeliverWebhook = "task:deliver_webhook"
+
+	// Maintenance, enqueued periodically by cmd/scheduler
+	TaskReencodeOutdated = "task:reencode_outdated"
+	TaskCollectGarbage   = "task:collect_garbage"
+)
+
+// ProfileVersion is bumped whenever the encoding settings change enough that existing
+// videos should be encoded again, see TaskReencodeOutdated.
+const ProfileVersion = 1
+
+// Queues configured on the worker server, named after the job priority that routes to
+// them. Follow-up tasks of a job (renditions, chunks, finalize) stay in the queue of the
+// task that created them.
+const (
+	QueueCritical = "critical"
+	QueueDefault  = "default"
+	QueueBulk     = "bulk"
 )
 
+// QueueForPriority maps a job priority to its queue. An empty priority is the default.
+func QueueForPriority(priority string) (string, error) {
+	switch priority {
+	case "":
+		return QueueDefault, nil
+	case QueueCritical, QueueDefault, QueueBulk:
+		return priority, nil
+	default:
+		return "", fmt.Errorf("unknown priority %q, expected one of %s, %s, %s", priority, QueueCritical, QueueDefault, QueueBulk)
+	}
+}
+
 type VideoEncodingPayload struct {
+	// JobID and TenantID are assigned by the API when the job is created
+	JobID    string `json:"job_id,omitempty"`
+	TenantID string `json:"tenant_id,omitempty"`
+
+	// Priority is critical, default or bulk, see QueueForPriority
+	Priority string `json:"priority,omitempty"`
+
 	VideoID      string `json:"video_id" binding:"required"`
 	InputFile    string `json:"input_file" binding:"required"`
 	TargetFormat string `json:"target_format" binding:"required"`
 	Resolutions  []int  `json:"resolutions" binding:"required"`
+
+	// WebhookURL receives signed lifecycle events of this job only
+	WebhookURL string `json:"webhook_url,omitempty" binding:"omitempty,url"`
+
+	// ChunkDuration in seconds. When set, the source is split into chunks that are
+	// encoded in parallel across workers instead of one task per rendition.
+	ChunkDuration int `json:"chunk_duration,omitempty"`
+
+	// Visibility is public, unlisted or private, set before the first rendition is
+	// published. Empty keeps the video's current visibility.
+	Visibility string `json:"visibility,omitempty" binding:"omitempty,oneof=public unlisted private"`
+
+	// Encryption encrypts the HLS segments, nil leaves them in the clear
+	Encryption *Encryption `json:"encryption,omitempty"`
+
+	// Overlay burns an image, such as the customer's logo, into every rendition. Not
+	// available for chunked jobs.
+	Overlay *Overlay `json:"overlay,omitempty"`
+
+	// ForensicWatermark encodes every segment twice with different marks, so that the
+	// playback proxy can give each viewer a unique sequence of them. Not available for
+	// chunked jobs.
+	ForensicWatermark bool `json:"forensic_watermark,omitempty"`
+
+	// ProcessAt or ProcessIn (a duration such as "6h") delay the job, e.g. to run
+	// re-encodes off-peak. At most one of them may be set.
+	ProcessAt *time.Time `json:"process_at,omitempty"`
+	ProcessIn string     `json:"process_in,omitempty"`
+}
+
+const (
+	// EncryptionAES128 encrypts whole segments with AES-128-CBC, see EXT-X-KEY METHOD=AES-128
+	EncryptionAES128 = "aes-128"
+	// EncryptionCENC writes fMP4 segments encrypted with common encryption (ISO/IEC 23001-7,
+	// AES-CTR) and a ClearKey pssh box in the init segment, for EME players
+	EncryptionCENC = "cenc"
+	// EncryptionCBCS is the AES-CBC pattern scheme of common encryption. ffmpeg cannot
+	// write it, so it is accepted by the binding only to be refused with a clear error.
+	EncryptionCBCS = "cbcs"
+)
+
+type Encryption struct {
+	Method string `json:"method" binding:"required,oneof=aes-128 cenc cbcs"`
+
+	// KeyRotationSegments starts a new key every that many segments, 0 encrypts a whole
+	// rendition with a single key. Only aes-128 rotates keys.
+	KeyRotationSegments int `json:"key_rotation_segments,omitempty" binding:"min=0"`
+}
+
+// Overlay positions
+const (
+	OverlayTopLeft     = "top-left"
+	OverlayTopRight    = "top-right"
+	OverlayBottomLeft  = "bottom-left"
+	OverlayBottomRight = "bottom-right"
+	OverlayCenter      = "center"
+)
+
+// Overlay is an image burned into the video. Sizes are relative to the height of each
+// rendition, so the image looks the same on every rung of the ladder.
+type Overlay struct {
+	// Image is the object key of the image in the bucket, e.g. a PNG with transparency
+	Image string `json:"image" binding:"required"`
+	// Position is one of the Overlay* positions, bottom-right by default
+	Position string `json:"position,omitempty" binding:"omitempty,oneof=top-left top-right bottom-left bottom-right center"`
+	// Margin from the edges as a fraction of the height, 0.03 by default
+	Margin float64 `json:"margin,omitempty" binding:"min=0,max=0.5"`
+	// Scale is the height of the image as a fraction of the height, 0.1 by default
+	Scale float64 `json:"scale,omitempty" binding:"min=0,max=1"`
+	// Opacity from 0 to 1, 0 is fully opaque like 1
+	Opacity float64 `json:"opacity,omitempty" binding:"min=0,max=1"`
+	// Start and End limit the overlay to a time range in seconds, End 0 is the end of the video
+	Start float64 `json:"start,omitempty" binding:"min=0"`
+	End   float64 `json:"end,omitempty" binding:"min=0"`
+}
+
+// ForensicVariantDir holds the B variant of the segments of a forensically watermarked
+// rendition, under the rendition directory that holds the A variant
+const ForensicVariantDir = "b"
+
+// ScheduleOption maps ProcessAt or ProcessIn onto the matching asynq option. It returns nil
+// when the job should run right away.
+func (p VideoEncodingPayload) ScheduleOption() (asynq.Option, error) {
+	switch {
+	case p.ProcessAt != nil && p.ProcessIn != "":
+		return nil, fmt.Errorf("process_at and process_in cannot be used together")
+	case p.ProcessAt != nil:
+		return asynq.ProcessAt(*p.ProcessAt), nil
+	case p.ProcessIn != "":
+		delay, err := time.ParseDuration(p.ProcessIn)
+		if err != nil || delay < 0 {
+			return nil, fmt.Errorf("process_in must be a positive duration such as 90m or 6h")
+		}
+		return asynq.ProcessIn(delay), nil
+	}
+	return nil, nil
+}
+
+// ProfileKey identifies the encoding settings of a job, independent of the video. Two
+// jobs for the same video with the same profile produce identical output.
+func (p VideoEncodingPayload) ProfileKey() string {
+	resolutions := slices.Clone(p.Resolutions)
+	slices.Sort(resolutions)
+
+	profile := fmt.Appendf(nil, "%s|%v|%d", p.TargetFormat, resolutions, p.ChunkDuration)
+	// Appended only when set, so the key of unencrypted profiles stays what it always was
+	if p.Encryption != nil {
+		profile = fmt.Appendf(profile, "|%s|%d", p.Encryption.Method, p.Encryption.KeyRotationSegments)
+	}
+	if p.ForensicWatermark {
+		profile = append(profile, "|forensic"...)
+	}
+	if o := p.Overlay; o != nil {
+		profile = fmt.Appendf(profile, "|overlay|%s|%s|%g|%g|%g|%g|%g", o.Image, o.Position, o.Margin, o.Scale, o.Opacity, o.Start, o.End)
+	}
+	sum := sha256.Sum256(profile)
+	return hex.EncodeToString(sum[:8])
+}
+
+// JobMaxRetry is the retry budget of the first task of a job. The tenant limiter defers a
+// task by having asynq retry it, which does not use up that budget, but asynq archives a
+// task that has none at all instead of retrying it.
+const JobMaxRetry = 1
+
+// EncodingTaskID is the asynq task ID of the first task of a job, so asynq itself rejects
+// a second identical job while the first one is still queued.
+func (p VideoEncodingPayload) EncodingTaskID() string {
+	return "encode:" + p.VideoID + ":" + p.ProfileKey()
+}
+
+// RenditionTaskID is the asynq task ID of the encode of one rendition of a job, so a
+// probe retried after queueing some of them does not queue them twice.
+func RenditionTaskID(jobID string, height int) string {
+	return fmt.Sprintf("%s:rendition:%d", jobID, height)
+}
+
+// FinalizeTaskID is the asynq task ID of the finalize task of a job, so it is queued only
+// once even when a retried rendition task enqueues it again.
+func FinalizeTaskID(jobID string) string {
+	return jobID + ":finalize"
+}
+
+// ChunkTaskID is the asynq task ID of the encode of one chunk of a chunked job, like
+// RenditionTaskID
+func ChunkTaskID(jobID string, index int) string {
+	return fmt.Sprintf("%s:chunk:%d", jobID, index)
+}
+
+// StitchTaskID is the asynq task ID of the stitch task of a chunked job, like
+// FinalizeTaskID
+func StitchTaskID(jobID string) string {
+	return jobID + ":stitch"
+}
+
+type ReencodeOutdatedPayload struct {
+	// Limit caps how many videos a single run queues
+	Limit int `json:"limit"`
+}
+
+type GarbageCollectionPayload struct {
+	// OlderThanHours spares every prefix written to more recently
+	OlderThanHours int `json:"older_than_hours"`
+	// DryRun only reports what would be deleted
+	DryRun bool `json:"dry_run"`
+}
+
+type RenditionEncodingPayload struct {
+	JobID     string `json:"job_id"`
+	TenantID  string `json:"tenant_id"`
+	VideoID   string `json:"video_id"`
+	InputFile string `json:"input_file"`
+	Height    int    `json:"height"`
+	HasAudio  bool   `json:"has_audio"`
+
+	// Renditions is the full ladder of the job, used to publish the master playlist
+	Renditions []int `json:"renditions"`
+
+	Encryption        *Encryption `json:"encryption,omitempty"`
+	Overlay           *Overlay    `json:"overlay,omitempty"`
+	ForensicWatermark bool        `json:"forensic_watermark,omitempty"`
+}
+
+type FinalizePayload struct {
+	JobID      string `json:"job_id"`
+	VideoID    string `json:"video_id"`
+	Renditions []int  `json:"renditions"`
+}
+
+type ChunkEncodingPayload struct {
+	JobID      string      `json:"job_id"`
+	TenantID   string      `json:"tenant_id"`
+	VideoID    string      `json:"video_id"`
+	ChunkIndex int         `json:"chunk_index"`
+	ChunkCount int         `json:"chunk_count"`
+	ChunkStart float64     `json:"chunk_start"` // seconds into the source
+	Renditions []int       `json:"renditions"`
+	HasAudio   bool        `json:"has_audio"`
+	Encryption *Encryption `json:"encryption,omitempty"`
+}
+
+type StitchPayload struct {
+	JobID      string      `json:"job_id"`
+	VideoID    string      `json:"video_id"`
+	ChunkCount int         `json:"chunk_count"`
+	Renditions []int       `json:"renditions"`
+	HasAudio   bool        `json:"has_audio"`
+	Encryption *Encryption `json:"encryption,omitempty"`
+}
+
+type WebhookDeliveryPayload struct {
+	DeliveryID string `json:"delivery_id"`
+	TenantID   string `json:"tenant_id"`
+	// EndpointID of a registered endpoint, empty for a per job webhook_url
+	EndpointID string          `json:"endpoint_id,omitempty"`
+	URL        string          `json:"url"`
+	Event      json.RawMessage `json:"event"`
 }
 
 func NewVideoEncodingTask(data VideoEncodingPayload) (*asynq.Task, error) {
@@ -24,3 +295,84 @@ func NewVideoEncodingTask(data VideoEncodingPayload) (*asynq.Task, error) {
 	}
 	return asynq.NewTask(TaskEncodeVideo, payload), nil
 }
+
+// NewEncodingJobTask creates the first task of a job: a split when the job is chunked, a
+// probe otherwise.
+func NewEncodingJobTask(data VideoEncodingPayload) (*asynq.Task, error) {
+	if data.ChunkDuration > 0 {
+		return NewSplitVideoTask(data)
+	}
+	return NewProbeVideoTask(data)
+}
+
+func NewProbeVideoTask(data VideoEncodingPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TaskProbeVideo, payload), nil
+}
+
+func NewRenditionEncodingTask(data RenditionEncodingPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TaskEncodeRendition, payload), nil
+}
+
+func NewFinalizeTask(data FinalizePayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TaskFinalizeVideo, payload), nil
+}
+
+func NewSplitVideoTask(data VideoEncodingPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TaskSplitVideo, payload), nil
+}
+
+func NewChunkEncodingTask(data ChunkEncodingPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TaskEncodeChunk, payload), nil
+}
+
+func NewStitchTask(data StitchPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TaskStitchVideo, payload), nil
+}
+
+func NewWebhookDeliveryTask(data WebhookDeliveryPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TaskDeliverWebhook, payload), nil
+}
+
+func NewReencodeOutdatedTask(data ReencodeOutdatedPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TaskReencodeOutdated, payload), nil
+}
+
+func NewGarbageCollectionTask(data GarbageCollectionPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TaskCollectGarbage, payload), nil
+}